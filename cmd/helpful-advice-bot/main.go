@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/davhofer/botsky/pkg/botsky"
 	"github.com/davhofer/botsky/pkg/listeners"
@@ -10,8 +11,8 @@ import (
 	"encoding/json"
 	"math/rand/v2"
 	"net/http"
+	"time"
 
-	"github.com/davhofer/indigo/api/bsky"
 	"github.com/davhofer/indigo/api/chat"
 )
 
@@ -23,81 +24,71 @@ type Response struct {
 	Slip Slip `json:"slip"`
 }
 
-func MentionHandler(ctx context.Context, client *botsky.Client, notifications []*bsky.NotificationListNotifications_Notification) {
-
-	// iterate over all notifications
-	for _, notif := range notifications {
-		// only consider mentions
-		if notif.Reason == "mention" {
-			fmt.Println("mention received")
-			// Uri is the mentioning post
-			post, err := client.GetPost(ctx, notif.Uri)
-			if err != nil {
-				fmt.Println(err)
-			}
-
-			textLower := strings.ToLower(post.Text)
-			if strings.Contains(textLower, "advice") || strings.Contains(textLower, "help") {
-				pb := botsky.NewPostBuilder("gotcha, sliding into those DMs").ReplyTo(notif.Uri)
-				_, _, err := client.Post(ctx, pb)
-				if err != nil {
-					fmt.Println(err)
-					return
-				}
+func MentionHandler(ctx context.Context, client *botsky.Client, mention *listeners.MentionEvent) error {
+	logger := client.Logger().With("author", mention.Author.Did, "uri", mention.Uri)
+	logger.Info("Mention received")
 
-				// slide into DMs
-				authorDid := notif.Author.Did
-
-				if _, _, err := client.ChatSendMessage(ctx, authorDid, "you ready for some great advice?"); err != nil {
-					fmt.Println("chat error", err)
-					fmt.Println(err.Error())
+	textLower := strings.ToLower(mention.Post.Text)
+	if strings.Contains(textLower, "advice") || strings.Contains(textLower, "help") {
+		pb := botsky.NewPostBuilder("gotcha, sliding into those DMs").ReplyTo(mention.Uri)
+		_, _, err := client.Post(ctx, pb)
+		if err != nil {
+			return err
+		}
 
-					if strings.Contains(err.Error(), "recipient requires incoming messages to come from someone they follow") {
-						pb := botsky.NewPostBuilder("you gotta let me message you, either follow me or open up DMs in your chat settings, then try again").ReplyTo(notif.Uri)
-						client.Post(ctx, pb)
+		// slide into DMs
+		authorDid := mention.Author.Did
 
-					} else if strings.Contains(err.Error(), "recipient has disabled incoming messages") {
-						pb := botsky.NewPostBuilder("you gotta let me message you, change your chat settings and maybe follow me, then try again").ReplyTo(notif.Uri)
-						client.Post(ctx, pb)
-					}
-					return
+		if _, _, err := client.ChatSendMessage(ctx, authorDid, "you ready for some great advice?"); err != nil {
+			if errors.Is(err, botsky.ErrChatRecipientDisallowed) {
+				logger.Info("Author doesn't accept messages from the bot", "error", err)
+				pb := botsky.NewPostBuilder("you gotta let me message you, either follow me or open up DMs in your chat settings, then try again").ReplyTo(mention.Uri)
+				if _, _, err := client.Post(ctx, pb); err != nil {
+					return fmt.Errorf("replying to mention: %w", err)
 				}
+				return nil
+			}
+			return fmt.Errorf("sending chat message: %w", err)
+		}
 
-				advice, err := getAdvice()
-				if err != nil {
-					fmt.Println(err)
-					return
-				}
-				_, _, err = client.ChatSendMessage(ctx, authorDid, "As my mama used to say, "+strings.ToLower(advice))
-				if err != nil {
-					fmt.Println(err)
-					return
-				}
-				client.ChatSendMessage(ctx, authorDid, "you're welcome")
-				client.ChatSendMessage(ctx, authorDid, "alright gotta go, the world needs me")
-
-			} else {
-				pb := botsky.NewPostBuilder("idk what you want from me...\nlet me know if you need some great advice").ReplyTo(notif.Uri)
-				_, _, err := client.Post(ctx, pb)
-				if err != nil {
-					fmt.Println(err)
-				}
+		advice, err := getAdvice()
+		if err != nil {
+			return err
+		}
+		logger.Debug("Sending advice", "advice", advice)
+		messages := []string{
+			"As my mama used to say, " + strings.ToLower(advice),
+			"you're welcome",
+			"alright gotta go, the world needs me",
+		}
+		for _, message := range messages {
+			if _, _, err := client.ChatSendMessage(ctx, authorDid, message); err != nil {
+				return fmt.Errorf("sending chat message: %w", err)
 			}
 		}
+
+	} else {
+		pb := botsky.NewPostBuilder("idk what you want from me...\nlet me know if you need some great advice").ReplyTo(mention.Uri)
+		if _, _, err := client.Post(ctx, pb); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-func ChatMessageHandler(ctx context.Context, client *botsky.Client, chatElems []*chat.ConvoGetLog_Output_Logs_Elem) {
+func ChatMessageHandler(ctx context.Context, client *botsky.Client, chatElems []*chat.ConvoGetLog_Output_Logs_Elem) error {
+	var errs []error
 	for _, elem := range chatElems {
 		if elem.ConvoDefs_LogCreateMessage != nil && elem.ConvoDefs_LogCreateMessage.Message.ConvoDefs_MessageView.Sender.Did != client.Did {
 			convoId := elem.ConvoDefs_LogCreateMessage.ConvoId
 			reply := "sorry I'm way too busy for you right now"
 			if _, _, err := client.ChatConvoSendMessage(ctx, convoId, reply); err != nil {
-				fmt.Println("Error:", err)
+				errs = append(errs, err)
 				continue
 			}
 		}
 	}
+	return errors.Join(errs...)
 }
 
 func getAdvice() (string, error) {
@@ -119,7 +110,6 @@ func getAdvice() (string, error) {
 	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
 		return "", err
 	}
-	fmt.Println("advice:", r.Slip.Advice)
 	return r.Slip.Advice, nil
 }
 
@@ -141,6 +131,7 @@ func main() {
 		fmt.Println(err)
 		return
 	}
+	defer client.Close()
 
 	err = client.Authenticate(ctx)
 	if err != nil {
@@ -148,13 +139,13 @@ func main() {
 		return
 	}
 
-	fmt.Println("Authentication successful")
+	client.Logger().Info("Authentication successful")
 
 	botsky.Sleep(1)
 
 	mentionListener := listeners.NewPollingNotificationListener(ctx, client)
 
-	if err := mentionListener.RegisterHandler("replyToMentions", MentionHandler); err != nil {
+	if err := mentionListener.OnMention("replyToMentions", MentionHandler); err != nil {
 		fmt.Println(err)
 		return
 	}
@@ -168,10 +159,15 @@ func main() {
 	mentionListener.Start()
 	chatListener.Start()
 
-	botsky.WaitUntilCancel()
-
-	mentionListener.Stop()
+	botsky.WaitUntilCancel(client.Logger())
 
-	chatListener.Stop()
-	botsky.Sleep(3)
+	// give running handlers some time to finish
+	shutdownCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err := mentionListener.Shutdown(shutdownCtx); err != nil {
+		client.Logger().Error("Stopping mention listener failed", "error", err)
+	}
+	if err := chatListener.Shutdown(shutdownCtx); err != nil {
+		client.Logger().Error("Stopping chat listener failed", "error", err)
+	}
 }
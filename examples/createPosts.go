@@ -24,6 +24,7 @@ func createPosts() {
 		fmt.Println(err)
 		return
 	}
+	defer client.Close()
 
 	err = client.Authenticate(ctx)
 	if err != nil {
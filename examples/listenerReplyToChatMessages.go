@@ -11,7 +11,7 @@ import (
 
 // example handler that replies to dms by repeating their content
 // gets called by the listener when there are new messages
-func ExampleChatMessageHandler(ctx context.Context, client *botsky.Client, chatElems []*chat.ConvoGetLog_Output_Logs_Elem) {
+func ExampleChatMessageHandler(ctx context.Context, client *botsky.Client, chatElems []*chat.ConvoGetLog_Output_Logs_Elem) error {
 	// iterate over all new chat logs
 	for _, elem := range chatElems {
 		// only consider messages from other people
@@ -21,10 +21,11 @@ func ExampleChatMessageHandler(ctx context.Context, client *botsky.Client, chatE
 			msgText := elem.ConvoDefs_LogCreateMessage.Message.ConvoDefs_MessageView.Text
 			reply := "You said: '" + msgText + "'"
 			if _, _, err := client.ChatConvoSendMessage(ctx, convoId, reply); err != nil {
-				fmt.Println("Error:", err)
+				return err
 			}
 		}
 	}
+	return nil
 }
 
 // Note: in my testing, seeing the replies pop up in the web interface often took a few seconds/required me to refresh the page
@@ -44,6 +45,7 @@ func listenerReplyToChatMessages() {
 		fmt.Println(err)
 		return
 	}
+	defer client.Close()
 
 	err = client.Authenticate(ctx)
 	if err != nil {
@@ -61,7 +63,7 @@ func listenerReplyToChatMessages() {
 
 	listener.Start()
 
-	botsky.WaitUntilCancel()
+	botsky.WaitUntilCancel(client.Logger())
 
 	listener.Stop()
 
@@ -11,7 +11,7 @@ import (
 
 // example handler that replies to mentions
 // gets called by the listener
-func ExampleMentionHandler(ctx context.Context, client *botsky.Client, notifications []*bsky.NotificationListNotifications_Notification) {
+func ExampleMentionHandler(ctx context.Context, client *botsky.Client, notifications []*bsky.NotificationListNotifications_Notification) error {
 	// iterate over all notifications
 	for _, notif := range notifications {
 		// only consider mentions
@@ -19,9 +19,13 @@ func ExampleMentionHandler(ctx context.Context, client *botsky.Client, notificat
 			// Uri is the mentioning post
 			pb := botsky.NewPostBuilder("hello :)").ReplyTo(notif.Uri)
 			cid, uri, err := client.Post(ctx, pb)
-			fmt.Println("Posted:", cid, uri, err)
+			if err != nil {
+				return err
+			}
+			fmt.Println("Posted:", cid, uri)
 		}
 	}
+	return nil
 }
 
 func listenerReplyToMentions() {
@@ -40,6 +44,7 @@ func listenerReplyToMentions() {
 		fmt.Println(err)
 		return
 	}
+	defer client.Close()
 
 	err = client.Authenticate(ctx)
 	if err != nil {
@@ -60,7 +65,7 @@ func listenerReplyToMentions() {
 
 	listener.Start()
 
-	botsky.WaitUntilCancel()
+	botsky.WaitUntilCancel(client.Logger())
 
 	listener.Stop()
 
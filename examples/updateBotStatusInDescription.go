@@ -14,6 +14,7 @@ func runBot(handle, appkey, profileDescription string) error {
 	if err != nil {
 		return err
 	}
+	defer client.Close()
 	err = client.Authenticate(ctx)
 	if err != nil {
 		return err
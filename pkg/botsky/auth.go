@@ -2,7 +2,10 @@ package botsky
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"strings"
 	"time"
 
 	"github.com/davhofer/indigo/api/atproto"
@@ -10,10 +13,39 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
-// Extracts the remaining time until expiry from a jwt string
-func getJwtTimeRemaining(tokenString string) (time.Duration, error) {
-	// TODO: improve this?
-	token, _, _ := jwt.NewParser().ParseUnverified(tokenString, jwt.MapClaims{})
+// Returned by Authenticate if the account has email two-factor authentication enabled and no sign-in code
+// (auth factor token) could be obtained, see WithAuthFactorTokenPrompt.
+var ErrAuthFactorTokenRequired = errors.New("account requires a sign-in code (auth factor token) sent by email")
+
+const (
+	refreshBeforeExpiry = time.Minute      // refresh the session this long before the access token expires
+	refreshMinBackoff   = 5 * time.Second  // initial delay before retrying a failed refresh
+	refreshMaxBackoff   = 10 * time.Minute // maximum delay between retries of a failed refresh
+)
+
+// Time source of the session refresher, replaced in tests.
+type clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) (<-chan time.Time, func() bool)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	timer := time.NewTimer(d)
+	return timer.C, timer.Stop
+}
+
+// Extracts the remaining time (from now) until expiry from a jwt string
+func getJwtTimeRemaining(tokenString string, now time.Time) (time.Duration, error) {
+	token, _, err := jwt.NewParser().ParseUnverified(tokenString, jwt.MapClaims{})
+	if err != nil {
+		return 0, fmt.Errorf("Cannot parse JWT: %v", err)
+	}
 
 	// Extract claims
 	claims, ok := token.Claims.(jwt.MapClaims)
@@ -26,90 +58,282 @@ func getJwtTimeRemaining(tokenString string) (time.Duration, error) {
 	}
 	// Calculate the time remaining
 	expTimeUnix := time.Unix(expTime.Unix(), 0)
-	return time.Until(expTimeUnix), nil
+	return expTimeUnix.Sub(now), nil
+}
+
+// Returns a fresh XRPC client for the PDS, authenticated with the given token (or unauthenticated if it is empty).
+//
+// Used for session management calls, so they never modify the auth state shared with in-flight requests.
+func (c *Client) sessionXrpcClient(bearerJwt string) *xrpc.Client {
+	xrpcClient := &xrpc.Client{
+		Client:    c.sessionHTTPClient,
+		Host:      c.xrpcClient.GetHostAsync(),
+		UserAgent: c.xrpcClient.GetUserAgentAsync(),
+	}
+	if bearerJwt != "" {
+		xrpcClient.Auth = &xrpc.AuthInfo{AccessJwt: bearerJwt}
+	}
+	return xrpcClient
 }
 
 // Update the clients auth info with the given JWTs, handle, and did.
 //
-// This will also start a new goroutine to refresh the session before this one expires
+// The session is persisted if the client has a session store (see WithSessionStore).
+// This also starts the client's background refresher (once), which refreshes the session before it expires.
 func (c *Client) UpdateAuth(ctx context.Context, accessJwt string, refreshJwt string, handle string, did string) error {
-	c.xrpcClient.SetAuthAsync(xrpc.AuthInfo{
+	now := c.clock.Now()
+	tRemaining, err := getJwtTimeRemaining(accessJwt, now)
+	if err != nil {
+		return fmt.Errorf("UpdateAuth error: %v", err)
+	}
+	c.setAuth(ctx, xrpc.AuthInfo{
 		AccessJwt:  accessJwt,
 		RefreshJwt: refreshJwt,
 		Handle:     handle,
 		Did:        did,
-	})
+	}, now.Add(tRemaining))
+	return nil
+}
 
+// Set the auth info of the XRPC clients and (re)schedule the background refresher for the given expiry time.
+func (c *Client) setAuth(ctx context.Context, auth xrpc.AuthInfo, expiresAt time.Time) {
+	c.xrpcClient.SetAuthAsync(auth)
 	if c.chatClient != nil {
-		c.chatClient.SetAuthAsync(xrpc.AuthInfo{
-			AccessJwt:  accessJwt,
-			RefreshJwt: refreshJwt,
-			Handle:     handle,
-			Did:        did,
-		})
+		c.chatClient.SetAuthAsync(auth)
 	}
+	c.authExpiry.Store(expiresAt.Unix())
+	c.saveSession(ctx)
 
-	// Start timer for expiration of AccessJWT and session refresh
-	// parse time until expiration from accessJwt
-	tRemaining, err := getJwtTimeRemaining(accessJwt)
-	if err != nil {
-		return fmt.Errorf("UpdateAuth error: %v", err)
+	c.refresherOnce.Do(func() {
+		c.refresherWg.Add(1)
+		go c.refreshLoop()
+	})
+	// wake up the refresher so it reschedules based on the new token
+	select {
+	case c.refresherWake <- struct{}{}:
+	default:
 	}
+}
 
-	timer := time.NewTimer(tRemaining - time.Minute)
-	// start refresher goroutine in background
-	go c.RefreshSession(ctx, timer)
-	return nil
+// Refresh the client's session right away.
+//
+// Uses the refresh token if it is still valid, and falls back to a full login (Authenticate) otherwise.
+// The session is normally refreshed automatically in the background, so this rarely needs to be called directly.
+func (c *Client) RefreshSession(ctx context.Context) error {
+	c.sessionLock.Lock()
+	defer c.sessionLock.Unlock()
+	return c.refreshSession(ctx, true)
 }
 
-// Refreshes the client's session once the timer expires
-func (c *Client) RefreshSession(ctx context.Context, timer *time.Timer) {
-	// wait until timer fires
-	<-timer.C
+// Refreshes the session. Must be called with sessionLock held.
+//
+// prompt is passed on to authenticate, it is false for refreshes in the background.
+func (c *Client) refreshSession(ctx context.Context, prompt bool) error {
+	if oauth := c.oauth.Load(); oauth != nil {
+		if err := c.oauthRefresh(ctx, oauth); err != nil {
+			return fmt.Errorf("RefreshSession error (oauthRefresh): %w", err)
+		}
+		return nil
+	}
 
-	c.refreshProcessLock.Lock()
-	defer c.refreshProcessLock.Unlock()
+	auth := c.xrpcClient.GetAuthAsync()
 
 	// check that RefreshJWT is still (for some time) valid
-	auth := c.xrpcClient.GetAuthAsync()
-	if tRemaining, _ := getJwtTimeRemaining(auth.RefreshJwt); tRemaining > 30*time.Second {
-		// set access jwt to refresh jwt
-		auth.AccessJwt = auth.RefreshJwt
-		c.xrpcClient.SetAuthAsync(auth)
-		// refresh the session
-		session, err := atproto.ServerRefreshSession(ctx, c.xrpcClient)
-
-		if err != nil { // log error if it happened
-			logger.Println("RefreshSession error (ServerRefreshSession):", err)
-		} else if err := c.UpdateAuth(ctx, session.AccessJwt, session.RefreshJwt, session.Handle, session.Did); err != nil { // otherwise try to update auth
-			logger.Println("RefreshSession error (UpdateAuth):", err)
+	if tRemaining, err := getJwtTimeRemaining(auth.RefreshJwt, c.clock.Now()); err == nil && tRemaining > 30*time.Second {
+		session, err := atproto.ServerRefreshSession(ctx, c.sessionXrpcClient(auth.RefreshJwt))
+		if err == nil {
+			if err := c.UpdateAuth(ctx, session.AccessJwt, session.RefreshJwt, session.Handle, session.Did); err != nil {
+				return fmt.Errorf("RefreshSession error (UpdateAuth): %v", err)
+			}
+			return nil
+		}
+		if isTransientError(err) {
+			// the PDS is unavailable, a full login would fail as well
+			return fmt.Errorf("RefreshSession error (ServerRefreshSession): %w", err)
+		}
+		c.logger.Warn("Refreshing session failed, logging in again", "error", err)
+	}
+
+	// otherwise, perform full auth
+	if err := c.authenticate(ctx, prompt); err != nil {
+		return fmt.Errorf("RefreshSession error: %w", err)
+	}
+	return nil
+}
+
+// Background loop refreshing the session shortly before the access token expires.
+//
+// Runs until Close is called. Transient failures (PDS unavailable) are retried with exponential backoff.
+// Permanent failures are reported through the OnAuthError callback and stop the refresher until the auth
+// is updated, e.g. by calling Authenticate. The sign-in code prompt is never used in the background.
+func (c *Client) refreshLoop() {
+	defer c.refresherWg.Done()
+
+	backoff := time.Duration(0)
+	for {
+		var wait time.Duration
+		if backoff < 0 {
+			// stopped after a permanent failure, wait for new auth
+			select {
+			case <-c.ctx.Done():
+				return
+			case <-c.refresherWake:
+				backoff = 0
+				continue
+			}
+		}
+		if backoff > 0 {
+			wait = backoff
 		} else {
-			// if neither of the above returned an error, we successfully updated auth
+			wait = max(0, time.Unix(c.authExpiry.Load(), 0).Sub(c.clock.Now())-refreshBeforeExpiry)
+		}
+
+		timer, stop := c.clock.NewTimer(wait)
+		select {
+		case <-c.ctx.Done():
+			stop()
+			return
+		case <-c.refresherWake:
+			// auth was updated, reschedule
+			stop()
+			backoff = 0
+			continue
+		case <-timer:
+		}
+
+		c.sessionLock.Lock()
+		err := c.refreshSession(c.ctx, false)
+		c.sessionLock.Unlock()
+		// the successful refresh woke us up, discard that signal
+		select {
+		case <-c.refresherWake:
+		default:
+		}
+
+		switch {
+		case err == nil:
+			backoff = 0
+		case c.ctx.Err() != nil:
 			return
+		case isTransientError(err):
+			backoff = min(max(2*backoff, refreshMinBackoff), refreshMaxBackoff)
+			c.logger.Warn("Session refresh failed, retrying", "error", err, "backoff", backoff)
+		default:
+			// credentials are not accepted anymore, retrying won't help until they are updated
+			backoff = -1
+			c.reportAuthError(err)
 		}
 	}
+}
 
-	// otherwise, perform full auth
-	if err := c.Authenticate(ctx); err != nil {
-		logger.Println("RefreshSession error (Authenticate):", err)
+// Report an error which requires intervention (e.g. revoked app password).
+func (c *Client) reportAuthError(err error) {
+	c.logger.Error("Authentication failed", "error", err)
+	if c.onAuthError != nil {
+		c.onAuthError(err)
+	}
+}
+
+// Refresh the session after a request failed with ExpiredToken.
+//
+// usedJwt is the token the failed request was sent with. If the session was refreshed in the meantime
+// (e.g. by a concurrent request), it isn't refreshed again.
+func (c *Client) refreshExpiredSession(ctx context.Context, usedJwt string) error {
+	c.sessionLock.Lock()
+	defer c.sessionLock.Unlock()
+	if c.xrpcClient.GetAuthAsync().AccessJwt != usedJwt {
+		return nil
+	}
+	if err := c.refreshSession(ctx, false); err != nil {
+		if !isTransientError(err) {
+			c.reportAuthError(err)
+		}
+		return err
 	}
+	return nil
+}
+
+// Whether the error is an XRPC error response with the given error name (e.g. "ExpiredToken").
+func isXrpcErrorName(err error, name string) bool {
+	var xrpcErr *xrpc.XRPCError
+	return errors.As(err, &xrpcErr) && xrpcErr.ErrStr == name
+}
+
+// Whether the error is caused by the server or network being (temporarily) unavailable: network errors
+// (see isNetworkError), 5xx and 429 responses. Anything else (e.g. rejected credentials) is permanent.
+func isTransientError(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var xrpcErr *xrpc.Error
+	if errors.As(err, &xrpcErr) {
+		return xrpcErr.StatusCode >= 500 || xrpcErr.StatusCode == http.StatusTooManyRequests
+	}
+	var oauthErr *OAuthError
+	if errors.As(err, &oauthErr) {
+		return oauthErr.StatusCode >= 500 || oauthErr.StatusCode == http.StatusTooManyRequests
+	}
+	return errors.Is(err, ErrRateLimited) || isNetworkError(err)
+}
+
+// Stop the background session refresher. The client must not be used afterwards.
+func (c *Client) Close() error {
+	c.cancel()
+	c.refresherWg.Wait()
+	return nil
 }
 
 // Authenticates the client with the given credentials and updates its auth info.
 //
-// A background goroutine to automatically refresh the session is started through client.UpdateAuth
+// The background session refresher is started through client.UpdateAuth
 func (c *Client) Authenticate(ctx context.Context) error {
-	// reset auth
-	c.xrpcClient.SetAuthAsync(xrpc.AuthInfo{})
+	c.sessionLock.Lock()
+	defer c.sessionLock.Unlock()
+	return c.authenticate(ctx, true)
+}
+
+// Performs the login. Must be called with sessionLock held.
+//
+// The sign-in code prompt is only used if prompt is set. Otherwise, a required code fails the login with
+// ErrAuthFactorTokenRequired, as nobody might be there to enter it.
+func (c *Client) authenticate(ctx context.Context, prompt bool) error {
+	if c.oauth.Load() != nil {
+		return fmt.Errorf("Authenticate error: %w", ErrOAuthReauthorizationRequired)
+	}
+	// resolve DID and PDS if NewClient didn't do it
+	if c.Did == "" || c.xrpcClient.GetHostAsync() == "" {
+		if err := c.resolveIdentity(ctx); err != nil {
+			return fmt.Errorf("Authenticate error (resolveIdentity): %w", err)
+		}
+	}
+	// get the current credentials, they might have been rotated since the last login
+	if c.credentials != nil {
+		creds, err := c.credentials.Credentials(ctx)
+		if err != nil {
+			return fmt.Errorf("Authenticate error (CredentialProvider): %w", err)
+		}
+		c.appkey = creds.Appkey
+	}
 	// create new session and authenticate with handle and appkey
 	sessionCredentials := &atproto.ServerCreateSession_Input{
 		Identifier: c.Handle,
 		Password:   c.appkey,
 	}
-	session, err := atproto.ServerCreateSession(ctx, c.xrpcClient, sessionCredentials)
+	session, err := atproto.ServerCreateSession(ctx, c.sessionXrpcClient(""), sessionCredentials)
+	if isXrpcErrorName(err, "AuthFactorTokenRequired") {
+		if c.authPrompt == nil || !prompt {
+			return fmt.Errorf("Authenticate error (ServerCreateSession): %w", ErrAuthFactorTokenRequired)
+		}
+		token, promptErr := c.authPrompt(ctx)
+		if promptErr != nil {
+			return fmt.Errorf("Authenticate error (auth factor token prompt): %w: %v", ErrAuthFactorTokenRequired, promptErr)
+		}
+		token = strings.TrimSpace(token)
+		sessionCredentials.AuthFactorToken = &token
+		session, err = atproto.ServerCreateSession(ctx, c.sessionXrpcClient(""), sessionCredentials)
+	}
 	if err != nil {
-		// TODO: how to handle this error? if called as goroutine, it will be lost
-		return fmt.Errorf("Authenticate error (ServerCreateSession): %v", err)
+		return fmt.Errorf("Authenticate error (ServerCreateSession): %w", xrpcError(err))
 	}
 	if err := c.UpdateAuth(ctx, session.AccessJwt, session.RefreshJwt, session.Handle, session.Did); err != nil {
 		return fmt.Errorf("Authenticate error (UpdateAuth): %v", err)
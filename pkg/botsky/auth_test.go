@@ -0,0 +1,514 @@
+package botsky
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/davhofer/indigo/xrpc"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Manually advanced clock. Timers fire when the clock is advanced past their deadline.
+type fakeClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	timers  []*fakeTimer
+	created chan time.Duration // durations of the created timers
+}
+
+type fakeTimer struct {
+	at      time.Time
+	c       chan time.Time
+	stopped bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1_700_000_000, 0), created: make(chan time.Duration, 100)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	timer := &fakeTimer{at: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		timer.c <- c.now
+	} else {
+		c.timers = append(c.timers, timer)
+	}
+	c.created <- d
+	return timer.c, func() bool {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		wasActive := !timer.stopped
+		timer.stopped = true
+		return wasActive
+	}
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+	active := c.timers[:0]
+	for _, timer := range c.timers {
+		switch {
+		case timer.stopped:
+		case !timer.at.After(c.now):
+			timer.c <- c.now
+		default:
+			active = append(active, timer)
+		}
+	}
+	c.timers = active
+}
+
+// Wait until a timer with the given duration is created.
+func (c *fakeClock) waitForTimer(t *testing.T, d time.Duration) {
+	t.Helper()
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case created := <-c.created:
+			if created == d {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("no timer of %v was created", d)
+		}
+	}
+}
+
+// Local stand-in for the XRPC session endpoints of a PDS.
+type fakePDS struct {
+	*httptest.Server
+	clock *fakeClock
+
+	mutex           sync.Mutex
+	access          string // the currently accepted access token
+	refresh         string
+	issued          int
+	refreshStatus   int    // status of refreshSession responses, 0 for success
+	createStatus    int    // status of createSession responses, 0 for success
+	createError     string // error name of failed createSession responses
+	authFactorToken string // sign-in code required by createSession, "" for none
+
+	creates   atomic.Int64
+	refreshes atomic.Int64
+	requests  atomic.Int64 // other requests
+	handler   http.HandlerFunc
+}
+
+func newFakePDS(t *testing.T, clock *fakeClock) *fakePDS {
+	pds := &fakePDS{clock: clock}
+	pds.Server = httptest.NewServer(http.HandlerFunc(pds.serve))
+	t.Cleanup(pds.Close)
+	return pds
+}
+
+func (p *fakePDS) token(validFor time.Duration) string {
+	p.issued++
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"exp": p.clock.Now().Add(validFor).Unix(),
+		"jti": fmt.Sprint(p.issued),
+	}).SignedString([]byte("secret"))
+	return token
+}
+
+// Issue a new session and respond with it.
+func (p *fakePDS) issue(w http.ResponseWriter) {
+	p.access, p.refresh = p.token(10*time.Minute), p.token(time.Hour)
+	json.NewEncoder(w).Encode(map[string]any{
+		"accessJwt": p.access, "refreshJwt": p.refresh, "handle": "bot.test", "did": "did:plc:bot",
+	})
+}
+
+// Stop accepting the current access token, as if it expired.
+func (p *fakePDS) expireAccess() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.access = "expired"
+}
+
+func xrpcErrorResponse(w http.ResponseWriter, status int, name string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": name, "message": name})
+}
+
+func (p *fakePDS) serve(w http.ResponseWriter, r *http.Request) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	switch r.URL.Path {
+	case "/xrpc/com.atproto.server.createSession":
+		p.creates.Add(1)
+		if p.createStatus != 0 {
+			xrpcErrorResponse(w, p.createStatus, cmp.Or(p.createError, "AuthenticationRequired"))
+			return
+		}
+		var input struct {
+			AuthFactorToken *string `json:"authFactorToken"`
+		}
+		json.NewDecoder(r.Body).Decode(&input)
+		if p.authFactorToken != "" && valueOrZero(input.AuthFactorToken) != p.authFactorToken {
+			if input.AuthFactorToken == nil {
+				xrpcErrorResponse(w, http.StatusUnauthorized, "AuthFactorTokenRequired")
+			} else {
+				xrpcErrorResponse(w, http.StatusUnauthorized, "InvalidToken")
+			}
+			return
+		}
+		p.issue(w)
+	case "/xrpc/com.atproto.server.refreshSession":
+		p.refreshes.Add(1)
+		switch {
+		case p.refreshStatus != 0:
+			xrpcErrorResponse(w, p.refreshStatus, http.StatusText(p.refreshStatus))
+		case bearer != p.refresh:
+			xrpcErrorResponse(w, http.StatusBadRequest, "InvalidToken")
+		default:
+			p.issue(w)
+		}
+	default:
+		p.requests.Add(1)
+		if p.handler != nil {
+			p.handler(w, r)
+			return
+		}
+		if bearer != p.access {
+			xrpcErrorResponse(w, http.StatusBadRequest, "ExpiredToken")
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"did": "did:plc:bot", "handle": "bot.test"})
+	}
+}
+
+func (p *fakePDS) set(f func(p *fakePDS)) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	f(p)
+}
+
+// Client talking to the stand-in, with the given clock and without retries.
+func newTestClient(t *testing.T, pds *fakePDS, clock *fakeClock, options ...Option) *Client {
+	t.Helper()
+	options = append([]Option{
+		WithPDSHost(pds.URL),
+		WithEagerDIDResolution(false),
+		WithoutLogging(),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 1}),
+	}, options...)
+	client, err := NewClient(context.Background(), "did:plc:bot", "appkey", options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clock != nil {
+		client.clock = clock
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRefreshBeforeExpiry(t *testing.T) {
+	clock := newFakeClock()
+	pds := newFakePDS(t, clock)
+	client := newTestClient(t, pds, clock)
+
+	if err := client.Authenticate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	clock.waitForTimer(t, 9*time.Minute)
+	firstAccess := client.xrpcClient.GetAuthAsync().AccessJwt
+
+	clock.Advance(8 * time.Minute)
+	time.Sleep(20 * time.Millisecond)
+	if n := pds.refreshes.Load(); n != 0 {
+		t.Fatalf("refreshed %d times before the access token was about to expire", n)
+	}
+
+	clock.Advance(time.Minute)
+	waitFor(t, "the proactive refresh", func() bool { return client.xrpcClient.GetAuthAsync().AccessJwt != firstAccess })
+	if n := pds.refreshes.Load(); n != 1 {
+		t.Errorf("refreshed %d times, want 1", n)
+	}
+	// rescheduled for the new token
+	clock.waitForTimer(t, 9*time.Minute)
+	clock.Advance(9 * time.Minute)
+	waitFor(t, "the second refresh", func() bool { return pds.refreshes.Load() == 2 })
+	if n := pds.creates.Load(); n != 1 {
+		t.Errorf("logged in %d times, want 1", n)
+	}
+}
+
+func TestRefreshOnExpiredToken(t *testing.T) {
+	clock := newFakeClock()
+	pds := newFakePDS(t, clock)
+	client := newTestClient(t, pds, clock)
+	if err := client.Authenticate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	pds.expireAccess()
+	profile, err := client.GetProfile(context.Background(), "did:plc:bot")
+	if err != nil {
+		t.Fatalf("GetProfile error = %v", err)
+	}
+	if profile.Handle != "bot.test" {
+		t.Errorf("profile handle = %q", profile.Handle)
+	}
+	if n := pds.refreshes.Load(); n != 1 {
+		t.Errorf("refreshed %d times, want 1", n)
+	}
+	if n := pds.requests.Load(); n != 2 {
+		t.Errorf("sent %d requests, want the failed one and its retry", n)
+	}
+}
+
+func TestRefreshTransientBackoff(t *testing.T) {
+	clock := newFakeClock()
+	pds := newFakePDS(t, clock)
+	var authErrors atomic.Int64
+	client := newTestClient(t, pds, clock, WithOnAuthError(func(error) { authErrors.Add(1) }))
+	if err := client.Authenticate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	clock.waitForTimer(t, 9*time.Minute)
+
+	pds.set(func(p *fakePDS) { p.refreshStatus = http.StatusServiceUnavailable })
+	clock.Advance(9 * time.Minute)
+	for i, backoff := range []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second} {
+		clock.waitForTimer(t, backoff)
+		if n := pds.refreshes.Load(); n != int64(i+1) {
+			t.Fatalf("refresh attempts = %d, want %d", n, i+1)
+		}
+		if i < 2 {
+			clock.Advance(backoff)
+		}
+	}
+
+	pds.set(func(p *fakePDS) { p.refreshStatus = 0 })
+	clock.Advance(20 * time.Second)
+	waitFor(t, "the successful refresh", func() bool { return pds.refreshes.Load() == 4 })
+	clock.waitForTimer(t, 9*time.Minute)
+
+	if n := authErrors.Load(); n != 0 {
+		t.Errorf("OnAuthError called %d times for transient failures", n)
+	}
+	if n := pds.creates.Load(); n != 1 {
+		t.Errorf("logged in %d times, want 1 (no login while the PDS is unavailable)", n)
+	}
+}
+
+func TestRefreshPermanentFailure(t *testing.T) {
+	providerErr := errors.New("vault sealed")
+	var prompted atomic.Bool
+	tests := []struct {
+		name      string
+		setup     func(p *fakePDS)
+		configure func(c *Client) // e.g. options which only take effect on the next login
+		want      error
+	}{
+		{
+			name:  "revoked app password",
+			setup: func(p *fakePDS) { p.refreshStatus, p.createStatus = http.StatusBadRequest, http.StatusUnauthorized },
+		},
+		{
+			name:  "credential provider failure",
+			setup: func(p *fakePDS) { p.refreshStatus = http.StatusBadRequest },
+			configure: func(c *Client) {
+				c.credentials = CredentialProviderFunc(func(ctx context.Context) (Credentials, error) {
+					return Credentials{}, providerErr
+				})
+			},
+			want: providerErr,
+		},
+		{
+			name: "sign-in code required",
+			setup: func(p *fakePDS) {
+				p.refreshStatus, p.createStatus, p.createError = http.StatusBadRequest, http.StatusUnauthorized, "AuthFactorTokenRequired"
+			},
+			configure: func(c *Client) {
+				c.authPrompt = func(ctx context.Context) (string, error) {
+					prompted.Store(true)
+					return "123456", nil
+				}
+			},
+			want: ErrAuthFactorTokenRequired,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			pds := newFakePDS(t, clock)
+			authErrors := make(chan error, 10)
+			client := newTestClient(t, pds, clock, WithOnAuthError(func(err error) { authErrors <- err }))
+			if err := client.Authenticate(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			clock.waitForTimer(t, 9*time.Minute)
+
+			pds.set(tt.setup)
+			if tt.configure != nil {
+				client.sessionLock.Lock()
+				tt.configure(client)
+				client.sessionLock.Unlock()
+			}
+			clock.Advance(9 * time.Minute)
+
+			select {
+			case err := <-authErrors:
+				if tt.want != nil && !errors.Is(err, tt.want) {
+					t.Errorf("OnAuthError got %v, want %v", err, tt.want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("OnAuthError was not called")
+			}
+			if prompted.Load() {
+				t.Error("prompted for a sign-in code in the background")
+			}
+			// the refresher stops instead of retrying
+			time.Sleep(20 * time.Millisecond)
+			refreshes, creates := pds.refreshes.Load(), pds.creates.Load()
+			clock.Advance(time.Hour)
+			time.Sleep(20 * time.Millisecond)
+			if pds.refreshes.Load() != refreshes || pds.creates.Load() != creates {
+				t.Error("refreshed again after a permanent failure")
+			}
+
+			// and resumes once the client is authenticated again
+			pds.set(func(p *fakePDS) { p.refreshStatus, p.createStatus = 0, 0 })
+			client.sessionLock.Lock()
+			client.credentials, client.authPrompt = nil, nil
+			client.sessionLock.Unlock()
+			if err := client.Authenticate(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			clock.waitForTimer(t, 9*time.Minute)
+		})
+	}
+}
+
+func TestIsTransientError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"server error", &xrpc.Error{StatusCode: http.StatusBadGateway}, true},
+		{"rate limited", &xrpc.Error{StatusCode: http.StatusTooManyRequests}, true},
+		{"local rate limit", &rateLimitWaitError{class: RateLimitWrites, wait: time.Minute}, true},
+		{"connection refused", &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, true},
+		{"timeout", context.DeadlineExceeded, true},
+		{"unexpected EOF", fmt.Errorf("read: %w", io.ErrUnexpectedEOF), true},
+		{"bad request", &xrpc.Error{StatusCode: http.StatusBadRequest}, false},
+		{"unauthorized", &xrpc.Error{StatusCode: http.StatusUnauthorized}, false},
+		{"cancelled", context.Canceled, false},
+		{"credential provider", fmt.Errorf("Authenticate error (CredentialProvider): %w", errors.New("file not found")), false},
+		{"sign-in code", fmt.Errorf("Authenticate error: %w", ErrAuthFactorTokenRequired), false},
+		{"OAuth reauthorization", fmt.Errorf("Authenticate error: %w", ErrOAuthReauthorizationRequired), false},
+		{"JWT parse", fmt.Errorf("UpdateAuth error: %v", "Cannot parse JWT"), false},
+		{"OAuth server error", &OAuthError{StatusCode: http.StatusServiceUnavailable}, true},
+		{"OAuth invalid grant", &OAuthError{StatusCode: http.StatusBadRequest}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTransientError(tt.err); got != tt.want {
+				t.Errorf("isTransientError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthFactorToken(t *testing.T) {
+	errNoTerminal := errors.New("no terminal")
+	tests := []struct {
+		name        string
+		prompt      func(ctx context.Context) (string, error) // nil for none
+		want        error
+		wantCreates int64
+	}{
+		{name: "no prompt", want: ErrAuthFactorTokenRequired, wantCreates: 1},
+		{name: "code entered", prompt: func(ctx context.Context) (string, error) { return " 123456\n", nil }, wantCreates: 2},
+		{name: "wrong code", prompt: func(ctx context.Context) (string, error) { return "000000", nil }, want: ErrAuthRequired, wantCreates: 2},
+		{name: "prompt failed", prompt: func(ctx context.Context) (string, error) { return "", errNoTerminal }, want: ErrAuthFactorTokenRequired, wantCreates: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			pds := newFakePDS(t, clock)
+			pds.authFactorToken = "123456"
+			var options []Option
+			if tt.prompt != nil {
+				options = append(options, WithAuthFactorTokenPrompt(tt.prompt))
+			}
+			client := newTestClient(t, pds, clock, options...)
+
+			err := client.Authenticate(context.Background())
+			if !errors.Is(err, tt.want) {
+				t.Errorf("Authenticate error = %v, want %v", err, tt.want)
+			}
+			if n := pds.creates.Load(); n != tt.wantCreates {
+				t.Errorf("createSession called %d times, want %d", n, tt.wantCreates)
+			}
+		})
+	}
+}
+
+// The code is only needed once, the persisted session is resumed without it.
+func TestAuthFactorTokenPersisted(t *testing.T) {
+	clock := newFakeClock()
+	pds := newFakePDS(t, clock)
+	pds.authFactorToken = "123456"
+	store := NewMemorySessionStore()
+	var prompts atomic.Int64
+	prompt := WithAuthFactorTokenPrompt(func(ctx context.Context) (string, error) {
+		prompts.Add(1)
+		return "123456", nil
+	})
+
+	if err := newTestClient(t, pds, clock, prompt, WithSessionStore(store)).ResumeSession(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// after a restart
+	if err := newTestClient(t, pds, clock, prompt, WithSessionStore(store)).ResumeSession(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := prompts.Load(); n != 1 {
+		t.Errorf("prompted %d times, want 1", n)
+	}
+	if n := pds.creates.Load(); n != 2 {
+		t.Errorf("createSession called %d times, want 2 (without and with the code)", n)
+	}
+}
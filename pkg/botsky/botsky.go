@@ -3,10 +3,13 @@ package botsky
 import (
 	"context"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 
+	"github.com/davhofer/botsky/pkg/identity"
 	"github.com/davhofer/indigo/api/atproto"
 	"github.com/davhofer/indigo/api/bsky"
 	lexutil "github.com/davhofer/indigo/lex/util"
@@ -17,73 +20,242 @@ const ApiEntryway = "https://bsky.social"
 const ApiPublic = "https://public.api.bsky.app"
 const ApiChat = "https://api.bsky.chat"
 
-// TODO: need to wrap requests for rate limiting?
-
 // API Client
 //
-// Wraps an XRPC client for API calls and a second one for handling chat/DMs
+// Wraps an XRPC client for API calls (talking to the account's PDS) and a second one for handling chat/DMs
 type Client struct {
-	xrpcClient         *xrpc.Client
-	Handle             string
-	Did                string
-	appkey             string
-	refreshProcessLock sync.Mutex   // make sure only one auth refresher runs at a time
-	chatClient         *xrpc.Client // client for accessing chat api
-	chatCursor         string
+	xrpcClient      *xrpc.Client
+	Handle          string
+	Did             string
+	appkey          string
+	sessionLock     sync.Mutex         // serializes logins and session refreshes
+	appviewClient   *xrpc.Client       // client for public AppView reads. Same as xrpcClient unless an AppView host is configured
+	chatClient      *xrpc.Client       // client for accessing chat api
+	httpClient      *http.Client       // shared by all XRPC clients and other HTTP requests
+	logger          *slog.Logger       // logger for client events
+	identity        *identity.Resolver // resolves and verifies handles and DIDs
+	pdsHost         string             // explicitly configured PDS host, skips PDS discovery if set
+	repoClientsLock sync.Mutex
+	repoClients     map[string]*xrpc.Client      // unauthenticated clients for reading foreign repos, keyed by PDS host
+	sessionStore    SessionStore                 // persists sessions, may be nil
+	sessionKey      string                       // key of this account's session in the session store
+	onAuthError     func(error)                  // called when the session cannot be refreshed, may be nil
+	authExpiry      atomic.Int64                 // unix time at which the access token expires
+	oauth           atomic.Pointer[oauthSession] // set if the client is authenticated via OAuth
+	refresherOnce   sync.Once                    // the background refresher is started once, on the first UpdateAuth
+	refresherWake   chan struct{}                // signals the refresher to reschedule after auth was updated
+	refresherWg     sync.WaitGroup
+	clock           clock           // time source of the session refresher
+	ctx             context.Context // lifetime of the client, cancelled by Close
+	cancel          context.CancelFunc
+
+	// provides the email sign-in code for accounts with two-factor authentication, may be nil
+	authPrompt func(context.Context) (string, error)
+	// provides the credentials on every login, may be nil
+	credentials CredentialProvider
+	// throttles requests to the PDS and chat service
+	rateLimiter *rateLimiter
+	// HTTP client for XRPC calls: rate limited, retried on transient failures, refreshing the session
+	xrpcHTTPClient *http.Client
+	// HTTP client for session management calls: rate limited, but without session refresh
+	sessionHTTPClient *http.Client
 }
 
 // Sets up a new client (not yet authenticated)
-func NewClient(ctx context.Context, handle string, appkey string) (*Client, error) {
+//
+// The account's PDS is discovered from its DID document, unless a host is set explicitly with WithPDSHost.
+// Handle and appkey may be empty if the credentials come from a provider, see WithCredentialProvider.
+// See the With* functions for further options.
+func NewClient(ctx context.Context, handle string, appkey string, options ...Option) (*Client, error) {
+	opts := defaultClientOptions()
+	for _, option := range options {
+		option(&opts)
+	}
+
+	httpClient := opts.httpClient
+	if httpClient == nil {
+		httpClient = &http.Client{
+			Transport: opts.transport,
+			Timeout:   DefaultHTTPTimeout,
+		}
+	}
+	var userAgent *string
+	if opts.userAgent != "" {
+		userAgent = &opts.userAgent
+	}
+	logger := opts.logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	resolver := opts.identity
+	if resolver == nil {
+		resolver = identity.NewResolver(httpClient)
+	}
+	if handle == "" && opts.credentials != nil {
+		creds, err := opts.credentials.Credentials(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("NewClient error (CredentialProvider): %w", err)
+		}
+		handle, appkey = creds.Handle, creds.Appkey
+	}
+
+	clientCtx, cancel := context.WithCancel(context.Background())
 	client := &Client{
 		xrpcClient: &xrpc.Client{
-			Client: new(http.Client),
-			Host:   string(ApiEntryway),
+			Client:    httpClient,
+			Host:      opts.pdsHost,
+			UserAgent: userAgent,
 		},
-		Handle: handle,
+		Handle: strings.TrimPrefix(handle, "@"),
 		appkey: appkey,
 		chatClient: &xrpc.Client{
-			// TODO: reuse the http client?
-			Client: new(http.Client),
-			Host:   string(ApiChat),
+			Client:    httpClient,
+			Host:      opts.chatHost,
+			UserAgent: userAgent,
+			Headers:   map[string]string{},
 		},
-		chatCursor: "",
+		httpClient:    httpClient,
+		logger:        logger,
+		identity:      resolver,
+		pdsHost:       opts.pdsHost,
+		repoClients:   make(map[string]*xrpc.Client),
+		sessionStore:  opts.sessions,
+		sessionKey:    identity.NormalizeHandle(handle),
+		onAuthError:   opts.onAuthError,
+		authPrompt:    opts.authPrompt,
+		credentials:   opts.credentials,
+		rateLimiter:   newRateLimiter(opts.rateLimits, opts.maxWait),
+		refresherWake: make(chan struct{}, 1),
+		clock:         systemClock{},
+		ctx:           clientCtx,
+		cancel:        cancel,
+	}
+	// XRPC requests are rate limited, retried on transient failures, refresh the session
+	// if the access token expired, and use DPoP-bound tokens for OAuth sessions
+	client.xrpcHTTPClient = wrapHTTPClient(httpClient, func(base http.RoundTripper) http.RoundTripper {
+		logged := &loggingTransport{base: base, logger: logger}
+		rateLimited := &rateLimitTransport{base: &dpopTransport{base: logged, client: client}, limiter: client.rateLimiter}
+		retried := &retryTransport{base: rateLimited, policy: opts.retry}
+		return applyMiddleware(&authRefreshTransport{base: retried, client: client}, opts.middleware)
+	})
+	client.sessionHTTPClient = wrapHTTPClient(httpClient, func(base http.RoundTripper) http.RoundTripper {
+		return applyMiddleware(&rateLimitTransport{base: base, limiter: client.rateLimiter}, opts.middleware)
+	})
+	client.xrpcClient.Client = client.xrpcHTTPClient
+	client.chatClient.Client = client.xrpcHTTPClient
+	if opts.appviewHost != "" {
+		client.appviewClient = &xrpc.Client{
+			Client:    client.xrpcHTTPClient,
+			Host:      opts.appviewHost,
+			UserAgent: userAgent,
+		}
+	} else {
+		client.appviewClient = client.xrpcClient
+	}
+	if strings.HasPrefix(client.Handle, "did:") {
+		client.Did = client.Handle
+	}
+
+	if opts.resolveDid {
+		if err := client.resolveIdentity(ctx); err != nil {
+			cancel()
+			return nil, fmt.Errorf("NewClient error: %w", err)
+		}
+	}
+	return client, nil
+}
+
+// Get the client's logger, e.g. for logging from handlers. Listeners log through it as well.
+func (c *Client) Logger() *slog.Logger {
+	return c.logger
+}
+
+// Resolve the account's DID and discover its PDS (unless the PDS host was set explicitly).
+//
+// Called by NewClient, or by Authenticate if the resolution was deferred.
+func (c *Client) resolveIdentity(ctx context.Context) error {
+	// resolve own identity to get did and PDS. don't need to be authenticated to do that
+	ident, err := c.LookupIdentity(ctx, c.Handle)
+	if err != nil {
+		return err
+	}
+	c.Did = ident.Did
+
+	if c.pdsHost != "" {
+		return nil
 	}
-	// resolve own handle to get did. don't need to be authenticated to do that
-	clientDid, err := client.ResolveHandle(ctx, handle)
+	if ident.PDSEndpoint == "" {
+		return identity.ErrNoPDSEndpoint
+	}
+	c.xrpcClient.SetHostAsync(ident.PDSEndpoint)
+	return nil
+}
+
+// Get the XRPC client for reading the given repo. Reads of the bot's own repo go through the authenticated client,
+// other repos are read directly from the PDS hosting them.
+func (c *Client) repoClient(ctx context.Context, handleOrDid string) (*xrpc.Client, error) {
+	if handleOrDid == c.Did || strings.EqualFold(strings.TrimPrefix(handleOrDid, "@"), c.Handle) {
+		return c.xrpcClient, nil
+	}
+	ident, err := c.LookupIdentity(ctx, handleOrDid)
 	if err != nil {
 		return nil, err
 	}
-	client.Did = clientDid
-	return client, nil
+	if ident.Did == c.Did {
+		return c.xrpcClient, nil
+	}
+	if ident.PDSEndpoint == "" {
+		return nil, fmt.Errorf("repoClient error: %w", identity.ErrNoPDSEndpoint)
+	}
+
+	c.repoClientsLock.Lock()
+	defer c.repoClientsLock.Unlock()
+	if xrpcClient, ok := c.repoClients[ident.PDSEndpoint]; ok {
+		return xrpcClient, nil
+	}
+	xrpcClient := &xrpc.Client{
+		Client:    c.xrpcHTTPClient,
+		Host:      ident.PDSEndpoint,
+		UserAgent: c.xrpcClient.GetUserAgentAsync(),
+	}
+	c.repoClients[ident.PDSEndpoint] = xrpcClient
+	return xrpcClient, nil
 }
 
 // Resolve the given handle to a DID
 //
+// The handle is resolved via DNS or HTTPS and verified against the DID document (bidirectional verification).
 // If called on a DID, simply returns it
 func (c *Client) ResolveHandle(ctx context.Context, handle string) (string, error) {
 	if strings.HasPrefix(handle, "did:") {
 		return handle, nil
 	}
-	if strings.HasPrefix(handle, "@") {
-		handle = handle[1:]
+	ident, err := c.identity.LookupHandle(ctx, handle)
+	if err != nil {
+		return "", fmt.Errorf("ResolveHandle error: %w", err)
 	}
-	output, err := atproto.IdentityResolveHandle(ctx, c.xrpcClient, handle)
+	return ident.Did, nil
+}
+
+// Resolve the given handle or DID to the full identity (DID document, verified handle, PDS endpoint, signing key).
+func (c *Client) LookupIdentity(ctx context.Context, handleOrDid string) (*identity.Identity, error) {
+	ident, err := c.identity.Lookup(ctx, handleOrDid)
 	if err != nil {
-		return "", fmt.Errorf("ResolveHandle error: %v", err)
+		return nil, fmt.Errorf("LookupIdentity error: %w", err)
 	}
-	return output.Did, nil
+	return ident, nil
 }
 
 // Update the users profile description with the given string. All other profile components (avatar, banner, etc.) stay the same.
 func (c *Client) UpdateProfileDescription(ctx context.Context, description string) error {
 	profileRecord, err := atproto.RepoGetRecord(ctx, c.xrpcClient, "", "app.bsky.actor.profile", c.Handle, "self")
 	if err != nil {
-		return fmt.Errorf("UpdateProfileDescription error (RepoGetRecord): %v", err)
+		return fmt.Errorf("UpdateProfileDescription error (RepoGetRecord): %w", xrpcError(err))
 	}
 
 	var actorProfile bsky.ActorProfile
 	if err := decodeRecordAsLexicon(profileRecord.Value, &actorProfile); err != nil {
-		return fmt.Errorf("UpdateProfileDescription error (DecodeRecordAsLexicon): %v", err)
+		return fmt.Errorf("UpdateProfileDescription error (DecodeRecordAsLexicon): %w", err)
 	}
 
 	newProfile := bsky.ActorProfile{
@@ -110,9 +282,9 @@ func (c *Client) UpdateProfileDescription(ctx context.Context, description strin
 
 	output, err := atproto.RepoPutRecord(ctx, c.xrpcClient, &input)
 	if err != nil {
-		return fmt.Errorf("UpdateProfileDescription error (RepoPutRecord): %v", err)
+		return fmt.Errorf("UpdateProfileDescription error (RepoPutRecord): %w", xrpcError(err))
 	}
-	logger.Println("Profile updated:", output.Cid, output.Uri)
+	c.logger.Info("Profile updated", "did", c.Did, "cid", output.Cid, "uri", output.Uri)
 	return nil
 }
 
@@ -142,7 +314,7 @@ func (c *Client) GetPostViews(ctx context.Context, handleOrDid string, limit int
 	// get all post uris
 	postUris, err := c.RepoGetRecordUris(ctx, handleOrDid, "app.bsky.feed.post", limit)
 	if err != nil {
-		return nil, fmt.Errorf("GetPostViews error (RepoGetRecordUris): %v", err)
+		return nil, fmt.Errorf("GetPostViews error (RepoGetRecordUris): %w", err)
 	}
 
 	// hydrate'em
@@ -152,9 +324,9 @@ func (c *Client) GetPostViews(ctx context.Context, handleOrDid string, limit int
 		if j > len(postUris) {
 			j = len(postUris)
 		}
-		results, err := bsky.FeedGetPosts(ctx, c.xrpcClient, postUris[i:j])
+		results, err := bsky.FeedGetPosts(ctx, c.appviewClient, postUris[i:j])
 		if err != nil {
-			return nil, fmt.Errorf("GetPostViews error (FeedGetPosts): %v", err)
+			return nil, fmt.Errorf("GetPostViews error (FeedGetPosts): %w", xrpcError(err))
 		}
 		postViews = append(postViews, results.Posts...)
 	}
@@ -167,59 +339,71 @@ func (c *Client) GetPostViews(ctx context.Context, handleOrDid string, limit int
 func (c *Client) GetPosts(ctx context.Context, handleOrDid string, limit int) ([]*RichPost, error) {
 	postViews, err := c.GetPostViews(ctx, handleOrDid, limit)
 	if err != nil {
-		return nil, fmt.Errorf("GetPosts error (GetPostViews): %v", err)
+		return nil, fmt.Errorf("GetPosts error (GetPostViews): %w", err)
 	}
 
 	posts := make([]*RichPost, 0, len(postViews))
 	for _, postView := range postViews {
-		var feedPost bsky.FeedPost
-		if err := decodeRecordAsLexicon(postView.Record, &feedPost); err != nil {
-			return nil, fmt.Errorf("GetPosts error (DecodeRecordAsLexicon): %v", err)
+		post, err := richPostFromView(postView)
+		if err != nil {
+			return nil, fmt.Errorf("GetPosts error (DecodeRecordAsLexicon): %w", err)
 		}
-		posts = append(posts, &RichPost{
-			FeedPost:    feedPost,
-			AuthorDid:   postView.Author.Did,
-			Cid:         postView.Cid,
-			Uri:         postView.Uri,
-			IndexedAt:   postView.IndexedAt,
-			LikeCount:   *postView.LikeCount,
-			QuoteCount:  *postView.QuoteCount,
-			ReplyCount:  *postView.ReplyCount,
-			RepostCount: *postView.RepostCount,
-		})
+		posts = append(posts, post)
+	}
+	return posts, nil
+}
 
+// Load enriched posts by uri. Posts which don't exist (anymore) are left out.
+func (c *Client) GetPostsByUris(ctx context.Context, postUris []string) ([]*RichPost, error) {
+	posts := make([]*RichPost, 0, len(postUris))
+	for i := 0; i < len(postUris); i += 25 {
+		j := min(i+25, len(postUris))
+		results, err := bsky.FeedGetPosts(ctx, c.appviewClient, postUris[i:j])
+		if err != nil {
+			return nil, fmt.Errorf("GetPostsByUris error (FeedGetPosts): %w", xrpcError(err))
+		}
+		for _, postView := range results.Posts {
+			post, err := richPostFromView(postView)
+			if err != nil {
+				return nil, fmt.Errorf("GetPostsByUris error (DecodeRecordAsLexicon): %w", err)
+			}
+			posts = append(posts, post)
+		}
 	}
 	return posts, nil
 }
 
 // Get a single post by uri.
 func (c *Client) GetPost(ctx context.Context, postUri string) (RichPost, error) {
-	results, err := bsky.FeedGetPosts(ctx, c.xrpcClient, []string{postUri})
+	results, err := bsky.FeedGetPosts(ctx, c.appviewClient, []string{postUri})
 	if err != nil {
-		return RichPost{}, fmt.Errorf("GetPost error (FeedGetPosts): %v", err)
+		return RichPost{}, fmt.Errorf("GetPost error (FeedGetPosts): %w", xrpcError(err))
 	}
 	if len(results.Posts) == 0 {
-		return RichPost{}, fmt.Errorf("GetPost error: No post with the given uri found")
+		return RichPost{}, fmt.Errorf("GetPost error: %w", ErrNotFound)
 	}
-	postView := results.Posts[0]
-
-	var feedPost bsky.FeedPost
-	err = decodeRecordAsLexicon(postView.Record, &feedPost)
+	post, err := richPostFromView(results.Posts[0])
 	if err != nil {
-		return RichPost{}, fmt.Errorf("GetPost error (DecodeRecordAsLexicon): %v", err)
+		return RichPost{}, fmt.Errorf("GetPost error (DecodeRecordAsLexicon): %w", err)
 	}
+	return *post, nil
+}
 
-	post := RichPost{
+// Build the enriched post from a postView, decoding its record.
+func richPostFromView(postView *bsky.FeedDefs_PostView) (*RichPost, error) {
+	var feedPost bsky.FeedPost
+	if err := decodeRecordAsLexicon(postView.Record, &feedPost); err != nil {
+		return nil, err
+	}
+	return &RichPost{
 		FeedPost:    feedPost,
 		AuthorDid:   postView.Author.Did,
 		Cid:         postView.Cid,
 		Uri:         postView.Uri,
 		IndexedAt:   postView.IndexedAt,
-		LikeCount:   *postView.LikeCount,
-		QuoteCount:  *postView.QuoteCount,
-		ReplyCount:  *postView.ReplyCount,
-		RepostCount: *postView.RepostCount,
-	}
-
-	return post, nil
+		LikeCount:   valueOrZero(postView.LikeCount),
+		QuoteCount:  valueOrZero(postView.QuoteCount),
+		ReplyCount:  valueOrZero(postView.ReplyCount),
+		RepostCount: valueOrZero(postView.RepostCount),
+	}, nil
 }
@@ -0,0 +1,143 @@
+package botsky
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/davhofer/botsky/pkg/identity"
+)
+
+// Stand-in PLC directory serving DID documents with the given PDS endpoints ("" for none).
+func newPLCDirectory(t *testing.T, pdsEndpoints map[string]string) *identity.Resolver {
+	plc := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		did := r.URL.Path[1:]
+		endpoint, ok := pdsEndpoints[did]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		doc := identity.DIDDocument{ID: did}
+		if endpoint != "" {
+			doc.Service = []identity.Service{{ID: "#atproto_pds", Type: "AtprotoPersonalDataServer", ServiceEndpoint: endpoint}}
+		}
+		json.NewEncoder(w).Encode(doc)
+	}))
+	t.Cleanup(plc.Close)
+	resolver := identity.NewResolver(plc.Client())
+	resolver.PLCDirectory = plc.URL
+	return resolver
+}
+
+func TestPDSDiscovery(t *testing.T) {
+	pds := newRealTimePDS(t)
+	other := httptest.NewServer(http.NotFoundHandler())
+	defer other.Close()
+	resolver := newPLCDirectory(t, map[string]string{"did:plc:bot": pds.URL, "did:plc:nopds": ""})
+
+	tests := []struct {
+		name     string
+		did      string
+		options  []Option
+		wantHost string
+		wantErr  error
+	}{
+		{name: "from DID document", did: "did:plc:bot", wantHost: pds.URL},
+		{name: "explicit host", did: "did:plc:bot", options: []Option{WithPDSHost(other.URL)}, wantHost: other.URL},
+		{name: "no PDS in DID document", did: "did:plc:nopds", wantErr: identity.ErrNoPDSEndpoint},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := append([]Option{WithIdentityResolver(resolver), WithoutLogging()}, tt.options...)
+			client, err := NewClient(context.Background(), tt.did, "appkey", options...)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("NewClient error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			if host := client.xrpcClient.GetHostAsync(); host != tt.wantHost || client.Did != tt.did {
+				t.Errorf("client has host %s and DID %s, want %s and %s", host, client.Did, tt.wantHost, tt.did)
+			}
+		})
+	}
+
+	// with deferred resolution, the PDS is discovered on login
+	client, err := NewClient(context.Background(), "did:plc:bot", "appkey", WithIdentityResolver(resolver), WithoutLogging(), WithEagerDIDResolution(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Authenticate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := pds.creates.Load(); n != 1 {
+		t.Errorf("logged in %d times at the discovered PDS, want 1", n)
+	}
+}
+
+// Reads of foreign repos go to the PDS hosting them, reads of the bot's repo to its own PDS.
+func TestForeignRepoReads(t *testing.T) {
+	var foreignRequests atomic.Int64
+	foreign := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		foreignRequests.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/xrpc/com.atproto.repo.listRecords":
+			if r.URL.Query().Get("cursor") != "" {
+				w.Write([]byte(`{"records": []}`))
+				return
+			}
+			w.Write([]byte(`{"cursor": "next", "records": [
+				{"uri": "at://did:plc:alice/app.bsky.feed.post/1", "cid": "bafyreia", "value": {"$type": "app.bsky.feed.post", "text": "one", "createdAt": "2024-01-01T00:00:00Z"}}
+			]}`))
+		case "/xrpc/com.atproto.repo.getRecord":
+			w.Write([]byte(`{"uri": "at://did:plc:alice/app.bsky.feed.post/1", "cid": "bafyreia",
+				"value": {"$type": "app.bsky.feed.post", "text": "one", "createdAt": "2024-01-01T00:00:00Z"}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer foreign.Close()
+
+	pds := newFakePDS(t, newFakeClock())
+	pds.handler = func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"handle": "bot.test", "did": "did:plc:bot", "didDoc": map[string]any{},
+			"collections": []string{"app.bsky.feed.post"}, "handleIsCorrect": true,
+		})
+	}
+	resolver := newPLCDirectory(t, map[string]string{"did:plc:bot": pds.URL, "did:plc:alice": foreign.URL})
+	client := newTestClient(t, pds, nil, WithIdentityResolver(resolver))
+	ctx := context.Background()
+
+	records, err := client.RepoGetRecords(ctx, "did:plc:alice", "app.bsky.feed.post", -1)
+	if err != nil || len(records) != 1 {
+		t.Errorf("RepoGetRecords = %d records, %v, want 1", len(records), err)
+	}
+	post, cid, err := client.RepoGetPostAndCid(ctx, "at://did:plc:alice/app.bsky.feed.post/1")
+	if err != nil || post.Text != "one" || cid != "bafyreia" {
+		t.Errorf("RepoGetPostAndCid = %q, %s, %v", post.Text, cid, err)
+	}
+	if n := foreignRequests.Load(); n != 3 {
+		t.Errorf("sent %d requests to the foreign PDS, want 3", n)
+	}
+	if n := pds.requests.Load(); n != 0 {
+		t.Errorf("sent %d requests for the foreign repo to the bot's PDS", n)
+	}
+
+	if _, err := client.RepoGetCollections(ctx, "did:plc:bot"); err != nil {
+		t.Fatal(err)
+	}
+	if n := pds.requests.Load(); n != 1 {
+		t.Errorf("sent %d requests for the bot's repo to its PDS, want 1", n)
+	}
+}
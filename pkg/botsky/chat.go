@@ -13,10 +13,14 @@ func (c *Client) ChatUpdateActorAccess(ctx context.Context, handleOrDid string,
 	if err != nil {
 		return err
 	}
-	return chat.ModerationUpdateActorAccess(ctx, c.chatClient, &chat.ModerationUpdateActorAccess_Input{
+	err = chat.ModerationUpdateActorAccess(ctx, c.chatClient, &chat.ModerationUpdateActorAccess_Input{
 		Actor:       did,
 		AllowAccess: allowAccess,
 	})
+	if err != nil {
+		return fmt.Errorf("ChatUpdateActorAccess error: %w", xrpcError(err))
+	}
+	return nil
 }
 
 // Get number of unread messages in the given conversation.
@@ -35,7 +39,10 @@ func (c *Client) ChatConvoUpdateRead(ctx context.Context, convoId string, messag
 		ConvoId:   convoId,
 		MessageId: messageId,
 	})
-	return err
+	if err != nil {
+		return fmt.Errorf("ChatConvoUpdateRead error: %w", xrpcError(err))
+	}
+	return nil
 }
 
 // Get the conversation including exactly the provided accounts, or create a new one if it doesn't exist.
@@ -44,7 +51,7 @@ func (c *Client) ChatGetConvoForMembers(ctx context.Context, handlesOrDids []str
 	for _, handleOrDid := range handlesOrDids {
 		did, err := c.ResolveHandle(ctx, handleOrDid)
 		if err != nil {
-			return nil, fmt.Errorf("ChatGetConvoForMembers error: %v", err)
+			return nil, fmt.Errorf("ChatGetConvoForMembers error: %w", err)
 		}
 		dids = append(dids, did)
 	}
@@ -52,7 +59,7 @@ func (c *Client) ChatGetConvoForMembers(ctx context.Context, handlesOrDids []str
 	// TODO: does this require a handle?
 	convoOutput, err := chat.ConvoGetConvoForMembers(ctx, c.chatClient, dids)
 	if err != nil {
-		return nil, fmt.Errorf("ChatGetConvoForMembers error: %v", err)
+		return nil, fmt.Errorf("ChatGetConvoForMembers error: %w", xrpcError(err))
 	}
 	return convoOutput.Convo, nil
 }
@@ -62,7 +69,7 @@ func (c *Client) ChatGetConvo(ctx context.Context, convoId string) (*chat.ConvoD
 
 	convoOutput, err := chat.ConvoGetConvo(ctx, c.chatClient, convoId)
 	if err != nil {
-		return nil, fmt.Errorf("ChatGetConvo error: %v", err)
+		return nil, fmt.Errorf("ChatGetConvo error: %w", xrpcError(err))
 	}
 	return convoOutput.Convo, nil
 }
@@ -77,7 +84,7 @@ func (c *Client) ChatConvoSendMessage(ctx context.Context, convoId string, messa
 	}
 	msgView, err := chat.ConvoSendMessage(ctx, c.chatClient, &input)
 	if err != nil {
-		return "", "", fmt.Errorf("ChatSendMessage error: %v", err)
+		return "", "", fmt.Errorf("ChatSendMessage error: %w", xrpcError(err))
 	}
 	return msgView.Id, msgView.Rev, nil
 }
@@ -92,7 +99,7 @@ func (c *Client) ChatListConvos(ctx context.Context) ([]*chat.ConvoDefs_ConvoVie
 		// query repo for collection with updated cursor
 		output, err := chat.ConvoListConvos(ctx, c.chatClient, cursor, 100)
 		if err != nil {
-			return nil, fmt.Errorf("ChatListConvos error: %v", err)
+			return nil, fmt.Errorf("ChatListConvos error: %w", xrpcError(err))
 		}
 
 		// stop if no records returned
@@ -123,7 +130,7 @@ func (c *Client) ChatConvoGetMessages(ctx context.Context, convoId string, limit
 		// query repo for collection with updated cursor
 		output, err := chat.ConvoGetMessages(ctx, c.chatClient, convoId, cursor, 100)
 		if err != nil {
-			return nil, fmt.Errorf("ChatGetConvoMessages error: %v", err)
+			return nil, fmt.Errorf("ChatGetConvoMessages error: %w", xrpcError(err))
 		}
 
 		// stop if no records returned
@@ -177,12 +184,16 @@ func (c *Client) ChatSendGroupMessage(ctx context.Context, handlesOrDids []strin
 	return c.ChatConvoSendMessage(ctx, convo.Id, message)
 }
 
-// Get all chat logs since the last cursor update (maintained internally).
-func (c *Client) ChatGetRecentLogs(ctx context.Context) ([]*chat.ConvoGetLog_Output_Logs_Elem, error) {
-	logOutput, err := chat.ConvoGetLog(ctx, c.chatClient, c.chatCursor)
+// Get all chat logs since the given cursor, along with the cursor for the next call.
+//
+// Pass an empty cursor to start with the most recent logs.
+func (c *Client) ChatGetRecentLogs(ctx context.Context, cursor string) ([]*chat.ConvoGetLog_Output_Logs_Elem, string, error) {
+	logOutput, err := chat.ConvoGetLog(ctx, c.chatClient, cursor)
 	if err != nil {
-		return nil, err
+		return nil, "", fmt.Errorf("ChatGetRecentLogs error: %w", xrpcError(err))
+	}
+	if logOutput.Cursor != nil {
+		cursor = *logOutput.Cursor
 	}
-	c.chatCursor = *logOutput.Cursor
-	return logOutput.Logs, nil
+	return logOutput.Logs, cursor, nil
 }
@@ -0,0 +1,239 @@
+package botsky
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+var ErrCredentialsNotFound = errors.New("credentials not found")
+
+// Handle and app password of an account.
+type Credentials struct {
+	Handle string `json:"handle"`
+	Appkey string `json:"appkey"`
+}
+
+// Provides the credentials of an account.
+//
+// The provider is queried on every login (see WithCredentialProvider), so rotated credentials are picked up by
+// calling Authenticate again, without restarting the bot.
+type CredentialProvider interface {
+	Credentials(ctx context.Context) (Credentials, error)
+}
+
+// Adapter to use an ordinary function as a CredentialProvider.
+type CredentialProviderFunc func(ctx context.Context) (Credentials, error)
+
+func (f CredentialProviderFunc) Credentials(ctx context.Context) (Credentials, error) {
+	return f(ctx)
+}
+
+// Reads the credentials from environment variables.
+//
+// If a variable is not set, the variable with suffix "_FILE" is checked for the path of a file containing the value
+// (e.g. Docker secrets: BOTSKY_APPKEY_FILE=/run/secrets/appkey).
+type EnvCredentials struct {
+	HandleVar string // defaults to BOTSKY_HANDLE
+	AppkeyVar string // defaults to BOTSKY_APPKEY
+}
+
+func (e EnvCredentials) Credentials(ctx context.Context) (Credentials, error) {
+	handleVar, appkeyVar := e.HandleVar, e.AppkeyVar
+	if handleVar == "" {
+		handleVar = "BOTSKY_HANDLE"
+	}
+	if appkeyVar == "" {
+		appkeyVar = "BOTSKY_APPKEY"
+	}
+	handle, err := lookupEnvOrFile(handleVar)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("EnvCredentials error: %w", err)
+	}
+	appkey, err := lookupEnvOrFile(appkeyVar)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("EnvCredentials error: %w", err)
+	}
+	return Credentials{Handle: handle, Appkey: appkey}, nil
+}
+
+// Get the value of the environment variable, or the content of the file named by the variable with suffix "_FILE".
+func lookupEnvOrFile(name string) (string, error) {
+	if value := os.Getenv(name); value != "" {
+		return value, nil
+	}
+	path := os.Getenv(name + "_FILE")
+	if path == "" {
+		return "", fmt.Errorf("%w: %s env variable not set", ErrCredentialsNotFound, name)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading %s_FILE: %v", name, err)
+	}
+	value := strings.TrimSpace(string(data))
+	if value == "" {
+		return "", fmt.Errorf("%w: %s_FILE is empty", ErrCredentialsNotFound, name)
+	}
+	return value, nil
+}
+
+// Reads the credentials from a JSON config file of the form {"handle": "...", "appkey": "..."}.
+//
+// The file is read on every call, so it can be updated while the bot is running.
+type FileCredentials struct {
+	Path string
+}
+
+func (f FileCredentials) Credentials(ctx context.Context) (Credentials, error) {
+	data, err := os.ReadFile(f.Path)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("FileCredentials error (os.ReadFile): %v", err)
+	}
+	var creds Credentials
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return Credentials{}, fmt.Errorf("FileCredentials error (json.Unmarshal): %v", err)
+	}
+	if creds.Handle == "" || creds.Appkey == "" {
+		return Credentials{}, fmt.Errorf("FileCredentials error: %w: handle or appkey missing in %s", ErrCredentialsNotFound, f.Path)
+	}
+	return creds, nil
+}
+
+// Reads the credentials from a netrc-style file: the entry for Machine provides the handle (login) and app
+// password (password).
+type NetrcCredentials struct {
+	Path    string // defaults to ~/.netrc
+	Machine string // defaults to "bsky.social"
+}
+
+func (n NetrcCredentials) Credentials(ctx context.Context) (Credentials, error) {
+	path := n.Path
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return Credentials{}, fmt.Errorf("NetrcCredentials error (os.UserHomeDir): %v", err)
+		}
+		path = filepath.Join(home, ".netrc")
+	}
+	machine := n.Machine
+	if machine == "" {
+		machine = "bsky.social"
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("NetrcCredentials error (os.ReadFile): %v", err)
+	}
+
+	creds, found := parseNetrc(string(data), machine)
+	if !found {
+		return Credentials{}, fmt.Errorf("NetrcCredentials error: %w: no entry with login and password for %s in %s", ErrCredentialsNotFound, machine, path)
+	}
+	return creds, nil
+}
+
+type netrcEntry struct {
+	machine   string
+	isDefault bool
+	creds     Credentials
+}
+
+// Find the credentials for machine in netrc data. The first entry for the machine is used, or the default entry if
+// there is none.
+func parseNetrc(data string, machine string) (Credentials, bool) {
+	// netrc is a sequence of whitespace separated tokens, entries start with "machine <name>" or "default".
+	// Macro definitions ("macdef <name>") span the following lines up to an empty line.
+	var entries []*netrcEntry
+	key, inMacro := "", false
+	for _, line := range strings.Split(data, "\n") {
+		if inMacro {
+			inMacro = strings.TrimSpace(line) != ""
+			continue
+		}
+		for _, token := range strings.Fields(line) {
+			if key == "" {
+				switch token {
+				case "machine", "login", "password", "account", "macdef":
+					key = token
+				case "default":
+					entries = append(entries, &netrcEntry{isDefault: true})
+				}
+				continue
+			}
+			switch {
+			case key == "machine":
+				entries = append(entries, &netrcEntry{machine: token})
+			case key == "macdef":
+				inMacro = true
+			case key == "login" && len(entries) > 0:
+				entries[len(entries)-1].creds.Handle = token
+			case key == "password" && len(entries) > 0:
+				entries[len(entries)-1].creds.Appkey = token
+			}
+			key = ""
+			if inMacro {
+				// the rest of the line is ignored, the body starts on the next line
+				break
+			}
+		}
+	}
+
+	var match *netrcEntry
+	for _, entry := range entries {
+		if entry.machine == machine && !entry.isDefault {
+			match = entry
+			break
+		}
+		if entry.isDefault && match == nil {
+			match = entry
+		}
+	}
+	if match == nil || match.creds.Handle == "" || match.creds.Appkey == "" {
+		return Credentials{}, false
+	}
+	return match.creds, true
+}
+
+// Gets the app password from the output of a command, e.g. a password manager
+// (Command: []string{"pass", "show", "bots/mybot"} or []string{"op", "read", "op://Bots/mybot/password"}).
+//
+// Only the first line of the output is used. The command is executed on every call.
+type CommandCredentials struct {
+	Handle  string
+	Command []string
+}
+
+func (c CommandCredentials) Credentials(ctx context.Context) (Credentials, error) {
+	if len(c.Command) == 0 {
+		return Credentials{}, fmt.Errorf("CommandCredentials error: no command")
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.Command[0], c.Command[1:]...)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return Credentials{}, fmt.Errorf("CommandCredentials error (%s): %v: %s", c.Command[0], err, strings.TrimSpace(stderr.String()))
+	}
+	appkey, _, _ := strings.Cut(string(output), "\n")
+	appkey = strings.TrimSpace(appkey)
+	if appkey == "" {
+		return Credentials{}, fmt.Errorf("CommandCredentials error: %w: %s printed no password", ErrCredentialsNotFound, c.Command[0])
+	}
+	return Credentials{Handle: c.Handle, Appkey: appkey}, nil
+}
+
+// Prompts for the credentials in the terminal, see GetCLICredentials.
+type CLICredentials struct{}
+
+func (CLICredentials) Credentials(ctx context.Context) (Credentials, error) {
+	handle, appkey, err := GetCLICredentials()
+	if err != nil {
+		return Credentials{}, err
+	}
+	return Credentials{Handle: handle, Appkey: appkey}, nil
+}
@@ -0,0 +1,101 @@
+package botsky
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNetrcCredentials(t *testing.T) {
+	tests := []struct {
+		name    string
+		netrc   string
+		machine string
+		want    Credentials
+		wantErr error
+	}{
+		{
+			name:  "single line",
+			netrc: "machine bsky.social login bot.bsky.social password app-key",
+			want:  Credentials{Handle: "bot.bsky.social", Appkey: "app-key"},
+		},
+		{
+			name: "multiple lines and entries",
+			netrc: `machine github.com
+    login octocat
+    password gh-token
+machine bsky.social
+    login bot.bsky.social
+    password app-key
+`,
+			want: Credentials{Handle: "bot.bsky.social", Appkey: "app-key"},
+		},
+		{
+			name:    "entry without password doesn't take the next machine's",
+			netrc:   "machine bsky.social login bot.bsky.social\nmachine github.com login octocat password gh-token\n",
+			wantErr: ErrCredentialsNotFound,
+		},
+		{
+			name:    "password of a previous machine isn't used",
+			netrc:   "machine github.com login octocat password gh-token\nmachine bsky.social login bot.bsky.social\n",
+			wantErr: ErrCredentialsNotFound,
+		},
+		{
+			name:  "default entry",
+			netrc: "machine github.com login octocat password gh-token\ndefault login bot.bsky.social password app-key\n",
+			want:  Credentials{Handle: "bot.bsky.social", Appkey: "app-key"},
+		},
+		{
+			name:  "machine preferred over default",
+			netrc: "default login other password other-key\nmachine bsky.social login bot.bsky.social password app-key\n",
+			want:  Credentials{Handle: "bot.bsky.social", Appkey: "app-key"},
+		},
+		{
+			name: "macdef body is skipped",
+			netrc: `machine ftp.example.com login anonymous password guest
+macdef init
+machine bsky.social login evil password stolen
+cd /pub
+
+machine bsky.social login bot.bsky.social password app-key
+`,
+			want: Credentials{Handle: "bot.bsky.social", Appkey: "app-key"},
+		},
+		{
+			name:    "custom machine",
+			netrc:   "machine bsky.social login a password b\nmachine pds.example.com login bot.example.com password app-key\n",
+			machine: "pds.example.com",
+			want:    Credentials{Handle: "bot.example.com", Appkey: "app-key"},
+		},
+		{
+			name:  "account is ignored",
+			netrc: "machine bsky.social account main login bot.bsky.social password app-key",
+			want:  Credentials{Handle: "bot.bsky.social", Appkey: "app-key"},
+		},
+		{
+			name:    "no entry",
+			netrc:   "machine github.com login octocat password gh-token",
+			wantErr: ErrCredentialsNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), ".netrc")
+			if err := os.WriteFile(path, []byte(tt.netrc), 0600); err != nil {
+				t.Fatal(err)
+			}
+			creds, err := NetrcCredentials{Path: path, Machine: tt.machine}.Credentials(context.Background())
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Credentials() = %+v, %v, want error %v", creds, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || creds != tt.want {
+				t.Fatalf("Credentials() = %+v, %v, want %+v", creds, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package botsky
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Creates DPoP proofs (RFC 9449) with the key an OAuth session is bound to, and keeps track of server nonces.
+type dpopSigner struct {
+	key    *ecdsa.PrivateKey
+	jwk    map[string]string
+	mutex  sync.Mutex
+	nonces map[string]string // latest DPoP nonce, keyed by origin (scheme://host)
+}
+
+func newDpopSigner() (*dpopSigner, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return dpopSignerFromKey(key)
+}
+
+func dpopSignerFromKey(key *ecdsa.PrivateKey) (*dpopSigner, error) {
+	publicKey, err := key.PublicKey.ECDH()
+	if err != nil {
+		return nil, err
+	}
+	// uncompressed point: 0x04 || X || Y
+	point := publicKey.Bytes()
+	size := (len(point) - 1) / 2
+	return &dpopSigner{
+		key: key,
+		jwk: map[string]string{
+			"kty": "EC",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(point[1 : 1+size]),
+			"y":   base64.RawURLEncoding.EncodeToString(point[1+size:]),
+		},
+		nonces: make(map[string]string),
+	}, nil
+}
+
+// Restore a signer from a key serialized with marshalKey.
+func dpopSignerFromString(encoded string) (*dpopSigner, error) {
+	der, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParseECPrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	return dpopSignerFromKey(key)
+}
+
+// Serialize the key, for persisting the session.
+func (s *dpopSigner) marshalKey() (string, error) {
+	der, err := x509.MarshalECPrivateKey(s.key)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(der), nil
+}
+
+func originOf(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return rawUrl
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// Remember the nonce a server sent (ignored if empty).
+func (s *dpopSigner) updateNonce(rawUrl string, nonce string) {
+	if nonce == "" {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.nonces[originOf(rawUrl)] = nonce
+}
+
+// Create a DPoP proof for a request. If accessToken is set, the proof is bound to it (ath claim).
+func (s *dpopSigner) proof(method string, rawUrl string, accessToken string) (string, error) {
+	// htu is the url without query and fragment
+	htu := rawUrl
+	if i := strings.IndexAny(htu, "?#"); i != -1 {
+		htu = htu[:i]
+	}
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", fmt.Errorf("DPoP proof error: %w", err)
+	}
+	claims := jwt.MapClaims{
+		"jti": jti,
+		"htm": method,
+		"htu": htu,
+		"iat": time.Now().Unix(),
+	}
+	s.mutex.Lock()
+	if nonce, ok := s.nonces[originOf(rawUrl)]; ok {
+		claims["nonce"] = nonce
+	}
+	s.mutex.Unlock()
+	if accessToken != "" {
+		hash := sha256.Sum256([]byte(accessToken))
+		claims["ath"] = base64.RawURLEncoding.EncodeToString(hash[:])
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["typ"] = "dpop+jwt"
+	token.Header["jwk"] = s.jwk
+	signed, err := token.SignedString(s.key)
+	if err != nil {
+		return "", fmt.Errorf("DPoP proof error: %v", err)
+	}
+	return signed, nil
+}
+
+// Transport sending requests with DPoP-bound tokens while the client uses an OAuth session.
+//
+// Rewrites the "Bearer" authorization set by the XRPC client to "DPoP", attaches a proof, and retries once if the
+// resource server asks for a new nonce. Without an OAuth session, requests are passed through unchanged.
+type dpopTransport struct {
+	base   http.RoundTripper
+	client *Client
+}
+
+func (t *dpopTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	session := t.client.oauth.Load()
+	accessToken, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if session == nil || !ok {
+		return t.base.RoundTrip(req)
+	}
+
+	send := func() (*http.Response, error) {
+		proof, err := session.dpop.proof(req.Method, req.URL.String(), accessToken)
+		if err != nil {
+			return nil, err
+		}
+		dpopReq := req.Clone(req.Context())
+		if req.GetBody != nil {
+			if dpopReq.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		dpopReq.Header.Set("Authorization", "DPoP "+accessToken)
+		dpopReq.Header.Set("DPoP", proof)
+		resp, err := t.base.RoundTrip(dpopReq)
+		if err == nil {
+			session.dpop.updateNonce(req.URL.String(), resp.Header.Get("DPoP-Nonce"))
+		}
+		return resp, err
+	}
+
+	resp, err := send()
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	if !strings.Contains(resp.Header.Get("WWW-Authenticate"), "use_dpop_nonce") {
+		// the error might be reported in the body instead of the header
+		body, readErr := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		var xrpcErr struct {
+			Error string `json:"error"`
+		}
+		if readErr != nil || json.Unmarshal(body, &xrpcErr) != nil || xrpcErr.Error != "use_dpop_nonce" {
+			return resp, nil
+		}
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return resp, nil
+	}
+	resp.Body.Close()
+	return send()
+}
@@ -0,0 +1,114 @@
+package botsky
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/davhofer/indigo/xrpc"
+)
+
+// Sentinel errors, matched by errors.Is against errors returned by the client's methods.
+var (
+	ErrNotFound                = errors.New("not found")
+	ErrRateLimited             = errors.New("rate limited")
+	ErrAuthRequired            = errors.New("authentication required")
+	ErrChatRecipientDisallowed = errors.New("recipient does not accept messages from the bot")
+	ErrInvalidSwap             = errors.New("record was modified concurrently (invalid swap)")
+)
+
+// Error response of an XRPC request.
+//
+// Matches the sentinel errors with errors.Is, e.g. errors.Is(err, ErrNotFound) for a RecordNotFound response.
+type XRPCError struct {
+	StatusCode int
+	Name       string              // error name, e.g. "RecordNotFound" or "InvalidRequest"
+	Message    string              // human readable message
+	RateLimit  *xrpc.RatelimitInfo // rate limit state reported with the response, may be nil
+	Err        error               // the underlying error of the XRPC client
+}
+
+func (e *XRPCError) Error() string {
+	if e.Name == "" && e.Message == "" {
+		return fmt.Sprintf("XRPC ERROR %d", e.StatusCode)
+	}
+	return fmt.Sprintf("XRPC ERROR %d: %s: %s", e.StatusCode, e.Name, e.Message)
+}
+
+func (e *XRPCError) Unwrap() error {
+	return e.Err
+}
+
+// Error names meaning that the requested record, actor, etc. does not exist.
+var notFoundNames = map[string]bool{
+	"RecordNotFound":  true,
+	"RepoNotFound":    true,
+	"BlobNotFound":    true,
+	"NotFound":        true,
+	"ProfileNotFound": true,
+	"ActorNotFound":   true,
+	"ConvoNotFound":   true,
+}
+
+// Error names meaning that the request lacked valid credentials.
+var authRequiredNames = map[string]bool{
+	"AuthenticationRequired": true,
+	"AuthMissing":            true,
+	"ExpiredToken":           true,
+	"InvalidToken":           true,
+	"invalid_token":          true,
+}
+
+// Messages of the chat service when the recipient's chat settings don't allow messages from the bot.
+var chatDisallowedMessages = []string{
+	"recipient requires incoming messages to come from someone they follow",
+	"recipient has disabled incoming messages",
+}
+
+func (e *XRPCError) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound || notFoundNames[e.Name] ||
+			(e.Name == "InvalidRequest" && strings.HasPrefix(e.Message, "Could not locate record"))
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests || e.Name == "RateLimitExceeded"
+	case ErrAuthRequired:
+		return e.StatusCode == http.StatusUnauthorized || authRequiredNames[e.Name]
+	case ErrChatRecipientDisallowed:
+		for _, message := range chatDisallowedMessages {
+			if strings.Contains(e.Message, message) {
+				return true
+			}
+		}
+		return false
+	case ErrInvalidSwap:
+		return e.Name == "InvalidSwap"
+	}
+	return false
+}
+
+// Convert errors of the XRPC client to *XRPCError. Other errors are returned unchanged.
+func xrpcError(err error) error {
+	var converted *XRPCError
+	if errors.As(err, &converted) {
+		return err
+	}
+	var xrpcErr *xrpc.Error
+	if !errors.As(err, &xrpcErr) {
+		return err
+	}
+	result := &XRPCError{
+		StatusCode: xrpcErr.StatusCode,
+		RateLimit:  xrpcErr.Ratelimit,
+		Err:        err,
+	}
+	var body *xrpc.XRPCError
+	if errors.As(xrpcErr.Wrapped, &body) {
+		result.Name = body.ErrStr
+		result.Message = body.Message
+	} else if xrpcErr.Wrapped != nil {
+		result.Message = xrpcErr.Wrapped.Error()
+	}
+	return result
+}
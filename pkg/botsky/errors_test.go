@@ -0,0 +1,48 @@
+package botsky
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestGetPostNotFound(t *testing.T) {
+	tests := []struct {
+		name    string
+		respond func(w http.ResponseWriter)
+	}{
+		{
+			name:    "empty result",
+			respond: func(w http.ResponseWriter) { w.Write([]byte(`{"posts":[]}`)) },
+		},
+		{
+			name:    "404 response",
+			respond: func(w http.ResponseWriter) { xrpcErrorResponse(w, http.StatusNotFound, "NotFound") },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pds := newFakePDS(t, newFakeClock())
+			pds.handler = func(w http.ResponseWriter, r *http.Request) { tt.respond(w) }
+			client := newTestClient(t, pds, nil)
+
+			_, err := client.GetPost(context.Background(), "at://did:plc:bot/app.bsky.feed.post/3k")
+			if !errors.Is(err, ErrNotFound) {
+				t.Errorf("GetPost error = %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func TestAuthenticateWrongPassword(t *testing.T) {
+	pds := newFakePDS(t, newFakeClock())
+	pds.createStatus = http.StatusUnauthorized
+	client := newTestClient(t, pds, nil)
+
+	err := client.Authenticate(context.Background())
+	var xrpcErr *XRPCError
+	if !errors.Is(err, ErrAuthRequired) || !errors.As(err, &xrpcErr) || xrpcErr.Name != "AuthenticationRequired" {
+		t.Errorf("Authenticate error = %v, want an XRPCError matching ErrAuthRequired", err)
+	}
+}
@@ -10,24 +10,45 @@ import (
 
 // TODO: chekc that all functions with cursors that get lists/collections have the abilitiy to iterate and get more
 
-// Get the most recent notifications (doesn't include DMs!).
-//
-// Currently cannot get more than 100 notifications at once.
+// Get the most recent notifications (doesn't include DMs!), newest first.
 func (c *Client) NotifGetNotifications(ctx context.Context, limit int64) ([]*bsky.NotificationListNotifications_Notification, error) {
-	limit = min(100, limit)
 	limit = max(1, limit)
-	limit = 10
+	var notifications []*bsky.NotificationListNotifications_Notification
+	cursor := ""
+	for int64(len(notifications)) < limit {
+		page, next, _, err := c.NotifListNotifications(ctx, cursor, min(100, limit-int64(len(notifications))))
+		if err != nil {
+			return nil, fmt.Errorf("NotifGetNotifications error: %w", err)
+		}
+		notifications = append(notifications, page...)
+		if next == "" || len(page) == 0 {
+			break
+		}
+		cursor = next
+	}
+	return notifications, nil
+}
+
+// Get a single page of notifications (at most 100), newest first.
+//
+// Also returns the cursor of the next page ("" if there is none), and the time notifications were last marked
+// as seen ("" if never).
+func (c *Client) NotifListNotifications(ctx context.Context, cursor string, limit int64) ([]*bsky.NotificationListNotifications_Notification, string, string, error) {
+	limit = min(100, max(1, limit))
 	priority := false
 	reasons := []string{}
-	output, err := bsky.NotificationListNotifications(ctx, c.xrpcClient, "", limit, priority, reasons, "")
+	output, err := bsky.NotificationListNotifications(ctx, c.xrpcClient, cursor, limit, priority, reasons, "")
 	if err != nil {
-		return nil, fmt.Errorf("Error when calling ListNotifications: %v", err)
+		return nil, "", "", fmt.Errorf("Error when calling ListNotifications: %w", xrpcError(err))
 	}
-
-	// TODO: iterate over remaining notifications with cursor
-	// (low prio, unlikely that there will be 100+ notifications at a time)
-
-	return output.Notifications, nil
+	next, seenAt := "", ""
+	if output.Cursor != nil {
+		next = *output.Cursor
+	}
+	if output.SeenAt != nil {
+		seenAt = *output.SeenAt
+	}
+	return output.Notifications, next, seenAt, nil
 }
 
 // Get the number of unread notifications.
@@ -36,15 +57,23 @@ func (c *Client) NotifGetUnreadCount(ctx context.Context) (int64, error) {
 	seenAt := ""
 	output, err := bsky.NotificationGetUnreadCount(ctx, c.xrpcClient, priority, seenAt)
 	if err != nil {
-		return 0, fmt.Errorf("Unable to get notification unread count: %v", err)
+		return 0, fmt.Errorf("Unable to get notification unread count: %w", xrpcError(err))
 	}
 	return output.Count, nil
 }
 
 // Update all unseen notifications to seen.
 func (c *Client) NotifUpdateSeen(ctx context.Context) error {
+	return c.NotifUpdateSeenAt(ctx, time.Now())
+}
+
+// Mark the notifications indexed up to the given time as seen.
+func (c *Client) NotifUpdateSeenAt(ctx context.Context, seenAt time.Time) error {
 	updateSeenInput := bsky.NotificationUpdateSeen_Input{
-		SeenAt: time.Now().UTC().Format(time.RFC3339),
+		SeenAt: seenAt.UTC().Format(time.RFC3339Nano),
+	}
+	if err := bsky.NotificationUpdateSeen(ctx, c.xrpcClient, &updateSeenInput); err != nil {
+		return fmt.Errorf("NotifUpdateSeen error: %w", xrpcError(err))
 	}
-	return bsky.NotificationUpdateSeen(ctx, c.xrpcClient, &updateSeenInput)
+	return nil
 }
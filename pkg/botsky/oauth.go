@@ -0,0 +1,399 @@
+package botsky
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/davhofer/indigo/xrpc"
+)
+
+// Default OAuth scope, granting the same permissions as an app password with DM access.
+const DefaultOAuthScope = "atproto transition:generic transition:chat.bsky"
+
+// Service DID of the Bluesky chat service, used to proxy chat requests through the PDS for OAuth sessions.
+const chatServiceProxy = "did:web:api.bsky.chat#bsky_chat"
+
+var ErrOAuthReauthorizationRequired = errors.New("OAuth session cannot be refreshed, the user has to authorize the client again")
+
+// Error response of an OAuth authorization server.
+type OAuthError struct {
+	StatusCode  int
+	ErrorCode   string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *OAuthError) Error() string {
+	return fmt.Sprintf("OAuth error %d: %s: %s", e.StatusCode, e.ErrorCode, e.Description)
+}
+
+// Configuration of the OAuth client.
+//
+// Only public clients (token_endpoint_auth_method "none") are supported.
+type OAuthConfig struct {
+	ClientID    string // url of the client metadata document. Leave empty for a loopback (development) client
+	RedirectURI string // must be listed in the client metadata
+	Scope       string // defaults to DefaultOAuthScope
+}
+
+// Metadata of an OAuth authorization server (RFC 8414), as far as it is needed by the client.
+type oauthServerMetadata struct {
+	Issuer                             string `json:"issuer"`
+	AuthorizationEndpoint              string `json:"authorization_endpoint"`
+	TokenEndpoint                      string `json:"token_endpoint"`
+	PushedAuthorizationRequestEndpoint string `json:"pushed_authorization_request_endpoint"`
+}
+
+type oauthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	Scope        string `json:"scope"`
+	Sub          string `json:"sub"`
+}
+
+// State of an authorized OAuth session, shared by the client's requests.
+type oauthSession struct {
+	issuer        string
+	tokenEndpoint string
+	clientId      string
+	dpop          *dpopSigner
+}
+
+// A pending OAuth authorization, created by OAuthStartAuthorization.
+//
+// Direct the user to AuthorizationURL, then pass the query parameters of the redirect to OAuthCompleteAuthorization.
+type OAuthAuthorization struct {
+	AuthorizationURL string
+	State            string
+
+	config       OAuthConfig
+	metadata     oauthServerMetadata
+	codeVerifier string
+	dpop         *dpopSigner
+}
+
+// Generate a random url-safe string with the given number of random bytes.
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("randomToken error (rand.Read): %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Client id for loopback clients, see https://atproto.com/specs/oauth#localhost-client-development
+func loopbackClientID(redirectUri string, scope string) string {
+	params := url.Values{}
+	params.Set("redirect_uri", redirectUri)
+	params.Set("scope", scope)
+	return "http://localhost?" + params.Encode()
+}
+
+// Fetch a JSON document with a GET request.
+func (c *Client) getJSON(ctx context.Context, url string, result any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(result)
+}
+
+// Discover the authorization server of the account's PDS and fetch its metadata.
+func (c *Client) oauthDiscover(ctx context.Context) (oauthServerMetadata, error) {
+	var metadata oauthServerMetadata
+	pdsHost := strings.TrimSuffix(c.xrpcClient.GetHostAsync(), "/")
+
+	var resource struct {
+		AuthorizationServers []string `json:"authorization_servers"`
+	}
+	if err := c.getJSON(ctx, pdsHost+"/.well-known/oauth-protected-resource", &resource); err != nil {
+		return metadata, fmt.Errorf("oauthDiscover error (oauth-protected-resource): %v", err)
+	}
+	if len(resource.AuthorizationServers) == 0 {
+		return metadata, fmt.Errorf("oauthDiscover error: PDS %s lists no authorization server", pdsHost)
+	}
+
+	issuer := strings.TrimSuffix(resource.AuthorizationServers[0], "/")
+	if err := c.getJSON(ctx, issuer+"/.well-known/oauth-authorization-server", &metadata); err != nil {
+		return metadata, fmt.Errorf("oauthDiscover error (oauth-authorization-server): %v", err)
+	}
+	if metadata.Issuer != issuer {
+		return metadata, fmt.Errorf("oauthDiscover error: issuer mismatch (%s != %s)", metadata.Issuer, issuer)
+	}
+	if metadata.PushedAuthorizationRequestEndpoint == "" || metadata.TokenEndpoint == "" || metadata.AuthorizationEndpoint == "" {
+		return metadata, fmt.Errorf("oauthDiscover error: incomplete authorization server metadata")
+	}
+	return metadata, nil
+}
+
+// POST a form to the authorization server with a DPoP proof, retrying once if the server requires a (new) nonce.
+func (c *Client) oauthPost(ctx context.Context, dpop *dpopSigner, endpoint string, form url.Values, result any) error {
+	for attempt := 0; ; attempt++ {
+		proof, err := dpop.proof(http.MethodPost, endpoint, "")
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("DPoP", proof)
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		dpop.updateNonce(endpoint, resp.Header.Get("DPoP-Nonce"))
+
+		if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated {
+			return json.Unmarshal(body, result)
+		}
+		oauthErr := &OAuthError{StatusCode: resp.StatusCode}
+		json.Unmarshal(body, oauthErr)
+		if oauthErr.ErrorCode == "use_dpop_nonce" && attempt == 0 {
+			continue
+		}
+		return oauthErr
+	}
+}
+
+// Start an OAuth authorization for the client's account.
+//
+// Discovers the authorization server from the account's PDS and sends a pushed authorization request (PAR) with PKCE.
+// The returned AuthorizationURL has to be opened by the user in a browser.
+func (c *Client) OAuthStartAuthorization(ctx context.Context, config OAuthConfig) (*OAuthAuthorization, error) {
+	if config.Scope == "" {
+		config.Scope = DefaultOAuthScope
+	}
+	if config.RedirectURI == "" {
+		return nil, fmt.Errorf("OAuthStartAuthorization error: no redirect uri")
+	}
+	if config.ClientID == "" {
+		config.ClientID = loopbackClientID(config.RedirectURI, config.Scope)
+	}
+	if c.Did == "" || c.xrpcClient.GetHostAsync() == "" {
+		if err := c.resolveIdentity(ctx); err != nil {
+			return nil, fmt.Errorf("OAuthStartAuthorization error (resolveIdentity): %w", err)
+		}
+	}
+
+	metadata, err := c.oauthDiscover(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("OAuthStartAuthorization error: %w", err)
+	}
+	dpop, err := newDpopSigner()
+	if err != nil {
+		return nil, fmt.Errorf("OAuthStartAuthorization error (newDpopSigner): %v", err)
+	}
+
+	// PKCE
+	codeVerifier, err := randomToken(32)
+	if err != nil {
+		return nil, fmt.Errorf("OAuthStartAuthorization error: %w", err)
+	}
+	challenge := sha256.Sum256([]byte(codeVerifier))
+	state, err := randomToken(16)
+	if err != nil {
+		return nil, fmt.Errorf("OAuthStartAuthorization error: %w", err)
+	}
+
+	form := url.Values{}
+	form.Set("client_id", config.ClientID)
+	form.Set("response_type", "code")
+	form.Set("redirect_uri", config.RedirectURI)
+	form.Set("scope", config.Scope)
+	form.Set("state", state)
+	form.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	form.Set("code_challenge_method", "S256")
+	form.Set("login_hint", c.Handle)
+
+	var parResponse struct {
+		RequestURI string `json:"request_uri"`
+	}
+	if err := c.oauthPost(ctx, dpop, metadata.PushedAuthorizationRequestEndpoint, form, &parResponse); err != nil {
+		return nil, fmt.Errorf("OAuthStartAuthorization error (PAR): %w", err)
+	}
+
+	params := url.Values{}
+	params.Set("client_id", config.ClientID)
+	params.Set("request_uri", parResponse.RequestURI)
+	return &OAuthAuthorization{
+		AuthorizationURL: metadata.AuthorizationEndpoint + "?" + params.Encode(),
+		State:            state,
+		config:           config,
+		metadata:         metadata,
+		codeVerifier:     codeVerifier,
+		dpop:             dpop,
+	}, nil
+}
+
+// Complete an OAuth authorization with the query parameters the authorization server redirected the user with.
+//
+// Exchanges the authorization code for DPoP-bound tokens. Afterwards, the client is authenticated just like after
+// Authenticate: the session is refreshed in the background and persisted in the session store.
+func (c *Client) OAuthCompleteAuthorization(ctx context.Context, authorization *OAuthAuthorization, callbackParams url.Values) error {
+	if errCode := callbackParams.Get("error"); errCode != "" {
+		return fmt.Errorf("OAuthCompleteAuthorization error: %w", &OAuthError{ErrorCode: errCode, Description: callbackParams.Get("error_description")})
+	}
+	if subtle.ConstantTimeCompare([]byte(callbackParams.Get("state")), []byte(authorization.State)) != 1 {
+		return fmt.Errorf("OAuthCompleteAuthorization error: state mismatch")
+	}
+	if iss := callbackParams.Get("iss"); iss != "" && iss != authorization.metadata.Issuer {
+		return fmt.Errorf("OAuthCompleteAuthorization error: issuer mismatch")
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", callbackParams.Get("code"))
+	form.Set("redirect_uri", authorization.config.RedirectURI)
+	form.Set("code_verifier", authorization.codeVerifier)
+	form.Set("client_id", authorization.config.ClientID)
+
+	var tokens oauthTokenResponse
+	if err := c.oauthPost(ctx, authorization.dpop, authorization.metadata.TokenEndpoint, form, &tokens); err != nil {
+		return fmt.Errorf("OAuthCompleteAuthorization error (token request): %w", err)
+	}
+	if tokens.Sub != c.Did {
+		return fmt.Errorf("OAuthCompleteAuthorization error: authorized account %s is not %s", tokens.Sub, c.Did)
+	}
+
+	session := &oauthSession{
+		issuer:        authorization.metadata.Issuer,
+		tokenEndpoint: authorization.metadata.TokenEndpoint,
+		clientId:      authorization.config.ClientID,
+		dpop:          authorization.dpop,
+	}
+
+	c.sessionLock.Lock()
+	defer c.sessionLock.Unlock()
+	c.useOAuthSession(session)
+	c.setOAuthTokens(ctx, tokens)
+	return nil
+}
+
+// Switch the client to the given OAuth session. Chat requests are proxied through the PDS, since the chat service
+// does not accept OAuth tokens directly.
+func (c *Client) useOAuthSession(session *oauthSession) {
+	c.oauth.Store(session)
+	c.chatClient.SetHostAsync(c.xrpcClient.GetHostAsync())
+	c.chatClient.SetHeaderAsync("atproto-proxy", chatServiceProxy)
+}
+
+// Set the tokens of a token response as the client's auth info.
+func (c *Client) setOAuthTokens(ctx context.Context, tokens oauthTokenResponse) {
+	expiresIn := time.Duration(tokens.ExpiresIn) * time.Second
+	if expiresIn <= 0 {
+		expiresIn = 5 * time.Minute
+	}
+	c.setAuth(ctx, xrpc.AuthInfo{
+		AccessJwt:  tokens.AccessToken,
+		RefreshJwt: tokens.RefreshToken,
+		Handle:     c.Handle,
+		Did:        tokens.Sub,
+	}, c.clock.Now().Add(expiresIn))
+}
+
+// Refresh the OAuth tokens. Must be called with sessionLock held.
+func (c *Client) oauthRefresh(ctx context.Context, session *oauthSession) error {
+	auth := c.xrpcClient.GetAuthAsync()
+	if auth.RefreshJwt == "" {
+		return ErrOAuthReauthorizationRequired
+	}
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", auth.RefreshJwt)
+	form.Set("client_id", session.clientId)
+
+	var tokens oauthTokenResponse
+	if err := c.oauthPost(ctx, session.dpop, session.tokenEndpoint, form, &tokens); err != nil {
+		var oauthErr *OAuthError
+		if errors.As(err, &oauthErr) && oauthErr.ErrorCode == "invalid_grant" {
+			return fmt.Errorf("%w: %w", ErrOAuthReauthorizationRequired, err)
+		}
+		return err
+	}
+	if tokens.Sub != auth.Did {
+		return fmt.Errorf("refreshed token is for a different account (%s)", tokens.Sub)
+	}
+	c.setOAuthTokens(ctx, tokens)
+	return nil
+}
+
+// Authenticate via OAuth, for CLI bots running on the machine of the user authorizing them.
+//
+// Starts a temporary HTTP server on the loopback interface to receive the redirect, and calls openURL with the
+// authorization URL, which the user has to open in a browser (e.g. print it, or launch the browser).
+// Blocks until the authorization is completed, or ctx is cancelled.
+func (c *Client) AuthenticateOAuthLoopback(ctx context.Context, openURL func(authorizationURL string) error) error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("AuthenticateOAuthLoopback error (net.Listen): %v", err)
+	}
+	defer listener.Close()
+	redirectUri := fmt.Sprintf("http://%s/callback", listener.Addr().String())
+
+	authorization, err := c.OAuthStartAuthorization(ctx, OAuthConfig{RedirectURI: redirectUri})
+	if err != nil {
+		return fmt.Errorf("AuthenticateOAuthLoopback error: %w", err)
+	}
+
+	callbacks := make(chan url.Values, 1)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/callback" || r.URL.Query().Get("state") != authorization.State {
+				http.NotFound(w, r)
+				return
+			}
+			select {
+			case callbacks <- r.URL.Query():
+				fmt.Fprintln(w, "Authorization received, you can close this window.")
+			default:
+				http.Error(w, "Authorization already received", http.StatusConflict)
+			}
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	if err := openURL(authorization.AuthorizationURL); err != nil {
+		return fmt.Errorf("AuthenticateOAuthLoopback error (openURL): %v", err)
+	}
+
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("AuthenticateOAuthLoopback error: %w", ctx.Err())
+	case params := <-callbacks:
+		if err := c.OAuthCompleteAuthorization(ctx, authorization, params); err != nil {
+			return fmt.Errorf("AuthenticateOAuthLoopback error: %w", err)
+		}
+		return nil
+	}
+}
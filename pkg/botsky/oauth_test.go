@@ -0,0 +1,381 @@
+package botsky
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Local stand-in for an OAuth authorization server and the PDS it issues DPoP-bound tokens for.
+// Both require DPoP nonces, so every client retries its first request.
+type fakeAuthServer struct {
+	auth *httptest.Server
+	pds  *httptest.Server
+
+	mutex         sync.Mutex
+	challenge     string // code challenge of the pushed authorization request
+	access        string
+	refresh       string
+	issued        int
+	refreshError  string // error code of refresh token requests, "" to issue tokens
+	sub           string // account the tokens are issued for
+	parRequests   int
+	tokenRequests int
+	pdsRequests   int
+	proofKeys     []string // x coordinate of the key of every accepted PDS proof
+}
+
+const (
+	authServerNonce = "auth-nonce"
+	pdsNonce        = "pds-nonce"
+)
+
+func newFakeAuthServer(t *testing.T) *fakeAuthServer {
+	s := &fakeAuthServer{sub: "did:plc:bot"}
+	s.auth = httptest.NewServer(http.HandlerFunc(s.serveAuth))
+	s.pds = httptest.NewServer(http.HandlerFunc(s.servePDS))
+	t.Cleanup(s.auth.Close)
+	t.Cleanup(s.pds.Close)
+	return s
+}
+
+// Claims and jwk x coordinate of a DPoP proof. The signature is checked by the client's library, not here.
+func parseProof(proof string) (jwt.MapClaims, string) {
+	claims := jwt.MapClaims{}
+	token, _, err := jwt.NewParser().ParseUnverified(proof, claims)
+	if err != nil {
+		return nil, ""
+	}
+	jwk, _ := token.Header["jwk"].(map[string]any)
+	x, _ := jwk["x"].(string)
+	return claims, x
+}
+
+func oauthErrorResponse(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": code, "error_description": code})
+}
+
+func (s *fakeAuthServer) issue(w http.ResponseWriter) {
+	s.issued++
+	s.access, s.refresh = fmt.Sprintf("access-%d", s.issued), fmt.Sprintf("refresh-%d", s.issued)
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token": s.access, "refresh_token": s.refresh, "token_type": "DPoP", "expires_in": 3600, "sub": s.sub,
+	})
+}
+
+func (s *fakeAuthServer) serveAuth(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if r.URL.Path == "/.well-known/oauth-authorization-server" {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                                s.auth.URL,
+			"authorization_endpoint":                s.auth.URL + "/oauth/authorize",
+			"token_endpoint":                        s.auth.URL + "/oauth/token",
+			"pushed_authorization_request_endpoint": s.auth.URL + "/oauth/par",
+		})
+		return
+	}
+
+	switch r.URL.Path {
+	case "/oauth/par":
+		s.parRequests++
+	case "/oauth/token":
+		s.tokenRequests++
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	claims, _ := parseProof(r.Header.Get("DPoP"))
+	if claims == nil || claims["htm"] != http.MethodPost || claims["htu"] != s.auth.URL+r.URL.Path {
+		oauthErrorResponse(w, http.StatusBadRequest, "invalid_dpop_proof")
+		return
+	}
+	if claims["nonce"] != authServerNonce {
+		w.Header().Set("DPoP-Nonce", authServerNonce)
+		oauthErrorResponse(w, http.StatusBadRequest, "use_dpop_nonce")
+		return
+	}
+
+	r.ParseForm()
+	switch {
+	case r.URL.Path == "/oauth/par":
+		s.challenge = r.Form.Get("code_challenge")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"request_uri": "urn:ietf:params:oauth:request_uri:1"})
+	case r.Form.Get("grant_type") == "authorization_code":
+		verifier := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+		if r.Form.Get("code") != "code" || base64.RawURLEncoding.EncodeToString(verifier[:]) != s.challenge {
+			oauthErrorResponse(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+		s.issue(w)
+	case r.Form.Get("grant_type") == "refresh_token":
+		if s.refreshError != "" {
+			oauthErrorResponse(w, http.StatusBadRequest, s.refreshError)
+			return
+		}
+		if r.Form.Get("refresh_token") != s.refresh {
+			oauthErrorResponse(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+		s.issue(w)
+	default:
+		oauthErrorResponse(w, http.StatusBadRequest, "unsupported_grant_type")
+	}
+}
+
+func (s *fakeAuthServer) servePDS(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if r.URL.Path == "/.well-known/oauth-protected-resource" {
+		json.NewEncoder(w).Encode(map[string]any{"authorization_servers": []string{s.auth.URL}})
+		return
+	}
+
+	s.pdsRequests++
+	accessToken, ok := strings.CutPrefix(r.Header.Get("Authorization"), "DPoP ")
+	claims, x := parseProof(r.Header.Get("DPoP"))
+	ath := sha256.Sum256([]byte(accessToken))
+	if !ok || accessToken != s.access || claims == nil || claims["ath"] != base64.RawURLEncoding.EncodeToString(ath[:]) {
+		xrpcErrorResponse(w, http.StatusUnauthorized, "InvalidToken")
+		return
+	}
+	if claims["nonce"] != pdsNonce {
+		w.Header().Set("DPoP-Nonce", pdsNonce)
+		w.Header().Set("WWW-Authenticate", `DPoP error="use_dpop_nonce"`)
+		xrpcErrorResponse(w, http.StatusUnauthorized, "use_dpop_nonce")
+		return
+	}
+	s.proofKeys = append(s.proofKeys, x)
+	json.NewEncoder(w).Encode(map[string]any{"count": 3})
+}
+
+func (s *fakeAuthServer) set(f func(s *fakeAuthServer)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f(s)
+}
+
+func (s *fakeAuthServer) counts() (par int, token int, pds int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.parRequests, s.tokenRequests, s.pdsRequests
+}
+
+func newOAuthTestClient(t *testing.T, s *fakeAuthServer, options ...Option) *Client {
+	t.Helper()
+	options = append([]Option{
+		WithPDSHost(s.pds.URL),
+		WithEagerDIDResolution(false),
+		WithoutLogging(),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 1}),
+	}, options...)
+	client, err := NewClient(context.Background(), "did:plc:bot", "", options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// Run the authorization flow, with the callback the authorization server would redirect the user with.
+func authorize(t *testing.T, s *fakeAuthServer, client *Client) {
+	t.Helper()
+	authorization, err := client.OAuthStartAuthorization(context.Background(), OAuthConfig{RedirectURI: "http://127.0.0.1/callback"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	callback := url.Values{"state": {authorization.State}, "code": {"code"}, "iss": {s.auth.URL}}
+	if err := client.OAuthCompleteAuthorization(context.Background(), authorization, callback); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOAuthAuthorization(t *testing.T) {
+	s := newFakeAuthServer(t)
+	store := NewMemorySessionStore()
+	client := newOAuthTestClient(t, s, WithSessionStore(store))
+
+	authorization, err := client.OAuthStartAuthorization(context.Background(), OAuthConfig{RedirectURI: "http://127.0.0.1/callback"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(authorization.AuthorizationURL, s.auth.URL+"/oauth/authorize?") ||
+		!strings.Contains(authorization.AuthorizationURL, "request_uri=urn") {
+		t.Errorf("authorization url = %s", authorization.AuthorizationURL)
+	}
+	// the pushed authorization request was retried with the nonce
+	if par, _, _ := s.counts(); par != 2 {
+		t.Errorf("%d pushed authorization requests, want 2", par)
+	}
+
+	callback := url.Values{"state": {authorization.State}, "code": {"code"}, "iss": {s.auth.URL}}
+	if err := client.OAuthCompleteAuthorization(context.Background(), authorization, callback); err != nil {
+		t.Fatal(err)
+	}
+	// the nonce of the authorization server was reused for the token request
+	if _, token, _ := s.counts(); token != 1 {
+		t.Errorf("%d token requests, want 1", token)
+	}
+
+	// PDS requests are sent with DPoP-bound tokens, and retried with the nonce of the PDS
+	count, err := client.NotifGetUnreadCount(context.Background())
+	if err != nil || count != 3 {
+		t.Fatalf("NotifGetUnreadCount = %d, %v", count, err)
+	}
+	if _, _, pds := s.counts(); pds != 2 {
+		t.Errorf("%d PDS requests, want 2", pds)
+	}
+
+	session, err := store.Load(context.Background(), "did:plc:bot")
+	if err != nil || session.OAuth == nil || session.OAuth.Issuer != s.auth.URL || session.OAuth.DpopKey == "" || session.AccessJwt != "access-1" {
+		t.Errorf("stored session = %+v, %v", session, err)
+	}
+}
+
+func TestOAuthCallbackChecks(t *testing.T) {
+	tests := []struct {
+		name     string
+		callback func(authorization *OAuthAuthorization, issuer string) url.Values
+		sub      string
+		want     error // matched with errors.Is, nil to only expect an error
+	}{
+		{
+			name: "state mismatch",
+			callback: func(authorization *OAuthAuthorization, issuer string) url.Values {
+				return url.Values{"state": {"forged"}, "code": {"code"}, "iss": {issuer}}
+			},
+		},
+		{
+			name: "issuer mismatch",
+			callback: func(authorization *OAuthAuthorization, issuer string) url.Values {
+				return url.Values{"state": {authorization.State}, "code": {"code"}, "iss": {"https://evil.example"}}
+			},
+		},
+		{
+			name: "denied by the user",
+			callback: func(authorization *OAuthAuthorization, issuer string) url.Values {
+				return url.Values{"state": {authorization.State}, "error": {"access_denied"}}
+			},
+		},
+		{
+			name: "other account",
+			callback: func(authorization *OAuthAuthorization, issuer string) url.Values {
+				return url.Values{"state": {authorization.State}, "code": {"code"}, "iss": {issuer}}
+			},
+			sub: "did:plc:other",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFakeAuthServer(t)
+			if tt.sub != "" {
+				s.sub = tt.sub
+			}
+			client := newOAuthTestClient(t, s)
+			authorization, err := client.OAuthStartAuthorization(context.Background(), OAuthConfig{RedirectURI: "http://127.0.0.1/callback"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := client.OAuthCompleteAuthorization(context.Background(), authorization, tt.callback(authorization, s.auth.URL)); err == nil {
+				t.Fatal("OAuthCompleteAuthorization succeeded")
+			}
+			// the client isn't authenticated
+			if client.oauth.Load() != nil || client.xrpcClient.GetAuthAsync().AccessJwt != "" {
+				t.Error("client uses the rejected authorization")
+			}
+		})
+	}
+}
+
+func TestOAuthRefreshInvalidGrant(t *testing.T) {
+	s := newFakeAuthServer(t)
+	client := newOAuthTestClient(t, s)
+	authorize(t, s, client)
+
+	// a successful refresh rotates the tokens
+	if err := client.RefreshSession(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if auth := client.xrpcClient.GetAuthAsync(); auth.AccessJwt != "access-2" || auth.RefreshJwt != "refresh-2" {
+		t.Errorf("tokens after refresh = %s, %s", auth.AccessJwt, auth.RefreshJwt)
+	}
+
+	s.set(func(s *fakeAuthServer) { s.refreshError = "invalid_grant" })
+	err := client.RefreshSession(context.Background())
+	var oauthErr *OAuthError
+	if !errors.Is(err, ErrOAuthReauthorizationRequired) || !errors.As(err, &oauthErr) || oauthErr.ErrorCode != "invalid_grant" {
+		t.Errorf("RefreshSession error = %v, want ErrOAuthReauthorizationRequired", err)
+	}
+	// an OAuth session can't fall back to a login with an app password
+	if err := client.Authenticate(context.Background()); !errors.Is(err, ErrOAuthReauthorizationRequired) {
+		t.Errorf("Authenticate error = %v, want ErrOAuthReauthorizationRequired", err)
+	}
+
+	// other errors of the authorization server don't require a new authorization
+	s.set(func(s *fakeAuthServer) { s.refreshError = "temporarily_unavailable" })
+	if err := client.RefreshSession(context.Background()); err == nil || errors.Is(err, ErrOAuthReauthorizationRequired) {
+		t.Errorf("RefreshSession error = %v, want a plain OAuth error", err)
+	}
+}
+
+func TestOAuthResumeSession(t *testing.T) {
+	tests := []struct {
+		name        string
+		expired     bool
+		wantRefresh bool
+	}{
+		{name: "valid", wantRefresh: false},
+		{name: "expired", expired: true, wantRefresh: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newFakeAuthServer(t)
+			store := NewMemorySessionStore()
+			first := newOAuthTestClient(t, s, WithSessionStore(store))
+			authorize(t, s, first)
+			if _, err := first.NotifGetUnreadCount(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			first.Close()
+
+			if tt.expired {
+				session, _ := store.Load(context.Background(), "did:plc:bot")
+				session.OAuth.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+				store.Save(context.Background(), "did:plc:bot", session)
+			}
+			_, tokensBefore, _ := s.counts()
+
+			// a new process resumes the stored session with the same DPoP key
+			second := newOAuthTestClient(t, s, WithSessionStore(store))
+			if err := second.ResumeSession(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := second.NotifGetUnreadCount(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if _, tokens, _ := s.counts(); (tokens > tokensBefore) != tt.wantRefresh {
+				t.Errorf("%d token requests on resume, want refresh %v", tokens-tokensBefore, tt.wantRefresh)
+			}
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			if keys := s.proofKeys; len(keys) != 2 || keys[0] != keys[1] {
+				t.Errorf("proof keys %v, want the stored key to be reused", keys)
+			}
+		})
+	}
+}
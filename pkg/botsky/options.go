@@ -0,0 +1,205 @@
+package botsky
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"net/http"
+	"time"
+
+	"github.com/davhofer/botsky/pkg/identity"
+)
+
+// Default timeout of the HTTP client shared by all requests of a Client.
+const DefaultHTTPTimeout = 30 * time.Second
+
+type clientOptions struct {
+	pdsHost     string
+	appviewHost string
+	chatHost    string
+	httpClient  *http.Client
+	transport   http.RoundTripper
+	userAgent   string
+	logger      *slog.Logger
+	resolveDid  bool
+	sessions    SessionStore
+	onAuthError func(error)
+	authPrompt  func(context.Context) (string, error)
+	credentials CredentialProvider
+	identity    *identity.Resolver
+	rateLimits  map[RateLimitClass]RateLimit
+	maxWait     time.Duration
+	retry       RetryPolicy
+	middleware  []func(http.RoundTripper) http.RoundTripper
+}
+
+// Option configures a Client, see NewClient.
+type Option func(*clientOptions)
+
+func defaultClientOptions() clientOptions {
+	return clientOptions{
+		chatHost:   ApiChat,
+		resolveDid: true,
+		rateLimits: maps.Clone(DefaultRateLimits),
+		maxWait:    DefaultMaxRateLimitWait,
+		retry:      DefaultRetryPolicy(),
+	}
+}
+
+// Use the given PDS host (e.g. "https://bsky.social") instead of discovering the PDS from the account's DID document.
+func WithPDSHost(host string) Option {
+	return func(o *clientOptions) {
+		o.pdsHost = host
+	}
+}
+
+// Send public AppView reads (posts, profiles, actor search) directly to the given host (e.g. ApiPublic).
+//
+// These requests are unauthenticated, so viewer state (e.g. whether the bot follows an account) is not included.
+// By default, AppView requests are proxied through the PDS.
+func WithAppViewHost(host string) Option {
+	return func(o *clientOptions) {
+		o.appviewHost = host
+	}
+}
+
+// Use the given chat service host instead of ApiChat.
+func WithChatHost(host string) Option {
+	return func(o *clientOptions) {
+		o.chatHost = host
+	}
+}
+
+// Use the given HTTP client for all requests (XRPC, identity resolution, fetching images and link previews).
+//
+// By default, a client with a timeout of DefaultHTTPTimeout is used.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(o *clientOptions) {
+		o.httpClient = httpClient
+	}
+}
+
+// Use the given transport for the default HTTP client. Ignored if WithHTTPClient is set.
+func WithTransport(transport http.RoundTripper) Option {
+	return func(o *clientOptions) {
+		o.transport = transport
+	}
+}
+
+// Set the User-Agent header sent with XRPC requests.
+func WithUserAgent(userAgent string) Option {
+	return func(o *clientOptions) {
+		o.userAgent = userAgent
+	}
+}
+
+// Use the given logger for the client and its listeners. By default, slog.Default() is used.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *clientOptions) {
+		o.logger = logger
+	}
+}
+
+// Disable all logging of the client and its listeners.
+func WithoutLogging() Option {
+	return func(o *clientOptions) {
+		o.logger = slog.New(discardHandler{})
+	}
+}
+
+// slog handler dropping all records.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+// Set whether NewClient resolves the account's DID and PDS right away (default), or defers it to Authenticate.
+//
+// Deferring avoids network requests in NewClient, e.g. when constructing clients in tests.
+func WithEagerDIDResolution(eager bool) Option {
+	return func(o *clientOptions) {
+		o.resolveDid = eager
+	}
+}
+
+// Persist sessions in the given store, so they can be resumed with ResumeSession after a restart.
+func WithSessionStore(store SessionStore) Option {
+	return func(o *clientOptions) {
+		o.sessions = store
+	}
+}
+
+// Use the given resolver for DIDs and handles, e.g. to share its cache between several clients.
+//
+// By default, each client creates its own resolver using the client's HTTP client.
+func WithIdentityResolver(resolver *identity.Resolver) Option {
+	return func(o *clientOptions) {
+		o.identity = resolver
+	}
+}
+
+// Set a callback which is called when the session cannot be refreshed in the background and logging in again failed
+// as well (e.g. because the app password was revoked). Transient errors (PDS unavailable) are retried instead.
+func WithOnAuthError(onAuthError func(error)) Option {
+	return func(o *clientOptions) {
+		o.onAuthError = onAuthError
+	}
+}
+
+// Set a callback providing the sign-in code (auth factor token) for accounts with email two-factor authentication.
+//
+// It is called by Authenticate when the PDS requires a code, after the code was sent to the account's email.
+// Use GetCLIAuthFactorToken to prompt for it in the terminal. Combined with WithSessionStore, this is only
+// needed once: afterwards, the persisted session is resumed and refreshed without a full login.
+// Background refreshes never prompt: if they need a code, ErrAuthFactorTokenRequired is passed to OnAuthError.
+func WithAuthFactorTokenPrompt(prompt func(ctx context.Context) (string, error)) Option {
+	return func(o *clientOptions) {
+		o.authPrompt = prompt
+	}
+}
+
+// Get the credentials from the given provider on every login, instead of using the appkey passed to NewClient.
+//
+// If the handle passed to NewClient is empty, it is taken from the provider as well. Rotated app passwords are
+// picked up by calling Authenticate again.
+func WithCredentialProvider(provider CredentialProvider) Option {
+	return func(o *clientOptions) {
+		o.credentials = provider
+	}
+}
+
+// Set the proactive rate limit for a class of endpoints: at most limit requests (or write points) per window.
+//
+// Set limit = 0 to disable proactive throttling for the class. Responses with rate limit headers and 429 responses
+// are respected regardless. See DefaultRateLimits for the defaults.
+func WithRateLimit(class RateLimitClass, limit int, window time.Duration) Option {
+	return func(o *clientOptions) {
+		o.rateLimits[class] = RateLimit{Limit: limit, Window: window}
+	}
+}
+
+// Set how long a request waits for an exhausted rate limit to reset, before failing. Default: DefaultMaxRateLimitWait.
+func WithMaxRateLimitWait(maxWait time.Duration) Option {
+	return func(o *clientOptions) {
+		o.maxWait = maxWait
+	}
+}
+
+// Set the retry policy for transient failures of requests to the PDS and chat service. Default: DefaultRetryPolicy().
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(o *clientOptions) {
+		o.retry = policy
+	}
+}
+
+// Wrap the transport of all XRPC requests to the PDS and chat service, e.g. for tracing (see package instrumentation).
+//
+// The middleware sees every call once, including its retries and session refreshes. Can be given multiple times,
+// the first middleware is the outermost.
+func WithMiddleware(middleware func(http.RoundTripper) http.RoundTripper) Option {
+	return func(o *clientOptions) {
+		o.middleware = append(o.middleware, middleware)
+	}
+}
@@ -0,0 +1,137 @@
+package botsky
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// Transport counting the requests sent through it.
+type countingTransport struct {
+	requests atomic.Int64
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests.Add(1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestClientDefaults(t *testing.T) {
+	client, err := NewClient(context.Background(), "did:plc:bot", "appkey", WithEagerDIDResolution(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if client.httpClient.Timeout != DefaultHTTPTimeout {
+		t.Errorf("HTTP timeout = %v, want %v", client.httpClient.Timeout, DefaultHTTPTimeout)
+	}
+	if client.logger != slog.Default() {
+		t.Error("logger isn't slog.Default()")
+	}
+	// the PDS is discovered on login, AppView requests are proxied through it
+	if host := client.xrpcClient.GetHostAsync(); host != "" {
+		t.Errorf("PDS host = %q, want none before discovery", host)
+	}
+	if client.appviewClient != client.xrpcClient {
+		t.Error("AppView requests don't go through the PDS client")
+	}
+	if host := client.chatClient.GetHostAsync(); host != ApiChat {
+		t.Errorf("chat host = %q, want %q", host, ApiChat)
+	}
+	if client.Did != "did:plc:bot" {
+		t.Errorf("DID = %q, want the one passed as handle", client.Did)
+	}
+}
+
+func TestClientOptions(t *testing.T) {
+	var mutex sync.Mutex
+	userAgents := make(map[string]string) // by path
+	record := func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		userAgents[r.URL.Path] = r.Header.Get("User-Agent")
+		mutex.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+	}
+	appview := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		record(w, r)
+		json.NewEncoder(w).Encode(map[string]string{"did": "did:plc:alice", "handle": "alice.test"})
+	}))
+	defer appview.Close()
+	chatService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		record(w, r)
+		json.NewEncoder(w).Encode(map[string]any{"convos": []any{}})
+	}))
+	defer chatService.Close()
+	pds := newRealTimePDS(t)
+
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	transport := &countingTransport{}
+	client, err := NewClient(context.Background(), "did:plc:bot", "appkey",
+		WithEagerDIDResolution(false),
+		WithPDSHost(pds.URL),
+		WithAppViewHost(appview.URL),
+		WithChatHost(chatService.URL),
+		WithTransport(transport),
+		WithUserAgent("test-bot/1.0"),
+		WithLogger(logger),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	ctx := context.Background()
+	if err := client.Authenticate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetProfile(ctx, "did:plc:alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.ChatListConvos(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, path := range []string{"/xrpc/app.bsky.actor.getProfile", "/xrpc/chat.bsky.convo.listConvos"} {
+		if userAgent, ok := userAgents[path]; !ok || userAgent != "test-bot/1.0" {
+			t.Errorf("%s: sent = %v, User-Agent = %q", path, ok, userAgent)
+		}
+	}
+	if n := pds.creates.Load(); n != 1 {
+		t.Errorf("logged in %d times at the PDS host, want 1", n)
+	}
+	// login, profile and chat request
+	if n := transport.requests.Load(); n != 3 {
+		t.Errorf("%d requests went through the transport, want 3", n)
+	}
+	if !strings.Contains(logs.String(), "endpoint=app.bsky.actor.getProfile") {
+		t.Errorf("requests weren't logged with the given logger: %s", logs.String())
+	}
+}
+
+// A given HTTP client is used as is, WithTransport only applies to the default client.
+func TestWithHTTPClient(t *testing.T) {
+	clock := newFakeClock()
+	pds := newFakePDS(t, clock)
+	shared, ignored := &countingTransport{}, &countingTransport{}
+	httpClient := &http.Client{Transport: shared}
+	client := newTestClient(t, pds, clock, WithHTTPClient(httpClient), WithTransport(ignored))
+	if err := client.Authenticate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if client.httpClient != httpClient {
+		t.Error("the given HTTP client isn't used")
+	}
+	if shared.requests.Load() != 1 || ignored.requests.Load() != 0 {
+		t.Errorf("requests through the client's transport: %d, through WithTransport: %d, want 1 and 0", shared.requests.Load(), ignored.requests.Load())
+	}
+}
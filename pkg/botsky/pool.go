@@ -0,0 +1,211 @@
+package botsky
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davhofer/botsky/pkg/identity"
+)
+
+var ErrAccountNotFound = errors.New("account not in pool")
+
+// Default delay between logins in ClientPool.AuthenticateAll.
+const DefaultAuthStagger = 2 * time.Second
+
+// Manages the clients of several bot accounts operated from one process.
+//
+// All clients share one HTTP client (and thus connection pool) and one identity cache. Options passed to
+// NewClientPool apply to every account, e.g. WithSessionStore: each account's session is stored under its own key.
+// Listeners are bound to an account by creating them with the client returned by Add or Get.
+type ClientPool struct {
+	AuthStagger time.Duration // delay between logins in AuthenticateAll, to stay below the PDS rate limits
+
+	options    []Option
+	httpClient *http.Client
+	identity   *identity.Resolver
+	mutex      sync.RWMutex
+	clients    []*Client // in the order they were added
+	jobs       sync.WaitGroup
+	ctx        context.Context // lifetime of the pool, cancelled by Close
+	cancel     context.CancelFunc
+}
+
+// Sets up an empty pool. The options are applied to every client added to the pool.
+func NewClientPool(options ...Option) *ClientPool {
+	opts := defaultClientOptions()
+	for _, option := range options {
+		option(&opts)
+	}
+	httpClient := opts.httpClient
+	if httpClient == nil {
+		httpClient = &http.Client{
+			Transport: opts.transport,
+			Timeout:   DefaultHTTPTimeout,
+		}
+	}
+	resolver := opts.identity
+	if resolver == nil {
+		resolver = identity.NewResolver(httpClient)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ClientPool{
+		AuthStagger: DefaultAuthStagger,
+		options:     options,
+		httpClient:  httpClient,
+		identity:    resolver,
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+// Set up a client for the account and add it to the pool (not yet authenticated, see AuthenticateAll).
+//
+// The options are applied after the pool's options, so they can override them for this account.
+func (p *ClientPool) Add(ctx context.Context, handle string, appkey string, options ...Option) (*Client, error) {
+	allOptions := append([]Option{}, p.options...)
+	allOptions = append(allOptions, WithHTTPClient(p.httpClient), WithIdentityResolver(p.identity))
+	allOptions = append(allOptions, options...)
+	client, err := NewClient(ctx, handle, appkey, allOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("ClientPool.Add error: %w", err)
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if existing := p.lookup(client.Handle, client.Did); existing != nil {
+		client.Close()
+		return nil, fmt.Errorf("ClientPool.Add error: account %s is already in the pool", handle)
+	}
+	p.clients = append(p.clients, client)
+	return client, nil
+}
+
+// Find the client for the given handle or DID. Must be called with mutex held.
+func (p *ClientPool) lookup(handle string, did string) *Client {
+	handle = identity.NormalizeHandle(handle)
+	for _, client := range p.clients {
+		if (did != "" && client.Did == did) || identity.NormalizeHandle(client.Handle) == handle {
+			return client
+		}
+	}
+	return nil
+}
+
+// Get the client of the account with the given handle or DID.
+func (p *ClientPool) Get(handleOrDid string) (*Client, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	did := ""
+	if strings.HasPrefix(handleOrDid, "did:") {
+		did = handleOrDid
+	}
+	client := p.lookup(handleOrDid, did)
+	if client == nil {
+		return nil, fmt.Errorf("ClientPool.Get error: %w: %s", ErrAccountNotFound, handleOrDid)
+	}
+	return client, nil
+}
+
+// Get the clients of all accounts, in the order they were added.
+func (p *ClientPool) Clients() []*Client {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return append([]*Client{}, p.clients...)
+}
+
+// Remove the account from the pool and close its client.
+func (p *ClientPool) Remove(handleOrDid string) error {
+	client, err := p.Get(handleOrDid)
+	if err != nil {
+		return fmt.Errorf("ClientPool.Remove error: %w", err)
+	}
+	p.mutex.Lock()
+	for i, c := range p.clients {
+		if c == client {
+			p.clients = append(p.clients[:i], p.clients[i+1:]...)
+			break
+		}
+	}
+	p.mutex.Unlock()
+	return client.Close()
+}
+
+// Authenticate all accounts which are not authenticated yet, one after another with AuthStagger in between.
+//
+// Uses ResumeSession, so stored sessions are resumed instead of logging in again. Accounts that fail to
+// authenticate are skipped, their errors are joined in the returned error.
+func (p *ClientPool) AuthenticateAll(ctx context.Context) error {
+	var errs []error
+	first := true
+	for _, client := range p.Clients() {
+		if client.xrpcClient.GetAuthAsync().AccessJwt != "" {
+			continue
+		}
+		if !first && p.AuthStagger > 0 {
+			select {
+			case <-ctx.Done():
+				return errors.Join(append(errs, ctx.Err())...)
+			case <-time.After(p.AuthStagger):
+			}
+		}
+		first = false
+		if err := client.ResumeSession(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", client.Handle, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("ClientPool.AuthenticateAll error: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// Run a job for the given account every interval, until ctx is cancelled or the pool is closed.
+//
+// The job is first run after one interval. Errors are logged with the client's logger.
+func (p *ClientPool) Schedule(ctx context.Context, handleOrDid string, interval time.Duration, job func(context.Context, *Client) error) error {
+	client, err := p.Get(handleOrDid)
+	if err != nil {
+		return fmt.Errorf("ClientPool.Schedule error: %w", err)
+	}
+	p.jobs.Add(1)
+	go func() {
+		defer p.jobs.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-p.ctx.Done():
+				return
+			case <-ticker.C:
+				if err := job(ctx, client); err != nil {
+					client.logger.Error("Scheduled job failed", "account", client.Handle, "error", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop all scheduled jobs and close all clients.
+func (p *ClientPool) Close() error {
+	p.cancel()
+	p.jobs.Wait()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	var errs []error
+	for _, client := range p.clients {
+		if err := client.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	p.clients = nil
+	return errors.Join(errs...)
+}
@@ -0,0 +1,208 @@
+package botsky
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Pool of clients talking to the stand-in, without retries.
+func newTestPool(t *testing.T, pds *fakePDS, options ...Option) *ClientPool {
+	t.Helper()
+	options = append([]Option{
+		WithPDSHost(pds.URL),
+		WithEagerDIDResolution(false),
+		WithoutLogging(),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 1}),
+	}, options...)
+	pool := NewClientPool(options...)
+	t.Cleanup(func() { pool.Close() })
+	return pool
+}
+
+// Stand-in PDS issuing tokens relative to the real time, as the pool's clients use the system clock.
+func newRealTimePDS(t *testing.T) *fakePDS {
+	clock := newFakeClock()
+	clock.now = time.Now()
+	return newFakePDS(t, clock)
+}
+
+func TestClientPoolAdd(t *testing.T) {
+	pool := newTestPool(t, newRealTimePDS(t))
+	ctx := context.Background()
+	if _, err := pool.Add(ctx, "@alice.test", "appkey"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Add(ctx, "did:plc:bob", "appkey"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Add(ctx, "did:plc:carol", "appkey"); err != nil {
+		t.Fatalf("second account added by DID: %v", err)
+	}
+
+	for _, handleOrDid := range []string{"alice.test", "Alice.Test", "did:plc:bob"} {
+		if _, err := pool.Add(ctx, handleOrDid, "other"); err == nil {
+			t.Errorf("Add(%s) of an account in the pool succeeded, want an error", handleOrDid)
+		}
+	}
+	if n := len(pool.Clients()); n != 3 {
+		t.Errorf("pool has %d clients, want 3", n)
+	}
+}
+
+func TestClientPoolGet(t *testing.T) {
+	pool := newTestPool(t, newRealTimePDS(t))
+	ctx := context.Background()
+	alice, _ := pool.Add(ctx, "alice.test", "appkey")
+	bob, _ := pool.Add(ctx, "did:plc:bob", "appkey")
+
+	tests := []struct {
+		handleOrDid string
+		want        *Client
+	}{
+		{"alice.test", alice},
+		{"ALICE.test", alice},
+		{"did:plc:bob", bob},
+		{"bob.test", nil},
+		{"did:plc:alice", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.handleOrDid, func(t *testing.T) {
+			got, err := pool.Get(tt.handleOrDid)
+			if tt.want == nil {
+				if !errors.Is(err, ErrAccountNotFound) {
+					t.Errorf("Get error = %v, want ErrAccountNotFound", err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("Get = %p, %v, want %p", got, err, tt.want)
+			}
+		})
+	}
+
+	if err := pool.Remove("alice.test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Get("alice.test"); !errors.Is(err, ErrAccountNotFound) {
+		t.Errorf("Get after Remove error = %v, want ErrAccountNotFound", err)
+	}
+}
+
+func TestClientPoolAuthenticateAll(t *testing.T) {
+	pds := newRealTimePDS(t)
+	store := NewMemorySessionStore()
+	pool := newTestPool(t, pds, WithSessionStore(store))
+	pool.AuthStagger = 50 * time.Millisecond
+	ctx := context.Background()
+
+	// alice has a stored session, which is resumed without logging in
+	var stored Session
+	pds.set(func(p *fakePDS) {
+		p.access, p.refresh = p.token(10*time.Minute), p.token(time.Hour)
+		stored = Session{AccessJwt: p.access, RefreshJwt: p.refresh, Handle: "bot.test", Did: "did:plc:bot"}
+	})
+	if err := store.Save(ctx, "did:plc:alice", &stored); err != nil {
+		t.Fatal(err)
+	}
+	for _, did := range []string{"did:plc:alice", "did:plc:bob", "did:plc:carol"} {
+		if _, err := pool.Add(ctx, did, "appkey"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := time.Now()
+	if err := pool.AuthenticateAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 2*pool.AuthStagger {
+		t.Errorf("authenticated 3 accounts in %v, want at least %v between them", elapsed, pool.AuthStagger)
+	}
+	if n := pds.creates.Load(); n != 2 {
+		t.Errorf("%d logins, want 2", n)
+	}
+	for _, client := range pool.Clients() {
+		if client.xrpcClient.GetAuthAsync().AccessJwt == "" {
+			t.Errorf("%s is not authenticated", client.sessionKey)
+		}
+		if _, err := store.Load(ctx, client.sessionKey); err != nil {
+			t.Errorf("session of %s: %v", client.sessionKey, err)
+		}
+	}
+
+	// authenticated accounts are skipped
+	start = time.Now()
+	if err := pool.AuthenticateAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed >= pool.AuthStagger || pds.creates.Load() != 2 {
+		t.Errorf("second AuthenticateAll took %v and logged in %d times, want no logins", elapsed, pds.creates.Load()-2)
+	}
+}
+
+func TestClientPoolAuthenticateAllErrors(t *testing.T) {
+	pds := newRealTimePDS(t)
+	pool := newTestPool(t, pds)
+	pool.AuthStagger = 0
+	ctx := context.Background()
+	pool.Add(ctx, "did:plc:alice", "appkey")
+	pds.set(func(p *fakePDS) { p.createStatus = http.StatusUnauthorized })
+
+	err := pool.AuthenticateAll(ctx)
+	if !errors.Is(err, ErrAuthRequired) {
+		t.Errorf("AuthenticateAll error = %v, want ErrAuthRequired", err)
+	}
+}
+
+func TestClientPoolSchedule(t *testing.T) {
+	pool := newTestPool(t, newRealTimePDS(t))
+	ctx := context.Background()
+	alice, _ := pool.Add(ctx, "alice.test", "appkey")
+	if err := pool.Schedule(ctx, "bob.test", time.Millisecond, nil); !errors.Is(err, ErrAccountNotFound) {
+		t.Errorf("Schedule for an unknown account error = %v, want ErrAccountNotFound", err)
+	}
+
+	var runs, cancelledRuns atomic.Int64
+	err := pool.Schedule(ctx, "alice.test", 5*time.Millisecond, func(ctx context.Context, client *Client) error {
+		if client != alice {
+			t.Errorf("job got client %p, want %p", client, alice)
+		}
+		runs.Add(1)
+		return errors.New("failures don't stop the job")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobCtx, cancel := context.WithCancel(ctx)
+	pool.Schedule(jobCtx, "alice.test", 5*time.Millisecond, func(ctx context.Context, client *Client) error {
+		cancelledRuns.Add(1)
+		return nil
+	})
+	waitFor(t, "scheduled jobs", func() bool { return runs.Load() >= 2 && cancelledRuns.Load() >= 1 })
+
+	// cancelling the context stops only that job
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	n := cancelledRuns.Load()
+	before := runs.Load()
+	waitFor(t, "remaining job", func() bool { return runs.Load() > before })
+	if cancelledRuns.Load() != n {
+		t.Error("job ran after its context was cancelled")
+	}
+
+	// Close waits for the jobs to stop
+	if err := pool.Close(); err != nil {
+		t.Fatal(err)
+	}
+	n = runs.Load()
+	time.Sleep(20 * time.Millisecond)
+	if runs.Load() != n {
+		t.Error("job ran after the pool was closed")
+	}
+	if len(pool.Clients()) != 0 {
+		t.Error("clients left in the closed pool")
+	}
+}
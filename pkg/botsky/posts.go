@@ -79,7 +79,7 @@ func (c *Client) Repost(ctx context.Context, postUri string) (string, string, er
 
 	_, cid, err := c.RepoGetPostAndCid(ctx, postUri)
 	if err != nil {
-		return "", "", fmt.Errorf("Error getting post to repost: %v", err)
+		return "", "", fmt.Errorf("Error getting post to repost: %w", err)
 	}
 	ref := atproto.RepoStrongRef{
 		Uri: postUri,
@@ -99,7 +99,7 @@ func (c *Client) Repost(ctx context.Context, postUri string) (string, string, er
 	}
 	response, err := atproto.RepoCreateRecord(ctx, c.xrpcClient, post_input)
 	if err != nil {
-		return "", "", fmt.Errorf("unable to repost: %v", err)
+		return "", "", fmt.Errorf("unable to repost: %w", xrpcError(err))
 	}
 
 	return response.Cid, response.Uri, nil
@@ -204,7 +204,7 @@ func (c *Client) Post(ctx context.Context, pb *PostBuilder) (string, string, err
 		if len(parsedImages) > 0 {
 			blobs, err := c.RepoUploadImages(ctx, parsedImages)
 			if err != nil {
-				return "", "", fmt.Errorf("Error when uploading images: %v", err)
+				return "", "", fmt.Errorf("Error when uploading images: %w", err)
 			}
 			embed.Images = parsedImages
 			embed.UploadedImages = blobs
@@ -214,12 +214,12 @@ func (c *Client) Post(ctx context.Context, pb *PostBuilder) (string, string, err
 	if pb.EmbedLink != "" {
 		parsedLink, err := url.Parse(pb.EmbedLink)
 		if err != nil {
-			return "", "", fmt.Errorf("Error when parsing link: %v", err)
+			return "", "", fmt.Errorf("Error when parsing link: %w", err)
 		}
 
-		siteTags, err := fetchOpenGraphTwitterTags(pb.EmbedLink)
+		siteTags, err := fetchOpenGraphTwitterTags(c.httpClient, pb.EmbedLink)
 		if err != nil {
-			return "", "", fmt.Errorf("Error when fetching og/twitter tags from link: %v", err)
+			return "", "", fmt.Errorf("Error when fetching og/twitter tags from link: %w", err)
 		}
 
 		title := siteTags["title"]
@@ -231,7 +231,7 @@ func (c *Client) Post(ctx context.Context, pb *PostBuilder) (string, string, err
 		if hasImage {
 			parsedImageUrl, err := url.Parse(imageUrl)
 			if err != nil {
-				return "", "", fmt.Errorf("Error when parsing image url: %v", err)
+				return "", "", fmt.Errorf("Error when parsing image url: %w", err)
 			}
 			previewImg := imageSourceParsed{
 				Uri: *parsedImageUrl,
@@ -239,7 +239,7 @@ func (c *Client) Post(ctx context.Context, pb *PostBuilder) (string, string, err
 			}
 			b, err := c.RepoUploadImage(ctx, previewImg)
 			if err != nil {
-				return "", "", fmt.Errorf("Error when trying to upload image: %v", err)
+				return "", "", fmt.Errorf("Error when trying to upload image: %w", err)
 			}
 			if b != nil {
 				blob = *b
@@ -255,7 +255,7 @@ func (c *Client) Post(ctx context.Context, pb *PostBuilder) (string, string, err
 	if pb.EmbedPostQuote != "" {
 		_, cid, err := c.RepoGetPostAndCid(ctx, pb.EmbedPostQuote)
 		if err != nil {
-			return "", "", fmt.Errorf("Error when getting quoted post: %v", err)
+			return "", "", fmt.Errorf("Error when getting quoted post: %w", err)
 		}
 		embed.Record.Cid = cid
 		embed.Record.Uri = pb.EmbedPostQuote
@@ -265,7 +265,7 @@ func (c *Client) Post(ctx context.Context, pb *PostBuilder) (string, string, err
 	if pb.ReplyUri != "" {
 		replyPost, cid, err := c.RepoGetPostAndCid(ctx, pb.ReplyUri)
 		if err != nil {
-			return "", "", fmt.Errorf("Error when getting reply post: %v", err)
+			return "", "", fmt.Errorf("Error when getting reply post: %w", err)
 		}
 
 		var rootCid, rootUri string
@@ -302,7 +302,7 @@ func (c *Client) Post(ctx context.Context, pb *PostBuilder) (string, string, err
 		value := pb.Text[start:end]
 		// cut off the @
 		handle := value[1:]
-		resolveOutput, err := atproto.IdentityResolveHandle(ctx, c.xrpcClient, handle)
+		did, err := c.ResolveHandle(ctx, handle)
 		if err != nil {
 			// cannot resolve handle => not a mention
 			continue
@@ -316,14 +316,14 @@ func (c *Client) Post(ctx context.Context, pb *PostBuilder) (string, string, err
 			Value: handle,
 			Start: start,
 			End:   end,
-			Did:   resolveOutput.Did,
+			Did:   did,
 		})
 	}
 
 	// Build post
 	post, err := buildPost(pb, embed, replyRef, mentionMatches)
 	if err != nil {
-		return "", "", fmt.Errorf("Error when building post: %v", err)
+		return "", "", fmt.Errorf("Error when building post: %w", err)
 	}
 
 	return c.RepoCreatePostRecord(ctx, post)
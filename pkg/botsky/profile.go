@@ -0,0 +1,239 @@
+package botsky
+
+import (
+	"context"
+	"fmt"
+	"iter"
+
+	"github.com/davhofer/indigo/api/bsky"
+)
+
+// Profile information about an account, as seen by the bot (AppView profile view).
+type Profile struct {
+	Did            string
+	Handle         string
+	DisplayName    string
+	Description    string
+	Avatar         string // url of the avatar image
+	Banner         string // url of the banner image
+	FollowersCount int64
+	FollowsCount   int64
+	PostsCount     int64
+	Labels         []string // label values applied to the account
+	PinnedPost     string   // uri of the pinned post
+	CreatedAt      string
+	IndexedAt      string
+	Viewer         ProfileViewerState
+	Associated     ProfileAssociated
+}
+
+// Relationship between the bot and a profile.
+type ProfileViewerState struct {
+	Following  string // uri of the bot's follow record, if the bot follows the account
+	FollowedBy string // uri of the account's follow record, if the account follows the bot
+	Blocking   string // uri of the bot's block record, if the bot blocks the account
+	BlockedBy  bool
+	Muted      bool
+}
+
+// Additional info associated with a profile (lists, feeds, chat settings, etc.).
+type ProfileAssociated struct {
+	Lists             int64
+	Feedgens          int64
+	StarterPacks      int64
+	Labeler           bool
+	ChatAllowIncoming string // who can initiate DMs: "all", "none" or "following"
+}
+
+// Maximum number of actors per app.bsky.actor.getProfiles request.
+const getProfilesBatchSize = 25
+
+// Get the profile of the given account.
+func (c *Client) GetProfile(ctx context.Context, handleOrDid string) (*Profile, error) {
+	profileView, err := bsky.ActorGetProfile(ctx, c.appviewClient, handleOrDid)
+	if err != nil {
+		return nil, fmt.Errorf("GetProfile error (ActorGetProfile): %w", xrpcError(err))
+	}
+	return profileFromDetailedView(profileView), nil
+}
+
+// Get the profiles of the given accounts.
+//
+// Requests are batched (25 accounts per request). Accounts which cannot be found are omitted from the result.
+func (c *Client) GetProfiles(ctx context.Context, handlesOrDids []string) ([]*Profile, error) {
+	profiles := make([]*Profile, 0, len(handlesOrDids))
+	for i := 0; i < len(handlesOrDids); i += getProfilesBatchSize {
+		j := min(i+getProfilesBatchSize, len(handlesOrDids))
+		output, err := bsky.ActorGetProfiles(ctx, c.appviewClient, handlesOrDids[i:j])
+		if err != nil {
+			return nil, fmt.Errorf("GetProfiles error (ActorGetProfiles): %w", xrpcError(err))
+		}
+		for _, profileView := range output.Profiles {
+			profiles = append(profiles, profileFromDetailedView(profileView))
+		}
+	}
+	return profiles, nil
+}
+
+// Iterate over all accounts matching the search query.
+//
+// Results are fetched page by page while iterating. Iteration stops after the first error.
+func (c *Client) SearchActorsIter(ctx context.Context, query string) iter.Seq2[*Profile, error] {
+	return func(yield func(*Profile, error) bool) {
+		cursor := ""
+		for {
+			output, err := bsky.ActorSearchActors(ctx, c.appviewClient, cursor, 100, query, "")
+			if err != nil {
+				yield(nil, fmt.Errorf("SearchActors error (ActorSearchActors): %w", xrpcError(err)))
+				return
+			}
+			for _, profileView := range output.Actors {
+				if !yield(profileFromView(profileView), nil) {
+					return
+				}
+			}
+			if len(output.Actors) == 0 || output.Cursor == nil || *output.Cursor == "" || *output.Cursor == cursor {
+				return
+			}
+			cursor = *output.Cursor
+		}
+	}
+}
+
+// Search for accounts matching the query.
+//
+// Set limit = -1 in order to get all results.
+func (c *Client) SearchActors(ctx context.Context, query string, limit int) ([]*Profile, error) {
+	var profiles []*Profile
+	if limit == 0 {
+		return profiles, nil
+	}
+	for profile, err := range c.SearchActorsIter(ctx, query) {
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, profile)
+		if limit != -1 && len(profiles) >= limit {
+			break
+		}
+	}
+	return profiles, nil
+}
+
+// Iterate over accounts matching the search prefix, as used for autocompletion (e.g. of mentions).
+func (c *Client) SearchActorsTypeaheadIter(ctx context.Context, query string, limit int64) iter.Seq2[*Profile, error] {
+	return func(yield func(*Profile, error) bool) {
+		output, err := bsky.ActorSearchActorsTypeahead(ctx, c.appviewClient, max(1, min(100, limit)), query, "")
+		if err != nil {
+			yield(nil, fmt.Errorf("SearchActorsTypeahead error (ActorSearchActorsTypeahead): %w", xrpcError(err)))
+			return
+		}
+		for _, profileView := range output.Actors {
+			if !yield(profileFromBasicView(profileView), nil) {
+				return
+			}
+		}
+	}
+}
+
+// Get accounts matching the search prefix, as used for autocompletion (e.g. of mentions).
+//
+// At most 100 results are returned.
+func (c *Client) SearchActorsTypeahead(ctx context.Context, query string, limit int64) ([]*Profile, error) {
+	var profiles []*Profile
+	for profile, err := range c.SearchActorsTypeaheadIter(ctx, query, limit) {
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles, nil
+}
+
+func profileFromDetailedView(view *bsky.ActorDefs_ProfileViewDetailed) *Profile {
+	profile := &Profile{
+		Did:            view.Did,
+		Handle:         view.Handle,
+		DisplayName:    valueOrZero(view.DisplayName),
+		Description:    valueOrZero(view.Description),
+		Avatar:         valueOrZero(view.Avatar),
+		Banner:         valueOrZero(view.Banner),
+		FollowersCount: valueOrZero(view.FollowersCount),
+		FollowsCount:   valueOrZero(view.FollowsCount),
+		PostsCount:     valueOrZero(view.PostsCount),
+		CreatedAt:      valueOrZero(view.CreatedAt),
+		IndexedAt:      valueOrZero(view.IndexedAt),
+		Viewer:         viewerStateFromView(view.Viewer),
+		Associated:     associatedFromView(view.Associated),
+	}
+	if view.PinnedPost != nil {
+		profile.PinnedPost = view.PinnedPost.Uri
+	}
+	for _, label := range view.Labels {
+		profile.Labels = append(profile.Labels, label.Val)
+	}
+	return profile
+}
+
+func profileFromView(view *bsky.ActorDefs_ProfileView) *Profile {
+	profile := &Profile{
+		Did:         view.Did,
+		Handle:      view.Handle,
+		DisplayName: valueOrZero(view.DisplayName),
+		Description: valueOrZero(view.Description),
+		Avatar:      valueOrZero(view.Avatar),
+		CreatedAt:   valueOrZero(view.CreatedAt),
+		IndexedAt:   valueOrZero(view.IndexedAt),
+		Viewer:      viewerStateFromView(view.Viewer),
+		Associated:  associatedFromView(view.Associated),
+	}
+	for _, label := range view.Labels {
+		profile.Labels = append(profile.Labels, label.Val)
+	}
+	return profile
+}
+
+func profileFromBasicView(view *bsky.ActorDefs_ProfileViewBasic) *Profile {
+	profile := &Profile{
+		Did:         view.Did,
+		Handle:      view.Handle,
+		DisplayName: valueOrZero(view.DisplayName),
+		Avatar:      valueOrZero(view.Avatar),
+		CreatedAt:   valueOrZero(view.CreatedAt),
+		Viewer:      viewerStateFromView(view.Viewer),
+		Associated:  associatedFromView(view.Associated),
+	}
+	for _, label := range view.Labels {
+		profile.Labels = append(profile.Labels, label.Val)
+	}
+	return profile
+}
+
+func viewerStateFromView(viewer *bsky.ActorDefs_ViewerState) ProfileViewerState {
+	if viewer == nil {
+		return ProfileViewerState{}
+	}
+	return ProfileViewerState{
+		Following:  valueOrZero(viewer.Following),
+		FollowedBy: valueOrZero(viewer.FollowedBy),
+		Blocking:   valueOrZero(viewer.Blocking),
+		BlockedBy:  valueOrZero(viewer.BlockedBy),
+		Muted:      valueOrZero(viewer.Muted),
+	}
+}
+
+func associatedFromView(associated *bsky.ActorDefs_ProfileAssociated) ProfileAssociated {
+	if associated == nil {
+		return ProfileAssociated{}
+	}
+	result := ProfileAssociated{
+		Lists:        valueOrZero(associated.Lists),
+		Feedgens:     valueOrZero(associated.Feedgens),
+		StarterPacks: valueOrZero(associated.StarterPacks),
+		Labeler:      valueOrZero(associated.Labeler),
+	}
+	if associated.Chat != nil {
+		result.ChatAllowIncoming = associated.Chat.AllowIncoming
+	}
+	return result
+}
@@ -0,0 +1,159 @@
+package botsky
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/davhofer/indigo/api/bsky"
+)
+
+// Profile record of the bot, with fields which must survive an update of the description.
+const storedProfile = `{
+	"$type": "app.bsky.actor.profile",
+	"displayName": "Bot",
+	"description": "old description",
+	"avatar": {"$type": "blob", "ref": {"$link": "bafkreie5737gdxlw5i64vzichcalba3z2v5n6icifvx5xytvske7mr3hpm"}, "mimeType": "image/png", "size": 1234},
+	"pinnedPost": {"uri": "at://did:plc:bot/app.bsky.feed.post/pinned", "cid": "bafyreie5737gdxlw5i64vzichcalba3z2v5n6icifvx5xytvske7mr3hpm"},
+	"createdAt": "2024-01-01T00:00:00Z"
+}`
+
+func TestUpdateProfileDescription(t *testing.T) {
+	pds := newFakePDS(t, newFakeClock())
+	var put struct {
+		Repo       string          `json:"repo"`
+		Collection string          `json:"collection"`
+		Rkey       string          `json:"rkey"`
+		SwapRecord *string         `json:"swapRecord"`
+		Record     json.RawMessage `json:"record"`
+	}
+	pds.handler = func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/xrpc/com.atproto.repo.getRecord":
+			if q := r.URL.Query(); q.Get("collection") != "app.bsky.actor.profile" || q.Get("rkey") != "self" {
+				xrpcErrorResponse(w, http.StatusBadRequest, "RecordNotFound")
+				return
+			}
+			fmt.Fprintf(w, `{"uri": "at://did:plc:bot/app.bsky.actor.profile/self", "cid": "bafyreiprofile", "value": %s}`, storedProfile)
+		case "/xrpc/com.atproto.repo.putRecord":
+			json.NewDecoder(r.Body).Decode(&put)
+			json.NewEncoder(w).Encode(map[string]string{"uri": "at://did:plc:bot/app.bsky.actor.profile/self", "cid": "bafyreinew"})
+		default:
+			http.NotFound(w, r)
+		}
+	}
+	client := newTestClient(t, pds, nil)
+
+	if err := client.UpdateProfileDescription(context.Background(), "new description"); err != nil {
+		t.Fatal(err)
+	}
+	if put.Collection != "app.bsky.actor.profile" || put.Rkey != "self" || put.Repo != client.Handle {
+		t.Errorf("put %s/%s to %s, want the profile record of the bot", put.Collection, put.Rkey, put.Repo)
+	}
+	// concurrent updates of the profile aren't overwritten
+	if put.SwapRecord == nil || *put.SwapRecord != "bafyreiprofile" {
+		t.Errorf("swapRecord = %v, want the cid of the read record", put.SwapRecord)
+	}
+
+	var got, want map[string]any
+	if err := json.Unmarshal(put.Record, &got); err != nil {
+		t.Fatal(err)
+	}
+	json.Unmarshal([]byte(storedProfile), &want)
+	want["description"] = "new description"
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("written record = %v, want %v", got, want)
+	}
+}
+
+func TestGetProfiles(t *testing.T) {
+	pds := newFakePDS(t, newFakeClock())
+	var mutex sync.Mutex
+	var batches []int
+	pds.handler = func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/xrpc/app.bsky.actor.getProfiles" {
+			http.NotFound(w, r)
+			return
+		}
+		actors := r.URL.Query()["actors"]
+		mutex.Lock()
+		batches = append(batches, len(actors))
+		mutex.Unlock()
+		var output bsky.ActorGetProfiles_Output
+		for _, actor := range actors {
+			// unknown accounts are left out by the AppView
+			if strings.HasPrefix(actor, "did:plc:unknown") {
+				continue
+			}
+			following := "at://did:plc:bot/app.bsky.graph.follow/" + actor
+			output.Profiles = append(output.Profiles, &bsky.ActorDefs_ProfileViewDetailed{
+				Did:    actor,
+				Handle: strings.TrimPrefix(actor, "did:plc:") + ".test",
+				Viewer: &bsky.ActorDefs_ViewerState{Following: &following},
+			})
+		}
+		json.NewEncoder(w).Encode(output)
+	}
+	client := newTestClient(t, pds, nil, WithAppViewHost(pds.URL))
+
+	var actors []string
+	for i := range 30 {
+		actors = append(actors, fmt.Sprintf("did:plc:user%d", i))
+	}
+	actors = append(actors, "did:plc:unknown")
+	profiles, err := client.GetProfiles(context.Background(), actors)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(batches, []int{25, 6}) {
+		t.Errorf("requested batches of %v actors, want [25 6]", batches)
+	}
+	if len(profiles) != 30 {
+		t.Fatalf("got %d profiles, want 30", len(profiles))
+	}
+	if p := profiles[3]; p.Did != "did:plc:user3" || p.Handle != "user3.test" || p.Viewer.Following != "at://did:plc:bot/app.bsky.graph.follow/did:plc:user3" {
+		t.Errorf("profile = %+v", p)
+	}
+}
+
+func TestSearchActors(t *testing.T) {
+	pds := newFakePDS(t, newFakeClock())
+	pages := map[string]string{"": "page2", "page2": "page3", "page3": ""}
+	pds.handler = func(w http.ResponseWriter, r *http.Request) {
+		cursor := r.URL.Query().Get("cursor")
+		next, ok := pages[cursor]
+		if r.URL.Path != "/xrpc/app.bsky.actor.searchActors" || !ok {
+			http.NotFound(w, r)
+			return
+		}
+		output := bsky.ActorSearchActors_Output{Actors: []*bsky.ActorDefs_ProfileView{
+			{Did: "did:plc:" + cursor + "a", Handle: "a.test"},
+			{Did: "did:plc:" + cursor + "b", Handle: "b.test"},
+		}}
+		if next != "" {
+			output.Cursor = &next
+		}
+		json.NewEncoder(w).Encode(output)
+	}
+	client := newTestClient(t, pds, nil, WithAppViewHost(pds.URL))
+
+	tests := []struct {
+		limit int
+		want  int
+	}{
+		{limit: 0, want: 0},
+		{limit: 3, want: 3},
+		{limit: -1, want: 6},
+	}
+	for _, tt := range tests {
+		profiles, err := client.SearchActors(context.Background(), "bot", tt.limit)
+		if err != nil || len(profiles) != tt.want {
+			t.Errorf("SearchActors(limit %d) = %d profiles, %v, want %d", tt.limit, len(profiles), err, tt.want)
+		}
+	}
+}
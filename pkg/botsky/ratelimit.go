@@ -0,0 +1,288 @@
+package botsky
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Class of XRPC endpoints sharing a rate limit.
+type RateLimitClass string
+
+const (
+	RateLimitWrites        RateLimitClass = "writes"        // record writes, limited in points (create: 3, update: 2, delete: 1)
+	RateLimitCreateSession RateLimitClass = "createSession" // logins
+	RateLimitReads         RateLimitClass = "reads"         // all other PDS requests
+	RateLimitChat          RateLimitClass = "chat"          // chat requests
+)
+
+// Proactive rate limit: at most Limit requests (or points, for writes) per Window.
+type RateLimit struct {
+	Limit  int
+	Window time.Duration
+}
+
+// Default rate limits, based on the limits of Bluesky's PDSes.
+var DefaultRateLimits = map[RateLimitClass]RateLimit{
+	RateLimitWrites:        {Limit: 5000, Window: time.Hour},
+	RateLimitCreateSession: {Limit: 30, Window: 5 * time.Minute},
+	RateLimitReads:         {Limit: 3000, Window: 5 * time.Minute},
+	RateLimitChat:          {Limit: 3000, Window: 5 * time.Minute},
+}
+
+// Default for how long a request waits for a rate limit to reset before failing, see WithMaxRateLimitWait.
+const DefaultMaxRateLimitWait = 5 * time.Minute
+
+// Write points per record operation.
+var writePoints = map[string]float64{
+	"com.atproto.repo.createRecord": 3,
+	"com.atproto.repo.putRecord":    2,
+	"com.atproto.repo.deleteRecord": 1,
+	"com.atproto.repo.applyWrites":  3,
+}
+
+// Current rate limit budget of an endpoint class.
+type RateLimitStatus struct {
+	Tokens    float64   // requests (or write points) the client will send right away, based on its own token bucket
+	Limit     int       // limit reported by the server, 0 if no response carried rate limit headers yet
+	Remaining int       // remaining requests (or points) reported by the server
+	Reset     time.Time // when the server's limit window resets
+	Policy    string    // policy reported by the server, e.g. "5000;w=3600"
+}
+
+// Token bucket of an endpoint class, adjusted by the rate limit headers of the server's responses.
+type rateBucket struct {
+	capacity     float64
+	refillPerSec float64
+	tokens       float64
+	lastRefill   time.Time
+	blockedUntil time.Time // the server's limit is exhausted until then
+	status       RateLimitStatus
+}
+
+func (b *rateBucket) refill(now time.Time) {
+	if b.capacity <= 0 {
+		return
+	}
+	b.tokens = min(b.capacity, b.tokens+now.Sub(b.lastRefill).Seconds()*b.refillPerSec)
+	b.lastRefill = now
+}
+
+type rateLimiter struct {
+	mutex   sync.Mutex
+	buckets map[RateLimitClass]*rateBucket
+	maxWait time.Duration
+}
+
+func newRateLimiter(limits map[RateLimitClass]RateLimit, maxWait time.Duration) *rateLimiter {
+	now := time.Now()
+	limiter := &rateLimiter{
+		buckets: make(map[RateLimitClass]*rateBucket),
+		maxWait: maxWait,
+	}
+	for class, limit := range limits {
+		bucket := &rateBucket{lastRefill: now}
+		if limit.Limit > 0 && limit.Window > 0 {
+			bucket.capacity = float64(limit.Limit)
+			bucket.refillPerSec = float64(limit.Limit) / limit.Window.Seconds()
+			bucket.tokens = bucket.capacity
+		}
+		limiter.buckets[class] = bucket
+	}
+	return limiter
+}
+
+// Classify a request and determine its cost.
+func classifyRequest(req *http.Request) (RateLimitClass, float64) {
+	method := strings.TrimPrefix(req.URL.Path, "/xrpc/")
+	switch {
+	case method == "com.atproto.server.createSession":
+		return RateLimitCreateSession, 1
+	case writePoints[method] > 0:
+		return RateLimitWrites, writePoints[method]
+	case strings.HasPrefix(method, "chat.bsky."):
+		return RateLimitChat, 1
+	default:
+		return RateLimitReads, 1
+	}
+}
+
+func (l *rateLimiter) bucket(class RateLimitClass) *rateBucket {
+	bucket, ok := l.buckets[class]
+	if !ok {
+		bucket = &rateBucket{lastRefill: time.Now()}
+		l.buckets[class] = bucket
+	}
+	return bucket
+}
+
+// Wait until the request can be sent without exceeding the class's limit, and take its cost from the bucket.
+//
+// Returns an error if ctx is done, or the wait would be longer than maxWait.
+func (l *rateLimiter) wait(ctx context.Context, class RateLimitClass, cost float64) error {
+	for {
+		l.mutex.Lock()
+		bucket := l.bucket(class)
+		now := time.Now()
+		bucket.refill(now)
+
+		var wait time.Duration
+		switch {
+		case now.Before(bucket.blockedUntil):
+			wait = bucket.blockedUntil.Sub(now)
+		case bucket.capacity <= 0 || bucket.tokens >= cost:
+			bucket.tokens -= cost
+			l.mutex.Unlock()
+			return nil
+		default:
+			wait = time.Duration((cost - bucket.tokens) / bucket.refillPerSec * float64(time.Second))
+		}
+		l.mutex.Unlock()
+
+		if wait > l.maxWait {
+			return &rateLimitWaitError{class: class, wait: wait}
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Update the class's bucket with the rate limit headers of a response.
+func (l *rateLimiter) update(class RateLimitClass, resp *http.Response) {
+	limit, errLimit := strconv.Atoi(resp.Header.Get("RateLimit-Limit"))
+	remaining, errRemaining := strconv.Atoi(resp.Header.Get("RateLimit-Remaining"))
+	reset, errReset := strconv.ParseInt(resp.Header.Get("RateLimit-Reset"), 10, 64)
+	if errLimit != nil || errRemaining != nil {
+		if resp.StatusCode == http.StatusTooManyRequests {
+			// no rate limit headers, fall back to Retry-After or a default delay
+			l.block(class, retryAfter(resp))
+		}
+		return
+	}
+	resetTime := time.Now().Add(time.Minute)
+	if errReset == nil {
+		resetTime = time.Unix(reset, 0)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	bucket := l.bucket(class)
+	bucket.status = RateLimitStatus{
+		Limit:     limit,
+		Remaining: remaining,
+		Reset:     resetTime,
+		Policy:    resp.Header.Get("RateLimit-Policy"),
+	}
+	// the server knows best, don't send more than it will accept
+	bucket.tokens = min(bucket.tokens, float64(remaining))
+	if remaining <= 0 || resp.StatusCode == http.StatusTooManyRequests {
+		bucket.blockedUntil = resetTime
+	}
+}
+
+func (l *rateLimiter) block(class RateLimitClass, until time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	bucket := l.bucket(class)
+	if until.After(bucket.blockedUntil) {
+		bucket.blockedUntil = until
+	}
+}
+
+// Parse the Retry-After header of a response (seconds or HTTP date). Defaults to one minute.
+func retryAfter(resp *http.Response) time.Time {
+	value := resp.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Now().Add(time.Duration(seconds) * time.Second)
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return date
+	}
+	return time.Now().Add(time.Minute)
+}
+
+// How long requests of the class are blocked because the server's limit is exhausted.
+func (l *rateLimiter) blockedFor(class RateLimitClass) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return time.Until(l.bucket(class).blockedUntil)
+}
+
+func (l *rateLimiter) status() map[RateLimitClass]RateLimitStatus {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	result := make(map[RateLimitClass]RateLimitStatus, len(l.buckets))
+	for class, bucket := range l.buckets {
+		bucket.refill(now)
+		status := bucket.status
+		status.Tokens = bucket.tokens
+		result[class] = status
+	}
+	return result
+}
+
+type rateLimitWaitError struct {
+	class RateLimitClass
+	wait  time.Duration
+}
+
+func (e *rateLimitWaitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+func (e *rateLimitWaitError) Error() string {
+	return "rate limit for " + string(e.class) + " exhausted, resets in " + e.wait.Round(time.Second).String()
+}
+
+// Transport throttling requests to stay within the rate limits, and waiting for the limit to reset on 429 responses.
+type rateLimitTransport struct {
+	base    http.RoundTripper
+	limiter *rateLimiter
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	class, cost := classifyRequest(req)
+	for attempt := 0; ; attempt++ {
+		if err := t.limiter.wait(req.Context(), class, cost); err != nil {
+			return nil, err
+		}
+		sendReq := req
+		if attempt > 0 {
+			sendReq = req.Clone(req.Context())
+			if req.Body != nil && req.Body != http.NoBody {
+				var err error
+				if sendReq.Body, err = req.GetBody(); err != nil {
+					return nil, err
+				}
+			}
+		}
+		resp, err := t.base.RoundTrip(sendReq)
+		if err != nil {
+			return resp, err
+		}
+		t.limiter.update(class, resp)
+
+		// retry once after the limit reset, if the request can be replayed and the reset is not too far away
+		replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+		if resp.StatusCode != http.StatusTooManyRequests || attempt > 0 || !replayable || t.limiter.blockedFor(class) > t.limiter.maxWait {
+			return resp, nil
+		}
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+	}
+}
+
+// Get the current rate limit budget per endpoint class.
+func (c *Client) RateLimitStatus() map[RateLimitClass]RateLimitStatus {
+	return c.rateLimiter.status()
+}
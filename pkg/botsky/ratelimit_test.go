@@ -0,0 +1,61 @@
+package botsky
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+// Requests which got a 429 with a short Retry-After are sent again once, with their body restored.
+func TestRateLimitRetryAfter(t *testing.T) {
+	tests := []struct {
+		name string
+		call func(ctx context.Context, client *Client) error
+	}{
+		{
+			name: "query without body",
+			call: func(ctx context.Context, client *Client) error {
+				_, err := client.GetProfile(ctx, "did:plc:bot")
+				return err
+			},
+		},
+		{
+			name: "procedure with body",
+			call: func(ctx context.Context, client *Client) error {
+				return client.RepoDeletePost(ctx, "at://did:plc:bot/app.bsky.feed.post/3k")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pds := newFakePDS(t, newFakeClock())
+			var calls atomic.Int64
+			pds.handler = func(w http.ResponseWriter, r *http.Request) {
+				if calls.Add(1) == 1 {
+					w.Header().Set("Retry-After", "1")
+					xrpcErrorResponse(w, http.StatusTooManyRequests, "RateLimitExceeded")
+					return
+				}
+				if r.Method == http.MethodPost {
+					body, _ := io.ReadAll(r.Body)
+					if len(body) == 0 {
+						xrpcErrorResponse(w, http.StatusBadRequest, "EmptyBody")
+						return
+					}
+				}
+				json.NewEncoder(w).Encode(map[string]any{"did": "did:plc:bot", "handle": "bot.test"})
+			}
+			client := newTestClient(t, pds, nil)
+
+			if err := tt.call(context.Background(), client); err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			if n := calls.Load(); n != 2 {
+				t.Errorf("sent %d requests, want 2", n)
+			}
+		})
+	}
+}
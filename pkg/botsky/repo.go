@@ -4,7 +4,7 @@ import (
 	"bytes"
 	"context"
 	"fmt"
-	"log"
+	"time"
 
 	"github.com/davhofer/indigo/api/atproto"
 	"github.com/davhofer/indigo/api/bsky"
@@ -15,22 +15,30 @@ import (
 // TODO: download image function from embed/repo, using SyncGetBlob
 // useful to extract images e.g. from posts
 
-// TODO: info about user/profile
-
 // TODO: functions to get likes, follows, followers, posts, etc.
 // use curser to go through all pages
 
 // Get all collections available on the repo.
 func (c *Client) RepoGetCollections(ctx context.Context, handleOrDid string) ([]string, error) {
-	output, err := atproto.RepoDescribeRepo(ctx, c.xrpcClient, handleOrDid)
+	xrpcClient, err := c.repoClient(ctx, handleOrDid)
+	if err != nil {
+		return nil, fmt.Errorf("RepoGetCollections error (repoClient): %w", err)
+	}
+	output, err := atproto.RepoDescribeRepo(ctx, xrpcClient, handleOrDid)
 	if err != nil {
-		return nil, fmt.Errorf("RepoGetCollections error (RepoDescribeRepo): %v", err)
+		return nil, fmt.Errorf("RepoGetCollections error (RepoDescribeRepo): %w", xrpcError(err))
 	}
 	return output.Collections, nil
 }
 
 // Get all recors of the specified collection from the given repo.
+//
+// Records of other accounts are read directly from the PDS hosting their repo.
 func (c *Client) RepoGetRecords(ctx context.Context, handleOrDid string, collection string, limit int) ([]*atproto.RepoListRecords_Record, error) {
+	xrpcClient, err := c.repoClient(ctx, handleOrDid)
+	if err != nil {
+		return nil, fmt.Errorf("RepoGetRecords error (repoClient): %w", err)
+	}
 
 	var records []*atproto.RepoListRecords_Record
 	cursor, lastCid := "", ""
@@ -38,9 +46,9 @@ func (c *Client) RepoGetRecords(ctx context.Context, handleOrDid string, collect
 	// iterate until we got all records
 	for {
 		// query repo for collection with updated cursor
-		output, err := atproto.RepoListRecords(ctx, c.xrpcClient, collection, cursor, 100, handleOrDid, false, "", "")
+		output, err := atproto.RepoListRecords(ctx, xrpcClient, collection, cursor, 100, handleOrDid, false, "", "")
 		if err != nil {
-			return nil, fmt.Errorf("RepoGetRecords error (RepoListRecords): %v", err)
+			return nil, fmt.Errorf("RepoGetRecords error (RepoListRecords): %w", xrpcError(err))
 		}
 
 		// stop if no records returned
@@ -77,7 +85,7 @@ func (c *Client) RepoGetRecords(ctx context.Context, handleOrDid string, collect
 func (c *Client) RepoGetRecordUris(ctx context.Context, handleOrDid string, collection string, limit int) ([]string, error) {
 	records, err := c.RepoGetRecords(ctx, handleOrDid, collection, limit)
 	if err != nil {
-		return nil, fmt.Errorf("RepoGetRecordUris error (RepoGetRecords): %v", err)
+		return nil, fmt.Errorf("RepoGetRecordUris error (RepoGetRecords): %w", err)
 	}
 	uris := make([]string, len(records))
 	for i, r := range records {
@@ -94,11 +102,15 @@ func (c *Client) RepoGetRecordUris(ctx context.Context, handleOrDid string, coll
 func (c *Client) RepoGetRecordAsType(ctx context.Context, recordUri string, resultPointer cborUnmarshaler) error {
 	parsedUri, err := util.ParseAtUri(recordUri)
 	if err != nil {
-		return fmt.Errorf("RepoGetCidOfRecord error (ParseAtUri): %v", err)
+		return fmt.Errorf("RepoGetRecordAsType error (ParseAtUri): %w", err)
+	}
+	xrpcClient, err := c.repoClient(ctx, parsedUri.Did)
+	if err != nil {
+		return fmt.Errorf("RepoGetRecordAsType error (repoClient): %w", err)
 	}
-	record, err := atproto.RepoGetRecord(ctx, c.xrpcClient, "", parsedUri.Collection, parsedUri.Did, parsedUri.Rkey)
+	record, err := atproto.RepoGetRecord(ctx, xrpcClient, "", parsedUri.Collection, parsedUri.Did, parsedUri.Rkey)
 	if err != nil {
-		return fmt.Errorf("RepoGetRecordAsType error (RepoGetRecord): %v", err)
+		return fmt.Errorf("RepoGetRecordAsType error (RepoGetRecord): %w", xrpcError(err))
 	}
 	return decodeRecordAsLexicon(record.Value, resultPointer)
 
@@ -109,14 +121,18 @@ func (c *Client) RepoGetPostAndCid(ctx context.Context, postUri string) (bsky.Fe
 	var post bsky.FeedPost
 	parsedUri, err := util.ParseAtUri(postUri)
 	if err != nil {
-		return post, "", fmt.Errorf("RepoGetPostAndCid error (ParseAtUri): %v", err)
+		return post, "", fmt.Errorf("RepoGetPostAndCid error (ParseAtUri): %w", err)
+	}
+	xrpcClient, err := c.repoClient(ctx, parsedUri.Did)
+	if err != nil {
+		return post, "", fmt.Errorf("RepoGetPostAndCid error (repoClient): %w", err)
 	}
-	record, err := atproto.RepoGetRecord(ctx, c.xrpcClient, "", parsedUri.Collection, parsedUri.Did, parsedUri.Rkey)
+	record, err := atproto.RepoGetRecord(ctx, xrpcClient, "", parsedUri.Collection, parsedUri.Did, parsedUri.Rkey)
 	if err != nil {
-		return post, "", fmt.Errorf("RepoGetPostAndCid error (RepoGetRecord): %v", err)
+		return post, "", fmt.Errorf("RepoGetPostAndCid error (RepoGetRecord): %w", xrpcError(err))
 	}
 	if err := decodeRecordAsLexicon(record.Value, &post); err != nil {
-		return post, "", fmt.Errorf("RepoGetPostAndCid error (DecodeRecordAsLexicon): %v", err)
+		return post, "", fmt.Errorf("RepoGetPostAndCid error (DecodeRecordAsLexicon): %w", err)
 	}
 	return post, *record.Cid, nil
 }
@@ -125,7 +141,7 @@ func (c *Client) RepoGetPostAndCid(ctx context.Context, postUri string) (bsky.Fe
 func (c *Client) RepoDeletePost(ctx context.Context, postUri string) error {
 	parsedUri, err := util.ParseAtUri(postUri)
 	if err != nil {
-		return fmt.Errorf("RepoDeletePost error (ParseAtUri): %v", err)
+		return fmt.Errorf("RepoDeletePost error (ParseAtUri): %w", err)
 	}
 	_, err = atproto.RepoDeleteRecord(ctx, c.xrpcClient, &atproto.RepoDeleteRecord_Input{
 		Collection: "app.bsky.feed.post",
@@ -133,8 +149,9 @@ func (c *Client) RepoDeletePost(ctx context.Context, postUri string) error {
 		Rkey:       parsedUri.Rkey,
 	})
 	if err != nil {
-		return fmt.Errorf("RepoDeletePost error (RepoDeleteRecord): %v", err)
+		return fmt.Errorf("RepoDeletePost error (RepoDeleteRecord): %w", xrpcError(err))
 	}
+	c.logger.Debug("Post deleted", "did", c.Did, "uri", postUri)
 	return nil
 }
 
@@ -142,14 +159,14 @@ func (c *Client) RepoDeletePost(ctx context.Context, postUri string) error {
 func (c *Client) RepoDeleteAllPosts(ctx context.Context) error {
 	postUris, err := c.RepoGetRecordUris(ctx, c.Handle, "app.bsky.feed.post", -1)
 	if err != nil {
-		return fmt.Errorf("RepoDeleteAllPosts error (RepoGetRecordUris): %v", err)
+		return fmt.Errorf("RepoDeleteAllPosts error (RepoGetRecordUris): %w", err)
 	}
-	logger.Println("Deleting", len(postUris), "posts from repo")
+	c.logger.Info("Deleting posts from repo", "count", len(postUris))
 
 	for _, uri := range postUris {
 		err = c.RepoDeletePost(ctx, uri)
 		if err != nil {
-			return fmt.Errorf("RepoDeleteAllPosts error (RepoDeletePost): %v", err)
+			return fmt.Errorf("RepoDeleteAllPosts error (RepoDeletePost): %w", err)
 		}
 	}
 	return nil
@@ -162,15 +179,17 @@ func (c *Client) RepoDeleteAllPosts(ctx context.Context) error {
 // License: Apache 2.0
 func (c *Client) RepoUploadImage(ctx context.Context, image imageSourceParsed) (*lexutil.LexBlob, error) {
 
-	getImage, err := getImageAsBuffer(image.Uri.String())
+	start := time.Now()
+	getImage, err := getImageAsBuffer(c.httpClient, image.Uri.String())
 	if err != nil {
-		log.Printf("Couldn't retrive the image: %v , %v", image, err)
+		return nil, fmt.Errorf("RepoUploadImage error (getImageAsBuffer): %w", err)
 	}
 
 	resp, err := atproto.RepoUploadBlob(ctx, c.xrpcClient, bytes.NewReader(getImage))
 	if err != nil {
-		return nil, fmt.Errorf("RepoUploadImage error (RepoUploadBlob): %v", err)
+		return nil, fmt.Errorf("RepoUploadImage error (RepoUploadBlob): %w", xrpcError(err))
 	}
+	c.logger.Debug("Image uploaded", "uri", image.Uri.String(), "size", resp.Blob.Size, "duration", time.Since(start))
 
 	blob := lexutil.LexBlob{
 		Ref:      resp.Blob.Ref,
@@ -191,15 +210,17 @@ func (c *Client) RepoUploadImages(ctx context.Context, images []imageSourceParse
 	blobs := make([]lexutil.LexBlob, 0, len(images))
 
 	for _, img := range images {
-		getImage, err := getImageAsBuffer(img.Uri.String())
+		start := time.Now()
+		getImage, err := getImageAsBuffer(c.httpClient, img.Uri.String())
 		if err != nil {
-			log.Printf("Couldn't retrive the image: %v , %v", img, err)
+			return nil, fmt.Errorf("RepoUploadImages error (getImageAsBuffer): %w", err)
 		}
 
 		resp, err := atproto.RepoUploadBlob(ctx, c.xrpcClient, bytes.NewReader(getImage))
 		if err != nil {
-			return nil, fmt.Errorf("RepoUploadImages error (RepoUploadBlob): %v", err)
+			return nil, fmt.Errorf("RepoUploadImages error (RepoUploadBlob): %w", xrpcError(err))
 		}
+		c.logger.Debug("Image uploaded", "uri", img.Uri.String(), "size", resp.Blob.Size, "duration", time.Since(start))
 
 		blobs = append(blobs, lexutil.LexBlob{
 			Ref:      resp.Blob.Ref,
@@ -229,8 +250,9 @@ func (c *Client) RepoCreatePostRecord(ctx context.Context, post bsky.FeedPost) (
 
 	response, err := atproto.RepoCreateRecord(ctx, c.xrpcClient, post_input)
 	if err != nil {
-		return "", "", fmt.Errorf("unable to post, %v", err)
+		return "", "", fmt.Errorf("unable to post, %w", xrpcError(err))
 	}
+	c.logger.Debug("Post created", "did", c.Did, "uri", response.Uri)
 
 	return response.Cid, response.Uri, nil
 }
@@ -0,0 +1,228 @@
+package botsky
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Retry policy for transient XRPC failures (5xx responses, timeouts, connection resets).
+//
+// Queries (GET requests) are always retried. Procedures are only retried if they are safe to repeat: record writes
+// with an explicit rkey, and requests with an idempotency key (see WithIdempotencyKey).
+type RetryPolicy struct {
+	MaxAttempts    int           // total attempts per request, including the first one. Set to 1 to disable retries
+	InitialBackoff time.Duration // delay before the first retry, doubled for every further retry
+	MaxBackoff     time.Duration // maximum delay between attempts
+	AttemptTimeout time.Duration // timeout per attempt, 0 for none (the HTTP client's timeout covers all attempts)
+
+	// Decides whether a failed attempt should be retried. Defaults to IsRetryable.
+	Retryable func(resp *http.Response, err error) bool
+	// Called for every retry and when giving up, e.g. to collect metrics. May be nil.
+	OnRetry func(RetryEvent)
+}
+
+// Describes a retry (or giving up after the last attempt), passed to RetryPolicy.OnRetry.
+type RetryEvent struct {
+	Method     string // XRPC method, e.g. "app.bsky.feed.getPosts"
+	Attempt    int    // number of the failed attempt, starting at 1
+	StatusCode int    // status code of the failed attempt, 0 if it failed without a response
+	Err        error  // error of the failed attempt, nil if it failed with a response
+	Delay      time.Duration
+	GaveUp     bool // no further attempts are made
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    4,
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff:     10 * time.Second,
+	}
+}
+
+// Whether a failed request is worth retrying: server errors and network failures, but not cancellation.
+func IsRetryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return isNetworkError(err)
+	}
+	switch resp.StatusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Whether the request failed because the server couldn't be reached or didn't respond in time: connection and DNS
+// failures, resets, timeouts and truncated responses. Cancellation is not a network error.
+func isNetworkError(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	return errors.As(err, &opErr) ||
+		errors.As(err, &dnsErr) ||
+		errors.As(err, &netErr) && netErr.Timeout() ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.EOF)
+}
+
+type idempotencyKey struct{}
+
+// Mark requests made with the returned context as safe to retry, by sending the given key in the Idempotency-Key header.
+//
+// Only use this if the server deduplicates requests by the key, or repeating the request is harmless.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKey{}, key)
+}
+
+// Record writes which can be repeated without creating duplicates, as long as they name the record explicitly.
+var rkeyWrites = map[string]bool{
+	"com.atproto.repo.createRecord": true,
+	"com.atproto.repo.putRecord":    true,
+	"com.atproto.repo.deleteRecord": true,
+}
+
+// Whether the request can be sent again without side effects.
+func isIdempotent(req *http.Request) bool {
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		return true
+	}
+	if req.Header.Get("Idempotency-Key") != "" {
+		return true
+	}
+	method := strings.TrimPrefix(req.URL.Path, "/xrpc/")
+	if !rkeyWrites[method] || req.GetBody == nil {
+		return false
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return false
+	}
+	defer body.Close()
+	var input struct {
+		Rkey *string `json:"rkey"`
+	}
+	return json.NewDecoder(body).Decode(&input) == nil && input.Rkey != nil && *input.Rkey != ""
+}
+
+// Transport retrying requests that failed transiently, with exponential backoff and jitter.
+type retryTransport struct {
+	base   http.RoundTripper
+	policy RetryPolicy
+}
+
+// Body which cancels the attempt's context when closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if key, ok := req.Context().Value(idempotencyKey{}).(string); ok && key != "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("Idempotency-Key", key)
+	}
+	replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	if t.policy.MaxAttempts <= 1 || !replayable || !isIdempotent(req) {
+		return t.base.RoundTrip(req)
+	}
+	retryable := t.policy.Retryable
+	if retryable == nil {
+		retryable = IsRetryable
+	}
+	method := strings.TrimPrefix(req.URL.Path, "/xrpc/")
+
+	for attempt := 1; ; attempt++ {
+		resp, err := t.attempt(req, attempt)
+		if (err == nil && resp.StatusCode < 400) || !retryable(resp, err) {
+			return resp, err
+		}
+
+		event := RetryEvent{Method: method, Attempt: attempt, Err: err}
+		if resp != nil {
+			event.StatusCode = resp.StatusCode
+		}
+		if attempt >= t.policy.MaxAttempts || req.Context().Err() != nil {
+			event.GaveUp = true
+			t.report(event)
+			return resp, err
+		}
+		event.Delay = t.backoff(attempt)
+		if resp != nil {
+			if after := time.Until(retryAfter(resp)); resp.Header.Get("Retry-After") != "" && after > event.Delay {
+				event.Delay = min(after, t.policy.MaxBackoff)
+			}
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		t.report(event)
+
+		timer := time.NewTimer(event.Delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Send one attempt of the request, with a fresh body and the per-attempt timeout.
+func (t *retryTransport) attempt(req *http.Request, attempt int) (*http.Response, error) {
+	ctx, cancel := req.Context(), context.CancelFunc(func() {})
+	if t.policy.AttemptTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, t.policy.AttemptTimeout)
+	}
+	attemptReq := req.WithContext(ctx)
+	if attempt > 1 && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		attemptReq.Body = body
+	}
+	resp, err := t.base.RoundTrip(attemptReq)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// the timeout must stay active while the caller reads the body
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// Exponential backoff with full jitter.
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	backoff := t.policy.InitialBackoff << (attempt - 1)
+	if backoff <= 0 || backoff > t.policy.MaxBackoff {
+		backoff = t.policy.MaxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int64N(int64(backoff))) + 1
+}
+
+func (t *retryTransport) report(event RetryEvent) {
+	if t.policy.OnRetry != nil {
+		t.policy.OnRetry(event)
+	}
+}
@@ -0,0 +1,119 @@
+package botsky
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/davhofer/botsky/pkg/identity"
+)
+
+// Reads from the AppView and from foreign PDSes go through the same retries as reads from the bot's PDS.
+func TestReadsRetried(t *testing.T) {
+	var mutex sync.Mutex
+	calls := make(map[string]int) // by path
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		calls[r.URL.Path]++
+		first := calls[r.URL.Path] == 1
+		mutex.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/did:plc:alice":
+			// PLC directory: alice's PDS is the stand-in as well
+			json.NewEncoder(w).Encode(&identity.DIDDocument{
+				ID:      "did:plc:alice",
+				Service: []identity.Service{{ID: "#atproto_pds", Type: "AtprotoPersonalDataServer", ServiceEndpoint: server.URL}},
+			})
+			return
+		case "/xrpc/com.atproto.repo.describeRepo":
+			if first {
+				xrpcErrorResponse(w, http.StatusServiceUnavailable, "Unavailable")
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]any{
+				"handle": "alice.test", "did": "did:plc:alice", "didDoc": map[string]any{},
+				"collections": []string{"app.bsky.feed.post"}, "handleIsCorrect": true,
+			})
+		case "/xrpc/app.bsky.actor.getProfile":
+			if first {
+				xrpcErrorResponse(w, http.StatusBadGateway, "Unavailable")
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]any{"did": "did:plc:alice", "handle": "alice.test"})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	resolver := identity.NewResolver(server.Client())
+	resolver.PLCDirectory = server.URL
+	pds := newFakePDS(t, newFakeClock())
+	client := newTestClient(t, pds, nil,
+		WithAppViewHost(server.URL),
+		WithIdentityResolver(resolver),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}),
+	)
+
+	profile, err := client.GetProfile(context.Background(), "did:plc:alice")
+	if err != nil || profile.Handle != "alice.test" {
+		t.Errorf("GetProfile = %v, %v", profile, err)
+	}
+	collections, err := client.RepoGetCollections(context.Background(), "did:plc:alice")
+	if err != nil || len(collections) != 1 {
+		t.Errorf("RepoGetCollections = %v, %v", collections, err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, path := range []string{"/xrpc/app.bsky.actor.getProfile", "/xrpc/com.atproto.repo.describeRepo"} {
+		if calls[path] != 2 {
+			t.Errorf("%s was requested %d times, want 2", path, calls[path])
+		}
+	}
+}
+
+// Network failures are classified the same way for retries and for the session refresher.
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		err    error
+		want   bool
+	}{
+		{name: "server error", status: http.StatusBadGateway, want: true},
+		{name: "bad request", status: http.StatusBadRequest, want: false},
+		{name: "connection refused", err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, want: true},
+		{name: "DNS failure", err: &net.DNSError{Err: "server misbehaving", IsTemporary: true}, want: true},
+		{name: "timeout", err: context.DeadlineExceeded, want: true},
+		{name: "unexpected EOF", err: fmt.Errorf("read: %w", io.ErrUnexpectedEOF), want: true},
+		{name: "cancelled", err: context.Canceled, want: false},
+		{name: "other error", err: errors.New("invalid request"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp *http.Response
+			if tt.err == nil {
+				resp = &http.Response{StatusCode: tt.status}
+			}
+			if got := IsRetryable(resp, tt.err); got != tt.want {
+				t.Errorf("IsRetryable = %v, want %v", got, tt.want)
+			}
+			if tt.err != nil && isTransientError(tt.err) != tt.want {
+				t.Errorf("isTransientError = %v, want %v", !tt.want, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package botsky
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/davhofer/indigo/api/atproto"
+	"github.com/davhofer/indigo/xrpc"
+)
+
+var ErrSessionNotFound = errors.New("no stored session")
+
+// Session data persisted by a SessionStore.
+type Session struct {
+	AccessJwt  string            `json:"accessJwt"`
+	RefreshJwt string            `json:"refreshJwt"`
+	Handle     string            `json:"handle"`
+	Did        string            `json:"did"`
+	PdsHost    string            `json:"pdsHost,omitempty"`
+	OAuth      *OAuthSessionData `json:"oauth,omitempty"` // set for sessions created via OAuth
+}
+
+// OAuth specific session data. Contains the private DPoP key the tokens are bound to.
+type OAuthSessionData struct {
+	Issuer        string `json:"issuer"`
+	TokenEndpoint string `json:"tokenEndpoint"`
+	ClientID      string `json:"clientId"`
+	DpopKey       string `json:"dpopKey"` // base64 encoded DER (SEC 1) EC private key
+	ExpiresAt     int64  `json:"expiresAt"`
+}
+
+// Persists sessions across restarts, so the client can resume them instead of logging in again.
+//
+// Sessions are keyed by the handle (or DID) the client was created with, so a single store can hold sessions for several accounts.
+// Load returns ErrSessionNotFound if there is no session for the key.
+type SessionStore interface {
+	Load(ctx context.Context, key string) (*Session, error)
+	Save(ctx context.Context, key string, session *Session) error
+	Delete(ctx context.Context, key string) error
+}
+
+// SessionStore keeping sessions in memory. Useful for tests and for sharing sessions between clients in one process.
+type MemorySessionStore struct {
+	mutex    sync.Mutex
+	sessions map[string]Session
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: make(map[string]Session)}
+}
+
+func (s *MemorySessionStore) Load(ctx context.Context, key string) (*Session, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	session, ok := s.sessions[key]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	return &session, nil
+}
+
+func (s *MemorySessionStore) Save(ctx context.Context, key string, session *Session) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sessions[key] = *session
+	return nil
+}
+
+func (s *MemorySessionStore) Delete(ctx context.Context, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.sessions, key)
+	return nil
+}
+
+// SessionStore keeping one JSON file per session in a directory.
+//
+// The directory is created with permissions 0700 and session files are written atomically with permissions 0600,
+// since they contain credentials.
+type FileSessionStore struct {
+	Dir   string
+	mutex sync.Mutex
+}
+
+func NewFileSessionStore(dir string) *FileSessionStore {
+	return &FileSessionStore{Dir: dir}
+}
+
+func (s *FileSessionStore) path(key string) string {
+	return filepath.Join(s.Dir, url.PathEscape(key)+".json")
+}
+
+func (s *FileSessionStore) Load(ctx context.Context, key string) (*Session, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	data, err := os.ReadFile(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("FileSessionStore.Load error (os.ReadFile): %w", err)
+	}
+	var session Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, fmt.Errorf("FileSessionStore.Load error (json.Unmarshal): %w", err)
+	}
+	return &session, nil
+}
+
+func (s *FileSessionStore) Save(ctx context.Context, key string, session *Session) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	data, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("FileSessionStore.Save error (json.Marshal): %w", err)
+	}
+	if err := os.MkdirAll(s.Dir, 0o700); err != nil {
+		return fmt.Errorf("FileSessionStore.Save error (os.MkdirAll): %w", err)
+	}
+	// write to a temporary file first so a crash can't leave a truncated session behind
+	tmp, err := os.CreateTemp(s.Dir, ".session-*")
+	if err != nil {
+		return fmt.Errorf("FileSessionStore.Save error (os.CreateTemp): %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return fmt.Errorf("FileSessionStore.Save error (Chmod): %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("FileSessionStore.Save error (Write): %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("FileSessionStore.Save error (Close): %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path(key)); err != nil {
+		return fmt.Errorf("FileSessionStore.Save error (os.Rename): %w", err)
+	}
+	return nil
+}
+
+func (s *FileSessionStore) Delete(ctx context.Context, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := os.Remove(s.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("FileSessionStore.Delete error (os.Remove): %w", err)
+	}
+	return nil
+}
+
+// Persist the current session, if the client has a session store.
+func (c *Client) saveSession(ctx context.Context) {
+	if c.sessionStore == nil {
+		return
+	}
+	auth := c.xrpcClient.GetAuthAsync()
+	session := &Session{
+		AccessJwt:  auth.AccessJwt,
+		RefreshJwt: auth.RefreshJwt,
+		Handle:     auth.Handle,
+		Did:        auth.Did,
+		PdsHost:    c.xrpcClient.GetHostAsync(),
+	}
+	if oauth := c.oauth.Load(); oauth != nil {
+		dpopKey, err := oauth.dpop.marshalKey()
+		if err != nil {
+			c.logger.Warn("Failed to save session", "error", err)
+			return
+		}
+		session.OAuth = &OAuthSessionData{
+			Issuer:        oauth.issuer,
+			TokenEndpoint: oauth.tokenEndpoint,
+			ClientID:      oauth.clientId,
+			DpopKey:       dpopKey,
+			ExpiresAt:     c.authExpiry.Load(),
+		}
+	}
+	if err := c.sessionStore.Save(ctx, c.sessionKey, session); err != nil {
+		c.logger.Warn("Failed to save session", "error", err)
+	}
+}
+
+// Resume the session persisted in the client's session store, instead of logging in again.
+//
+// The stored session is validated with the PDS and refreshed if its access token expired. Only if there is no
+// stored session, or it cannot be used anymore, does this fall back to a full login via Authenticate.
+func (c *Client) ResumeSession(ctx context.Context) error {
+	c.sessionLock.Lock()
+	defer c.sessionLock.Unlock()
+
+	if c.sessionStore == nil {
+		return c.authenticate(ctx, true)
+	}
+	session, err := c.sessionStore.Load(ctx, c.sessionKey)
+	if err != nil {
+		if !errors.Is(err, ErrSessionNotFound) {
+			c.logger.Warn("Failed to load session, logging in", "error", err)
+		}
+		return c.authenticate(ctx, true)
+	}
+
+	if c.xrpcClient.GetHostAsync() == "" && session.PdsHost != "" {
+		c.xrpcClient.SetHostAsync(session.PdsHost)
+	}
+	if c.Did == "" {
+		c.Did = session.Did
+	}
+	if session.OAuth != nil {
+		return c.resumeOAuthSession(ctx, session)
+	}
+
+	// try the stored access token if it is still valid for a while
+	if tRemaining, err := getJwtTimeRemaining(session.AccessJwt, c.clock.Now()); err == nil && tRemaining > time.Minute {
+		output, err := atproto.ServerGetSession(ctx, c.sessionXrpcClient(session.AccessJwt))
+		if err == nil && output.Did == session.Did {
+			if err := c.UpdateAuth(ctx, session.AccessJwt, session.RefreshJwt, output.Handle, output.Did); err == nil {
+				return nil
+			}
+		}
+	}
+
+	// otherwise use the refresh token to get a new session
+	if tRemaining, err := getJwtTimeRemaining(session.RefreshJwt, c.clock.Now()); err == nil && tRemaining > 30*time.Second {
+		refreshed, err := atproto.ServerRefreshSession(ctx, c.sessionXrpcClient(session.RefreshJwt))
+		if err == nil {
+			if err := c.UpdateAuth(ctx, refreshed.AccessJwt, refreshed.RefreshJwt, refreshed.Handle, refreshed.Did); err == nil {
+				return nil
+			}
+		} else {
+			c.logger.Warn("Failed to refresh stored session, logging in", "error", err)
+		}
+	}
+
+	// last resort: full login
+	return c.authenticate(ctx, true)
+}
+
+// Resume a stored OAuth session. OAuth sessions cannot fall back to a login, the user has to authorize again
+// if the refresh token is not accepted anymore. Must be called with sessionLock held.
+func (c *Client) resumeOAuthSession(ctx context.Context, session *Session) error {
+	dpop, err := dpopSignerFromString(session.OAuth.DpopKey)
+	if err != nil {
+		return fmt.Errorf("ResumeSession error (DPoP key): %v", err)
+	}
+	c.useOAuthSession(&oauthSession{
+		issuer:        session.OAuth.Issuer,
+		tokenEndpoint: session.OAuth.TokenEndpoint,
+		clientId:      session.OAuth.ClientID,
+		dpop:          dpop,
+	})
+	c.xrpcClient.SetAuthAsync(xrpc.AuthInfo{
+		AccessJwt:  session.AccessJwt,
+		RefreshJwt: session.RefreshJwt,
+		Handle:     session.Handle,
+		Did:        session.Did,
+	})
+
+	// the access token is opaque to the client, so rely on the stored expiry
+	expiresAt := time.Unix(session.OAuth.ExpiresAt, 0)
+	if expiresAt.Sub(c.clock.Now()) > time.Minute {
+		c.setAuth(ctx, c.xrpcClient.GetAuthAsync(), expiresAt)
+		return nil
+	}
+	if err := c.refreshSession(ctx, true); err != nil {
+		return fmt.Errorf("ResumeSession error: %w", err)
+	}
+	return nil
+}
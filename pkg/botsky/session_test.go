@@ -0,0 +1,119 @@
+package botsky
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResumeSession(t *testing.T) {
+	tests := []struct {
+		name          string
+		stored        bool
+		accessFor     time.Duration // remaining validity of the stored tokens
+		refreshFor    time.Duration
+		setup         func(p *fakePDS)
+		wantRequests  int64 // getSession calls
+		wantRefreshes int64
+		wantCreates   int64
+	}{
+		{name: "valid access token", stored: true, accessFor: 10 * time.Minute, refreshFor: time.Hour, wantRequests: 1},
+		{
+			name: "access token rejected", stored: true, accessFor: 10 * time.Minute, refreshFor: time.Hour,
+			setup:        func(p *fakePDS) { p.access = "revoked" },
+			wantRequests: 1, wantRefreshes: 1,
+		},
+		{name: "access token about to expire", stored: true, accessFor: 30 * time.Second, refreshFor: time.Hour, wantRefreshes: 1},
+		{
+			name: "refresh token rejected", stored: true, accessFor: 30 * time.Second, refreshFor: time.Hour,
+			setup:         func(p *fakePDS) { p.refreshStatus = http.StatusBadRequest },
+			wantRefreshes: 1, wantCreates: 1,
+		},
+		{name: "both tokens expired", stored: true, accessFor: -time.Minute, refreshFor: -time.Minute, wantCreates: 1},
+		{name: "no stored session", wantCreates: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			pds := newFakePDS(t, clock)
+			store := NewMemorySessionStore()
+			ctx := context.Background()
+			if tt.stored {
+				var stored Session
+				pds.set(func(p *fakePDS) {
+					p.access, p.refresh = p.token(tt.accessFor), p.token(tt.refreshFor)
+					stored = Session{AccessJwt: p.access, RefreshJwt: p.refresh, Handle: "bot.test", Did: "did:plc:bot", PdsHost: pds.URL}
+				})
+				store.Save(ctx, "did:plc:bot", &stored)
+			}
+			if tt.setup != nil {
+				pds.set(tt.setup)
+			}
+			client := newTestClient(t, pds, clock, WithSessionStore(store))
+
+			if err := client.ResumeSession(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if r, f, c := pds.requests.Load(), pds.refreshes.Load(), pds.creates.Load(); r != tt.wantRequests || f != tt.wantRefreshes || c != tt.wantCreates {
+				t.Errorf("getSession: %d, refreshSession: %d, createSession: %d, want %d, %d and %d", r, f, c, tt.wantRequests, tt.wantRefreshes, tt.wantCreates)
+			}
+			// the resumed session is in use and stored
+			auth := client.xrpcClient.GetAuthAsync()
+			var access string
+			pds.set(func(p *fakePDS) { access = p.access })
+			if auth.AccessJwt != access || client.Did != "did:plc:bot" {
+				t.Errorf("client uses access token %q of %s, want the one accepted by the PDS", auth.AccessJwt, client.Did)
+			}
+			if session, err := store.Load(ctx, "did:plc:bot"); err != nil || session.AccessJwt != auth.AccessJwt {
+				t.Errorf("stored session = %v, %v, want the current one", session, err)
+			}
+		})
+	}
+}
+
+func TestFileSessionStore(t *testing.T) {
+	ctx := context.Background()
+	dir := filepath.Join(t.TempDir(), "sessions")
+	store := NewFileSessionStore(dir)
+	if _, err := store.Load(ctx, "bot.test"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Load without a session error = %v, want ErrSessionNotFound", err)
+	}
+
+	session := &Session{AccessJwt: "access", RefreshJwt: "refresh", Handle: "bot.test", Did: "did:plc:bot", PdsHost: "https://pds.test"}
+	if err := store.Save(ctx, "bot.test", session); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := store.Load(ctx, "bot.test")
+	if err != nil || *loaded != *session {
+		t.Errorf("Load = %+v, %v, want %+v", loaded, err, session)
+	}
+
+	// sessions contain credentials, only the owner may read them
+	for path, want := range map[string]os.FileMode{dir: 0o700, store.path("bot.test"): 0o600} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := info.Mode().Perm(); perm != want {
+			t.Errorf("%s has permissions %o, want %o", path, perm, want)
+		}
+	}
+	// no temporary files are left behind
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("directory contains %d files, want 1", len(entries))
+	}
+
+	if err := store.Delete(ctx, "bot.test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load(ctx, "bot.test"); !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("Load after Delete error = %v, want ErrSessionNotFound", err)
+	}
+	if err := store.Delete(ctx, "bot.test"); err != nil {
+		t.Errorf("Delete of a missing session error = %v", err)
+	}
+}
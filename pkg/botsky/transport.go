@@ -0,0 +1,115 @@
+package botsky
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Returns a copy of the HTTP client whose transport is wrapped by the given middleware.
+func wrapHTTPClient(httpClient *http.Client, wrap func(http.RoundTripper) http.RoundTripper) *http.Client {
+	wrapped := *httpClient
+	base := httpClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	wrapped.Transport = wrap(base)
+	return &wrapped
+}
+
+// Wrap the transport with the middleware, the first one being the outermost.
+func applyMiddleware(transport http.RoundTripper, middleware []func(http.RoundTripper) http.RoundTripper) http.RoundTripper {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		transport = middleware[i](transport)
+	}
+	return transport
+}
+
+// XRPC methods managing the session itself, which must never trigger a session refresh.
+var sessionMethods = map[string]bool{
+	"com.atproto.server.createSession":  true,
+	"com.atproto.server.refreshSession": true,
+	"com.atproto.server.deleteSession":  true,
+	"com.atproto.server.getSession":     true,
+}
+
+// Transport refreshing the session and retrying the request once, if it failed because the access token expired.
+type authRefreshTransport struct {
+	base   http.RoundTripper
+	client *Client
+}
+
+func (t *authRefreshTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || (resp.StatusCode != http.StatusBadRequest && resp.StatusCode != http.StatusUnauthorized) {
+		return resp, err
+	}
+	usedJwt, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok || sessionMethods[strings.TrimPrefix(req.URL.Path, "/xrpc/")] {
+		return resp, nil
+	}
+	// the request can only be replayed if its body can be recreated
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return resp, nil
+	}
+
+	// peek at the error and restore the body for the caller
+	body, readErr := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if readErr != nil {
+		return resp, nil
+	}
+	var xrpcErr struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &xrpcErr) != nil {
+		return resp, nil
+	}
+	// OAuth access tokens are rejected with invalid_token once they expired
+	if xrpcErr.Error != "ExpiredToken" && !(xrpcErr.Error == "invalid_token" && t.client.oauth.Load() != nil) {
+		return resp, nil
+	}
+
+	if err := t.client.refreshExpiredSession(req.Context(), usedJwt); err != nil {
+		return resp, nil
+	}
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return resp, nil
+		}
+	}
+	retry.Header.Set("Authorization", "Bearer "+t.client.xrpcClient.GetAuthAsync().AccessJwt)
+	return t.base.RoundTrip(retry)
+}
+
+// Transport logging every XRPC request at debug level, with its endpoint, status and duration.
+type loggingTransport struct {
+	base   http.RoundTripper
+	logger *slog.Logger
+}
+
+func (t *loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.logger.Enabled(req.Context(), slog.LevelDebug) {
+		return t.base.RoundTrip(req)
+	}
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	attrs := []any{
+		"endpoint", strings.TrimPrefix(req.URL.Path, "/xrpc/"),
+		"host", req.URL.Host,
+		"method", req.Method,
+		"duration", time.Since(start),
+	}
+	if err != nil {
+		t.logger.DebugContext(req.Context(), "XRPC request failed", append(attrs, "error", err)...)
+		return resp, err
+	}
+	t.logger.DebugContext(req.Context(), "XRPC request", append(attrs, "status", resp.StatusCode)...)
+	return resp, nil
+}
@@ -3,10 +3,11 @@ package botsky
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
@@ -21,24 +22,32 @@ import (
 	"golang.org/x/term"
 )
 
-var logger = log.New(os.Stdout, "", log.LstdFlags|log.Lshortfile)
-
 // Convenience function to sleep for a number of seconds.
 func Sleep(seconds int) {
 	time.Sleep(time.Duration(seconds) * time.Second)
 }
 
+// Dereference the pointer, or return the zero value of the type if it is nil.
+func valueOrZero[T any](p *T) T {
+	if p == nil {
+		var zero T
+		return zero
+	}
+	return *p
+}
+
 // Get the credentials from environment variables.
 //
 // Handle: BOTSKY_HANDLE
 // Appkey/password: BOTSKY_APPKEY
+//
+// The values can also be read from files named by BOTSKY_HANDLE_FILE and BOTSKY_APPKEY_FILE, see EnvCredentials.
 func GetEnvCredentials() (string, string, error) {
-	handle := os.Getenv("BOTSKY_HANDLE")
-	appkey := os.Getenv("BOTSKY_APPKEY")
-	if handle == "" || appkey == "" {
-		return "", "", fmt.Errorf("BOTSKY_HANDLE or BOTSKY_APPKEY env variable not set")
+	creds, err := EnvCredentials{}.Credentials(context.Background())
+	if err != nil {
+		return "", "", err
 	}
-	return handle, appkey, nil
+	return creds.Handle, creds.Appkey, nil
 }
 
 // Enter the credentials via CLI prompt.
@@ -61,6 +70,18 @@ func GetCLICredentials() (string, string, error) {
 	return strings.TrimSpace(handle), strings.TrimSpace(appkey), nil
 }
 
+// Enter the sign-in code for accounts with email two-factor authentication via CLI prompt.
+//
+// Can be passed to WithAuthFactorTokenPrompt.
+func GetCLIAuthFactorToken(ctx context.Context) (string, error) {
+	fmt.Print("Enter the sign-in code sent to your email: ")
+	token, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("GetCLIAuthFactorToken error: %v", err)
+	}
+	return strings.TrimSpace(token), nil
+}
+
 type cborUnmarshaler interface {
 	UnmarshalCBOR(io.Reader) error
 }
@@ -96,12 +117,12 @@ func decodeRecordAsLexicon(recordDecoder *lexutil.LexiconTypeDecoder, resultPoin
 // This function has been modified from its original version.
 // Original source: https://github.com/danrusei/gobot-bsky/blob/main/gobot.go
 // License: Apache 2.0
-func getImageAsBuffer(imageLocation string) ([]byte, error) {
+func getImageAsBuffer(httpClient *http.Client, imageLocation string) ([]byte, error) {
 	if strings.HasPrefix(imageLocation, "http://") || strings.HasPrefix(imageLocation, "https://") {
 		// Fetch image from URL
-		response, err := http.Get(imageLocation)
+		response, err := httpClient.Get(imageLocation)
 		if err != nil {
-			return nil, fmt.Errorf("getImageAsBuffer error (http.Get): %v", err)
+			return nil, fmt.Errorf("getImageAsBuffer error (httpClient.Get): %v", err)
 		}
 		defer response.Body.Close()
 
@@ -166,14 +187,14 @@ func findRegexMatches(text, pattern string) []struct {
 }
 
 // Try to fetch the open graph or twitter tags for displaying embed information of the webpage (card image, description).
-func fetchOpenGraphTwitterTags(url string) (map[string]string, error) {
+func fetchOpenGraphTwitterTags(httpClient *http.Client, url string) (map[string]string, error) {
 	// Initialize the result map
 	tags := make(map[string]string)
 
 	// Make HTTP request
-	resp, err := http.Get(url)
+	resp, err := httpClient.Get(url)
 	if err != nil {
-		return nil, fmt.Errorf("fetchOpenGraphTwitterTags error (http.Get): %v", err)
+		return nil, fmt.Errorf("fetchOpenGraphTwitterTags error (httpClient.Get): %v", err)
 	}
 	defer resp.Body.Close()
 
@@ -236,13 +257,16 @@ func stripHashtag(hashtag string) string {
 }
 
 // Block until the user sends an interrupt (Ctrl+C). Useful when running a listener and no other foreground process.
-func WaitUntilCancel() {
+//
+// Logs to the given logger, e.g. client.Logger().
+func WaitUntilCancel(logger *slog.Logger) {
 	// Create channel for shutdown signals
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	fmt.Println("Waiting until cancelled (Ctrl+C)")
+	defer signal.Stop(sigChan)
+	logger.Info("Waiting until cancelled (Ctrl+C)")
 
 	// Block until we receive a shutdown signal
 	<-sigChan
-	fmt.Println("\nCancelled")
+	logger.Info("Cancelled")
 }
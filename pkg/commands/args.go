@@ -0,0 +1,159 @@
+package commands
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Type of a command argument.
+type ArgType int
+
+const (
+	ArgString   ArgType = iota // a single word, or several words in double quotes
+	ArgInt                     // an integer
+	ArgDuration                // a duration like 90s, 15m or 2h30m
+	ArgText                    // the rest of the text, must be the last argument
+)
+
+// Argument of a command.
+type Arg struct {
+	Name     string
+	Type     ArgType
+	Optional bool // optional arguments may only be followed by other optional arguments
+}
+
+// Parsed arguments of an invocation, by name. Missing optional arguments are not set.
+type Args map[string]any
+
+// Whether the argument was given.
+func (a Args) Has(name string) bool {
+	_, ok := a[name]
+	return ok
+}
+
+// Value of an ArgString or ArgText argument, "" if it wasn't given.
+func (a Args) String(name string) string {
+	value, _ := a[name].(string)
+	return value
+}
+
+// Value of an ArgInt argument, 0 if it wasn't given.
+func (a Args) Int(name string) int64 {
+	value, _ := a[name].(int64)
+	return value
+}
+
+// Value of an ArgDuration argument, 0 if it wasn't given.
+func (a Args) Duration(name string) time.Duration {
+	value, _ := a[name].(time.Duration)
+	return value
+}
+
+type token struct {
+	value string
+	start int // byte offset of the token in the input
+}
+
+// Split the input into words, keeping words in double quotes together.
+func tokenize(input string) []token {
+	var tokens []token
+	i := 0
+	for i < len(input) {
+		r, size := utf8.DecodeRuneInString(input[i:])
+		if unicode.IsSpace(r) {
+			i += size
+			continue
+		}
+		start := i
+		if r == '"' {
+			if end := strings.IndexByte(input[i+1:], '"'); end >= 0 {
+				tokens = append(tokens, token{value: input[i+1 : i+1+end], start: start})
+				i += end + 2
+				continue
+			}
+		}
+		end := strings.IndexFunc(input[i:], unicode.IsSpace)
+		if end < 0 {
+			end = len(input) - i
+		}
+		tokens = append(tokens, token{value: input[i : i+end], start: start})
+		i += end
+	}
+	return tokens
+}
+
+// Parse the arguments of an invocation according to the schema.
+func parseArgs(schema []Arg, input string) (Args, error) {
+	tokens := tokenize(input)
+	args := make(Args)
+	i := 0
+	for _, arg := range schema {
+		if i >= len(tokens) {
+			if arg.Optional {
+				continue
+			}
+			return nil, Errorf("missing argument <%s>", arg.Name)
+		}
+		switch arg.Type {
+		case ArgText:
+			args[arg.Name] = strings.TrimSpace(input[tokens[i].start:])
+			i = len(tokens)
+		case ArgInt:
+			value, err := strconv.ParseInt(tokens[i].value, 10, 64)
+			if err != nil {
+				return nil, Errorf("<%s> must be a number, got %q", arg.Name, tokens[i].value)
+			}
+			args[arg.Name] = value
+			i++
+		case ArgDuration:
+			value, err := time.ParseDuration(tokens[i].value)
+			if err != nil || value < 0 {
+				return nil, Errorf("<%s> must be a duration like 30m or 2h, got %q", arg.Name, tokens[i].value)
+			}
+			args[arg.Name] = value
+			i++
+		default:
+			args[arg.Name] = tokens[i].value
+			i++
+		}
+	}
+	if i < len(tokens) {
+		return nil, Errorf("too many arguments")
+	}
+	return args, nil
+}
+
+// Usage string of the argument, e.g. <city> or [count].
+func (a Arg) usage() string {
+	name := a.Name
+	if a.Type == ArgText {
+		name += "..."
+	}
+	if a.Optional {
+		return "[" + name + "]"
+	}
+	return "<" + name + ">"
+}
+
+// Error shown to the user who invoked a command, e.g. for invalid arguments.
+type UserError struct {
+	Message string
+	Err     error // optional cause, e.g. ErrPermissionDenied
+}
+
+func (e *UserError) Error() string {
+	return e.Message
+}
+
+func (e *UserError) Unwrap() error {
+	return e.Err
+}
+
+// Create an error which is replied to the user. Handlers can return it to reject an invocation.
+func Errorf(format string, a ...any) error {
+	return &UserError{Message: fmt.Sprintf(format, a...)}
+}
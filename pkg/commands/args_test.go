@@ -0,0 +1,78 @@
+package commands
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []token
+	}{
+		{input: "", want: nil},
+		{input: "  one two\tthree ", want: []token{{"one", 2}, {"two", 6}, {"three", 10}}},
+		{input: `say "hello world" now`, want: []token{{"say", 0}, {"hello world", 4}, {"now", 18}}},
+		{input: `"" x`, want: []token{{"", 0}, {"x", 3}}},
+		{input: `an "unclosed quote`, want: []token{{"an", 0}, {`"unclosed`, 3}, {"quote", 13}}},
+		{input: "über straße", want: []token{{"über", 0}, {"straße", 6}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			if got := tokenize(tt.input); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("tokenize(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	remind := []Arg{{Name: "in", Type: ArgDuration}, {Name: "what", Type: ArgText}}
+	roll := []Arg{{Name: "sides", Type: ArgInt}, {Name: "label", Optional: true}}
+	tests := []struct {
+		name    string
+		schema  []Arg
+		input   string
+		want    Args
+		wantErr bool
+	}{
+		{name: "duration and text", schema: remind, input: " 2h30m water  the plants ", want: Args{"in": 150 * time.Minute, "what": "water  the plants"}},
+		{name: "text keeps quotes", schema: remind, input: `1m say "hi"`, want: Args{"in": time.Minute, "what": `say "hi"`}},
+		{name: "invalid duration", schema: remind, input: "soon water", wantErr: true},
+		{name: "negative duration", schema: remind, input: "-1h water", wantErr: true},
+		{name: "missing text", schema: remind, input: "2h", wantErr: true},
+		{name: "int with optional", schema: roll, input: `6 "lucky dice"`, want: Args{"sides": int64(6), "label": "lucky dice"}},
+		{name: "optional missing", schema: roll, input: "20", want: Args{"sides": int64(20)}},
+		{name: "invalid int", schema: roll, input: "six", wantErr: true},
+		{name: "too many", schema: roll, input: "6 a b", wantErr: true},
+		{name: "no args", schema: nil, input: "", want: Args{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseArgs(tt.schema, tt.input)
+			if tt.wantErr {
+				var userErr *UserError
+				if !errors.As(err, &userErr) {
+					t.Errorf("parseArgs error = %v, want a UserError", err)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseArgs = %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestArgsAccessors(t *testing.T) {
+	args := Args{"city": "zurich", "count": int64(3), "in": time.Hour}
+	if args.String("city") != "zurich" || args.Int("count") != 3 || args.Duration("in") != time.Hour {
+		t.Errorf("accessors returned %q, %d, %s", args.String("city"), args.Int("count"), args.Duration("in"))
+	}
+	// missing or differently typed arguments are zero
+	if args.Has("missing") || args.String("count") != "" || args.Int("city") != 0 {
+		t.Error("missing or mistyped arguments aren't zero")
+	}
+}
@@ -0,0 +1,438 @@
+// Package commands parses and runs text commands sent to a bot, in posts mentioning it or in DMs.
+//
+// Commands are registered on a Router with an argument schema and handled e.g. with
+//
+//	router := commands.NewRouter(commands.WithPrefix("!"))
+//	err := router.Register(commands.Command{
+//		Name: "weather",
+//		Args: []commands.Arg{{Name: "city", Type: commands.ArgText}},
+//		Handler: func(ctx context.Context, inv *commands.Invocation) error {
+//			return inv.Reply(ctx, forecast(inv.Args.String("city")))
+//		},
+//	})
+//	err = notificationListener.OnMention("commands", router.MentionHandler())
+//	err = chatListener.RegisterHandler("commands", router.ChatHandler())
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/davhofer/botsky/pkg/botsky"
+	"github.com/davhofer/botsky/pkg/listeners"
+	"github.com/davhofer/indigo/api/bsky"
+	"github.com/davhofer/indigo/api/chat"
+)
+
+// Returned by the Handle functions if the text doesn't contain a registered command.
+var ErrUnknownCommand = errors.New("unknown command")
+
+// Maximum length (in characters) of post replies, longer replies are truncated.
+const maxPostLength = 300
+
+// Where a command was invoked.
+type Source int
+
+const (
+	SourcePost Source = iota // a post mentioning the bot
+	SourceChat               // a chat message
+)
+
+// A command the bot understands.
+type Command struct {
+	Name        string
+	Aliases     []string
+	Description string // shown in the help text
+	Args        []Arg
+	Cooldown    time.Duration // minimum time between two invocations by the same account
+	Permissions []Permission  // all of them must allow an invocation
+	Handler     func(ctx context.Context, inv *Invocation) error
+}
+
+// Usage string of the command, e.g. /weather <city...>.
+func (c *Command) Usage(prefix string) string {
+	parts := []string{prefix + c.Name}
+	for _, arg := range c.Args {
+		parts = append(parts, arg.usage())
+	}
+	return strings.Join(parts, " ")
+}
+
+// A single invocation of a command.
+type Invocation struct {
+	Client  *botsky.Client
+	Command *Command
+	Name    string // the name or alias the command was invoked with
+	Args    Args
+	Source  Source
+	Author  string // DID of the invoking account
+	PostUri string // the invoking post, for SourcePost
+	ConvoId string // the conversation, for SourceChat
+}
+
+// Reply to the invocation: with a reply post for SourcePost, or a message in the conversation for SourceChat.
+func (inv *Invocation) Reply(ctx context.Context, text string) error {
+	if inv.Source == SourceChat {
+		_, _, err := inv.Client.ChatConvoSendMessage(ctx, inv.ConvoId, text)
+		return err
+	}
+	if utf8.RuneCountInString(text) > maxPostLength {
+		text = string([]rune(text)[:maxPostLength-1]) + "…"
+	}
+	_, _, err := inv.Client.Post(ctx, botsky.NewPostBuilder(text).ReplyTo(inv.PostUri))
+	return err
+}
+
+type options struct {
+	prefix         string
+	optionalPrefix bool
+	help           bool
+	failureReply   string
+}
+
+// Configures a Router, see NewRouter.
+type Option func(*options)
+
+// Set the prefix of commands, e.g. "/" or "!". Default: "/".
+func WithPrefix(prefix string) Option {
+	return func(o *options) {
+		o.prefix = prefix
+	}
+}
+
+// Also recognize commands without the prefix, e.g. "@bot remind 2h water the plants".
+// Unknown commands are only answered if the prefix was used.
+func WithOptionalPrefix() Option {
+	return func(o *options) {
+		o.optionalPrefix = true
+	}
+}
+
+// Don't register the built-in help command.
+func WithoutHelp() Option {
+	return func(o *options) {
+		o.help = false
+	}
+}
+
+// Set the reply sent when a handler fails with an error that isn't a UserError.
+// Default: "Something went wrong, please try again later."
+//
+// After replying, the error is logged and not returned, so the listener doesn't retry the command.
+// With an empty reply, nothing is sent and the error is returned, e.g. to be retried with listeners.WithHandlerRetry.
+func WithFailureReply(text string) Option {
+	return func(o *options) {
+		o.failureReply = text
+	}
+}
+
+// Parses commands from posts and chat messages and runs their handlers.
+type Router struct {
+	options   options
+	mutex     sync.Mutex
+	commands  []*Command
+	byName    map[string]*Command
+	cooldowns map[string]time.Time // end of the cooldown by command and account
+}
+
+// Create a router. Unless WithoutHelp is given, a "help" command listing all commands is registered.
+func NewRouter(opts ...Option) *Router {
+	o := options{
+		prefix:       "/",
+		help:         true,
+		failureReply: "Something went wrong, please try again later.",
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	r := &Router{
+		options:   o,
+		byName:    make(map[string]*Command),
+		cooldowns: make(map[string]time.Time),
+	}
+	if o.help {
+		r.Register(Command{
+			Name:        "help",
+			Description: "List the commands, or show how to use one",
+			Args:        []Arg{{Name: "command", Optional: true}},
+			Handler:     r.helpHandler,
+		})
+	}
+	return r
+}
+
+// Register a command. Names and aliases are case-insensitive and must be unique.
+func (r *Router) Register(command Command) error {
+	if command.Name == "" || command.Handler == nil {
+		return fmt.Errorf("Register error: command needs a name and a handler")
+	}
+	for i, arg := range command.Args {
+		if arg.Type == ArgText && i != len(command.Args)-1 {
+			return fmt.Errorf("Register error: text argument %s of command %s must be the last one", arg.Name, command.Name)
+		}
+		if !arg.Optional && i > 0 && command.Args[i-1].Optional {
+			return fmt.Errorf("Register error: argument %s of command %s follows an optional argument", arg.Name, command.Name)
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	names := append([]string{command.Name}, command.Aliases...)
+	for _, name := range names {
+		if _, exists := r.byName[strings.ToLower(name)]; exists {
+			return fmt.Errorf("Register error: command %s already exists", name)
+		}
+	}
+	c := &command
+	for _, name := range names {
+		r.byName[strings.ToLower(name)] = c
+	}
+	r.commands = append(r.commands, c)
+	return nil
+}
+
+// Help text listing all commands with their usage and description.
+func (r *Router) Help() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	lines := make([]string, 0, len(r.commands))
+	for _, c := range r.commands {
+		line := c.Usage(r.options.prefix)
+		if c.Description != "" {
+			line += " - " + c.Description
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (r *Router) helpHandler(ctx context.Context, inv *Invocation) error {
+	if !inv.Args.Has("command") {
+		return inv.Reply(ctx, r.Help())
+	}
+	c := r.lookup(inv.Args.String("command"))
+	if c == nil {
+		return Errorf("unknown command %s", inv.Args.String("command"))
+	}
+	text := c.Usage(r.options.prefix)
+	if c.Description != "" {
+		text += "\n" + c.Description
+	}
+	if len(c.Aliases) > 0 {
+		text += "\nAliases: " + strings.Join(c.Aliases, ", ")
+	}
+	return inv.Reply(ctx, text)
+}
+
+func (r *Router) lookup(name string) *Command {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.byName[strings.ToLower(strings.TrimPrefix(name, r.options.prefix))]
+}
+
+// Parse and run a command from a post mentioning the bot. The mention of the bot is stripped from the text.
+//
+// Returns ErrUnknownCommand if the post doesn't contain a command.
+func (r *Router) HandlePost(ctx context.Context, client *botsky.Client, post *botsky.RichPost) error {
+	inv := &Invocation{Client: client, Source: SourcePost, Author: post.AuthorDid, PostUri: post.Uri}
+	return r.handle(ctx, inv, stripMentions(post.Text, post.Facets, client))
+}
+
+// Parse and run a command from a chat message. Messages sent by the bot itself are ignored.
+//
+// Returns ErrUnknownCommand if the message doesn't contain a command.
+func (r *Router) HandleChatMessage(ctx context.Context, client *botsky.Client, convoId string, message *chat.ConvoDefs_MessageView) error {
+	if message.Sender == nil || message.Sender.Did == client.Did {
+		return nil
+	}
+	inv := &Invocation{Client: client, Source: SourceChat, Author: message.Sender.Did, ConvoId: convoId}
+	return r.handle(ctx, inv, stripMentions(message.Text, message.Facets, client))
+}
+
+// Handler for PollingNotificationListener.OnMention, running the commands in mentions.
+func (r *Router) MentionHandler() listeners.EventHandler[listeners.MentionEvent] {
+	return func(ctx context.Context, client *botsky.Client, mention *listeners.MentionEvent) error {
+		if err := r.HandlePost(ctx, client, mention.Post); err != nil && !errors.Is(err, ErrUnknownCommand) {
+			return err
+		}
+		return nil
+	}
+}
+
+// Handler for PollingChatListener, running the commands in new messages.
+func (r *Router) ChatHandler() listeners.Handler[chat.ConvoGetLog_Output_Logs_Elem] {
+	return func(ctx context.Context, client *botsky.Client, elems []*chat.ConvoGetLog_Output_Logs_Elem) error {
+		var failed []*chat.ConvoGetLog_Output_Logs_Elem
+		var errs []error
+		for _, elem := range elems {
+			created := elem.ConvoDefs_LogCreateMessage
+			if created == nil || created.Message == nil || created.Message.ConvoDefs_MessageView == nil {
+				continue
+			}
+			err := r.HandleChatMessage(ctx, client, created.ConvoId, created.Message.ConvoDefs_MessageView)
+			if err != nil && !errors.Is(err, ErrUnknownCommand) {
+				failed = append(failed, elem)
+				errs = append(errs, err)
+			}
+		}
+		if len(failed) == 0 {
+			return nil
+		}
+		// only retry the failed commands, the others already ran (and replied)
+		return &listeners.PartialError[chat.ConvoGetLog_Output_Logs_Elem]{Failed: failed, Err: errors.Join(errs...)}
+	}
+}
+
+// Find the command in the text, check permissions and cooldown, parse the arguments and run the handler.
+// UserErrors are replied to the invoking account.
+func (r *Router) handle(ctx context.Context, inv *Invocation, text string) error {
+	explicit := r.options.prefix != "" && strings.HasPrefix(text, r.options.prefix)
+	if !explicit && r.options.prefix != "" && !r.options.optionalPrefix {
+		return ErrUnknownCommand
+	}
+	name, rest := strings.TrimPrefix(text, r.options.prefix), ""
+	if i := strings.IndexFunc(name, unicode.IsSpace); i >= 0 {
+		name, rest = name[:i], name[i:]
+	}
+	if name == "" {
+		return ErrUnknownCommand
+	}
+	inv.Name = name
+	inv.Command = r.lookup(name)
+	if inv.Command == nil {
+		if explicit {
+			r.reply(ctx, inv, fmt.Sprintf("Unknown command %s, try %shelp", name, r.options.prefix))
+		}
+		return ErrUnknownCommand
+	}
+	inv.Client.Logger().Debug("Command invoked", "command", inv.Command.Name, "author", inv.Author)
+
+	err := r.run(ctx, inv, rest)
+	var userErr *UserError
+	if errors.As(err, &userErr) {
+		r.reply(ctx, inv, userErr.Message)
+		return nil
+	}
+	if err != nil {
+		err = fmt.Errorf("command %s failed: %w", inv.Command.Name, err)
+		if r.options.failureReply == "" {
+			return err
+		}
+		// the user was told, retrying would reply again
+		inv.Client.Logger().Error("Command failed", "command", inv.Command.Name, "author", inv.Author, "error", err)
+		r.reply(ctx, inv, r.options.failureReply)
+	}
+	return nil
+}
+
+func (r *Router) run(ctx context.Context, inv *Invocation, rest string) error {
+	for _, permission := range inv.Command.Permissions {
+		if err := permission(ctx, inv); err != nil {
+			return err
+		}
+	}
+	args, err := parseArgs(inv.Command.Args, rest)
+	if err != nil {
+		var userErr *UserError
+		if errors.As(err, &userErr) {
+			userErr.Message += "\nUsage: " + inv.Command.Usage(r.options.prefix)
+		}
+		return err
+	}
+	inv.Args = args
+	if err := r.checkCooldown(inv); err != nil {
+		return err
+	}
+	if err := inv.Command.Handler(ctx, inv); err != nil {
+		return err
+	}
+	// only successful invocations count, so failed ones can be retried right away
+	r.startCooldown(inv)
+	return nil
+}
+
+// Check whether the invoking account is in the cooldown of the command.
+func (r *Router) checkCooldown(inv *Invocation) error {
+	if inv.Command.Cooldown <= 0 {
+		return nil
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Now()
+	if until, ok := r.cooldowns[cooldownKey(inv)]; ok && now.Before(until) {
+		return Errorf("please wait %s before using %s again", until.Sub(now).Round(time.Second), inv.Command.Name)
+	}
+	return nil
+}
+
+// Start the cooldown of the command for the invoking account.
+func (r *Router) startCooldown(inv *Invocation) {
+	if inv.Command.Cooldown <= 0 {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Now()
+	if len(r.cooldowns) > 1000 {
+		// forget expired cooldowns
+		for k, until := range r.cooldowns {
+			if now.After(until) {
+				delete(r.cooldowns, k)
+			}
+		}
+	}
+	r.cooldowns[cooldownKey(inv)] = now.Add(inv.Command.Cooldown)
+}
+
+func cooldownKey(inv *Invocation) string {
+	return inv.Command.Name + " " + inv.Author
+}
+
+// Reply to the invocation, logging a failure.
+func (r *Router) reply(ctx context.Context, inv *Invocation, text string) {
+	if err := inv.Reply(ctx, text); err != nil {
+		inv.Client.Logger().Warn("Replying to command failed", "author", inv.Author, "error", err)
+	}
+}
+
+// Remove mentions of the bot from the text, using the mention facets (or a leading @handle as fallback).
+func stripMentions(text string, facets []*bsky.RichtextFacet, client *botsky.Client) string {
+	var ranges [][2]int
+	for _, facet := range facets {
+		if facet == nil || facet.Index == nil {
+			continue
+		}
+		for _, feature := range facet.Features {
+			if feature.RichtextFacet_Mention != nil && feature.RichtextFacet_Mention.Did == client.Did {
+				start, end := int(facet.Index.ByteStart), int(facet.Index.ByteEnd)
+				if 0 <= start && start <= end && end <= len(text) {
+					ranges = append(ranges, [2]int{start, end})
+				}
+			}
+		}
+	}
+	// keep the text between the ranges, overlapping ranges are cut once
+	slices.SortFunc(ranges, func(a, b [2]int) int { return a[0] - b[0] })
+	var kept strings.Builder
+	pos := 0
+	for _, r := range ranges {
+		if r[1] <= pos {
+			continue
+		}
+		kept.WriteString(text[pos:max(r[0], pos)])
+		pos = r[1]
+	}
+	kept.WriteString(text[pos:])
+	text = strings.TrimSpace(kept.String())
+	if client.Handle != "" {
+		text = strings.TrimSpace(strings.TrimPrefix(text, "@"+client.Handle))
+	}
+	return text
+}
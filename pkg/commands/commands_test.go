@@ -0,0 +1,268 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/davhofer/botsky/pkg/botsky"
+	"github.com/davhofer/indigo/api/bsky"
+	"github.com/davhofer/indigo/api/chat"
+)
+
+// Local stand-in for the chat service and AppView: records sent messages and serves profiles of the followers.
+type standIn struct {
+	followers []string
+
+	mutex   sync.Mutex
+	replies []string
+}
+
+func (s *standIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/xrpc/chat.bsky.convo.sendMessage":
+		var input chat.ConvoSendMessage_Input
+		json.NewDecoder(r.Body).Decode(&input)
+		s.mutex.Lock()
+		s.replies = append(s.replies, input.Message.Text)
+		s.mutex.Unlock()
+		json.NewEncoder(w).Encode(chat.ConvoDefs_MessageView{Id: "message", Rev: "rev", Text: input.Message.Text})
+	case "/xrpc/app.bsky.actor.getProfile":
+		actor := r.URL.Query().Get("actor")
+		if actor == "did:plc:unknown" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "InvalidRequest", "message": "Profile not found"})
+			return
+		}
+		profile := bsky.ActorDefs_ProfileViewDetailed{Did: actor, Handle: "someone.test", Viewer: &bsky.ActorDefs_ViewerState{}}
+		if slices.Contains(s.followers, actor) {
+			followedBy := "at://" + actor + "/app.bsky.graph.follow/1"
+			profile.Viewer.FollowedBy = &followedBy
+		}
+		json.NewEncoder(w).Encode(profile)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Return and forget the sent replies.
+func (s *standIn) takeReplies() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	replies := s.replies
+	s.replies = nil
+	return replies
+}
+
+func newTestClient(t *testing.T, s *standIn) *botsky.Client {
+	t.Helper()
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	client, err := botsky.NewClient(context.Background(), "did:plc:bot", "",
+		botsky.WithEagerDIDResolution(false),
+		botsky.WithoutLogging(),
+		botsky.WithChatHost(server.URL),
+		botsky.WithAppViewHost(server.URL),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	client.Handle = "bot.test"
+	return client
+}
+
+// Send a chat message to the router.
+func sendMessage(client *botsky.Client, router *Router, author string, text string) error {
+	message := &chat.ConvoDefs_MessageView{Text: text, Sender: &chat.ConvoDefs_MessageViewSender{Did: author}}
+	return router.HandleChatMessage(context.Background(), client, "convo", message)
+}
+
+func mention(did string, start int64, end int64) *bsky.RichtextFacet {
+	return &bsky.RichtextFacet{
+		Index:    &bsky.RichtextFacet_ByteSlice{ByteStart: start, ByteEnd: end},
+		Features: []*bsky.RichtextFacet_Features_Elem{{RichtextFacet_Mention: &bsky.RichtextFacet_Mention{Did: did}}},
+	}
+}
+
+func TestStripMentions(t *testing.T) {
+	client := newTestClient(t, &standIn{})
+	tests := []struct {
+		name   string
+		text   string
+		facets []*bsky.RichtextFacet
+		want   string
+	}{
+		{name: "leading mention", text: "@bot.test /help", facets: []*bsky.RichtextFacet{mention("did:plc:bot", 0, 9)}, want: "/help"},
+		// "grüß " is 7 bytes, the mention starts at byte 7
+		{name: "byte offsets", text: "grüß @bot.test dich", facets: []*bsky.RichtextFacet{mention("did:plc:bot", 7, 16)}, want: "grüß  dich"},
+		{name: "other account kept", text: "@bot.test /hug @alice.test", facets: []*bsky.RichtextFacet{
+			mention("did:plc:bot", 0, 9), mention("did:plc:alice", 15, 26),
+		}, want: "/hug @alice.test"},
+		{name: "out of range facet", text: "/help", facets: []*bsky.RichtextFacet{mention("did:plc:bot", 3, 40)}, want: "/help"},
+		{name: "overlapping facets", text: "@bot.test /help", facets: []*bsky.RichtextFacet{
+			mention("did:plc:bot", 0, 9), mention("did:plc:bot", 1, 5),
+		}, want: "/help"},
+		{name: "handle without facet", text: "@bot.test /help", want: "/help"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stripMentions(tt.text, tt.facets, client); got != tt.want {
+				t.Errorf("stripMentions = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouter(t *testing.T) {
+	s := &standIn{}
+	client := newTestClient(t, s)
+	remind := Command{
+		Name:        "remind",
+		Aliases:     []string{"r"},
+		Description: "Remind you of something",
+		Args:        []Arg{{Name: "in", Type: ArgDuration}, {Name: "what", Type: ArgText}},
+		Handler: func(ctx context.Context, inv *Invocation) error {
+			return inv.Reply(ctx, "in "+inv.Args.Duration("in").String()+" via "+inv.Name+": "+inv.Args.String("what"))
+		},
+	}
+	strict := NewRouter()
+	optional := NewRouter(WithPrefix("!"), WithOptionalPrefix())
+	for _, router := range []*Router{strict, optional} {
+		if err := router.Register(remind); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name        string
+		router      *Router
+		text        string
+		wantUnknown bool
+		wantReply   string // part of the reply, "" for none
+	}{
+		{name: "command", router: strict, text: "/remind 1h water the plants", wantReply: "in 1h0m0s via remind: water the plants"},
+		{name: "alias", router: strict, text: "/R 1m tea", wantReply: "in 1m0s via R: tea"},
+		{name: "prefix required", router: strict, text: "help me with my plants", wantUnknown: true},
+		{name: "unknown command", router: strict, text: "/weather zurich", wantUnknown: true, wantReply: "Unknown command weather, try /help"},
+		{name: "invalid args", router: strict, text: "/remind soon", wantReply: "<in> must be a duration"},
+		{name: "help", router: strict, text: "/help", wantReply: "/help [command] - List the commands, or show how to use one\n/remind <in> <what...> - Remind you of something"},
+		{name: "help of alias", router: strict, text: "/help /r", wantReply: "/remind <in> <what...>\nRemind you of something\nAliases: r"},
+		{name: "help of unknown", router: strict, text: "/help weather", wantReply: "unknown command weather"},
+		{name: "optional prefix", router: optional, text: "remind 2h stretch", wantReply: "in 2h0m0s via remind: stretch"},
+		{name: "explicit prefix", router: optional, text: "!remind 2h stretch", wantReply: "in 2h0m0s via remind: stretch"},
+		{name: "command without prefix", router: optional, text: "help me", wantReply: "unknown command me"},
+		{name: "silent unknown without prefix", router: optional, text: "thanks!", wantUnknown: true},
+		{name: "empty", router: optional, text: "  ", wantUnknown: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := sendMessage(client, tt.router, "did:plc:alice", tt.text)
+			if unknown := errors.Is(err, ErrUnknownCommand); unknown != tt.wantUnknown || (err != nil && !unknown) {
+				t.Errorf("error = %v, want unknown command %v", err, tt.wantUnknown)
+			}
+			replies := s.takeReplies()
+			if tt.wantReply == "" {
+				if len(replies) != 0 {
+					t.Errorf("replied %q, want no reply", replies)
+				}
+				return
+			}
+			if len(replies) != 1 || !strings.Contains(replies[0], tt.wantReply) {
+				t.Errorf("replied %q, want %q", replies, tt.wantReply)
+			}
+		})
+	}
+
+	// messages of the bot itself are ignored
+	if err := sendMessage(client, strict, "did:plc:bot", "/help"); err != nil || len(s.takeReplies()) != 0 {
+		t.Errorf("bot's own message was handled: %v", err)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	handler := func(ctx context.Context, inv *Invocation) error { return nil }
+	tests := []struct {
+		name    string
+		command Command
+	}{
+		{name: "no handler", command: Command{Name: "x"}},
+		{name: "duplicate name", command: Command{Name: "HELP", Handler: handler}},
+		{name: "duplicate alias", command: Command{Name: "x", Aliases: []string{"help"}, Handler: handler}},
+		{name: "text not last", command: Command{Name: "x", Args: []Arg{{Name: "a", Type: ArgText}, {Name: "b"}}, Handler: handler}},
+		{name: "required after optional", command: Command{Name: "x", Args: []Arg{{Name: "a", Optional: true}, {Name: "b"}}, Handler: handler}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := NewRouter().Register(tt.command); err == nil {
+				t.Error("Register succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestCooldown(t *testing.T) {
+	s := &standIn{}
+	client := newTestClient(t, s)
+	router := NewRouter()
+	fail := true
+	calls := 0
+	router.Register(Command{
+		Name:     "ping",
+		Cooldown: time.Hour,
+		Handler: func(ctx context.Context, inv *Invocation) error {
+			calls++
+			if fail {
+				return errors.New("backend down")
+			}
+			return inv.Reply(ctx, "pong")
+		},
+	})
+
+	steps := []struct {
+		author    string
+		fail      bool
+		wantCalls int
+		wantReply string
+	}{
+		// a failed invocation is answered once and doesn't start the cooldown
+		{author: "did:plc:alice", fail: true, wantCalls: 1, wantReply: "Something went wrong, please try again later."},
+		{author: "did:plc:alice", wantCalls: 2, wantReply: "pong"},
+		{author: "did:plc:alice", wantCalls: 2, wantReply: "please wait 1h0m0s before using ping again"},
+		// cooldowns are per account
+		{author: "did:plc:bob", wantCalls: 3, wantReply: "pong"},
+	}
+	for i, step := range steps {
+		fail = step.fail
+		// the failure was replied to, so it isn't returned for a retry
+		if err := sendMessage(client, router, step.author, "/ping"); err != nil {
+			t.Errorf("step %d: error = %v", i, err)
+		}
+		if replies := s.takeReplies(); calls != step.wantCalls || len(replies) != 1 || replies[0] != step.wantReply {
+			t.Errorf("step %d: %d calls, replied %q, want %d calls and %q", i, calls, replies, step.wantCalls, step.wantReply)
+		}
+	}
+}
+
+func TestWithoutFailureReply(t *testing.T) {
+	s := &standIn{}
+	client := newTestClient(t, s)
+	router := NewRouter(WithFailureReply(""))
+	errBackend := errors.New("backend down")
+	router.Register(Command{Name: "ping", Handler: func(ctx context.Context, inv *Invocation) error { return errBackend }})
+
+	// the error is returned for the listener to retry, nothing is replied
+	if err := sendMessage(client, router, "did:plc:alice", "/ping"); !errors.Is(err, errBackend) {
+		t.Errorf("error = %v, want the handler error", err)
+	}
+	if replies := s.takeReplies(); len(replies) != 0 {
+		t.Errorf("replied %q, want no reply", replies)
+	}
+}
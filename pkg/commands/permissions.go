@@ -0,0 +1,39 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Returned (wrapped in a UserError) if the invoking account isn't allowed to use a command.
+var ErrPermissionDenied = errors.New("permission denied")
+
+// Check whether the invocation is allowed. Returns nil if it is, a UserError if it is denied,
+// or another error if the check itself failed.
+type Permission func(ctx context.Context, inv *Invocation) error
+
+// Only allow accounts following the bot.
+func FollowersOnly() Permission {
+	return func(ctx context.Context, inv *Invocation) error {
+		profile, err := inv.Client.GetProfile(ctx, inv.Author)
+		if err != nil {
+			return fmt.Errorf("FollowersOnly error (GetProfile): %w", err)
+		}
+		if profile.Viewer.FollowedBy == "" {
+			return &UserError{Message: "only followers can use this command", Err: ErrPermissionDenied}
+		}
+		return nil
+	}
+}
+
+// Only allow the given accounts (DIDs).
+func Allowlist(dids ...string) Permission {
+	return func(ctx context.Context, inv *Invocation) error {
+		if !slices.Contains(dids, inv.Author) {
+			return &UserError{Message: "you are not allowed to use this command", Err: ErrPermissionDenied}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,54 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestPermissions(t *testing.T) {
+	client := newTestClient(t, &standIn{followers: []string{"did:plc:alice"}})
+	tests := []struct {
+		name       string
+		permission Permission
+		author     string
+		wantDenied bool
+		wantErr    bool // the check itself failed
+	}{
+		{name: "allowlisted", permission: Allowlist("did:plc:alice", "did:plc:bob"), author: "did:plc:bob"},
+		{name: "not allowlisted", permission: Allowlist("did:plc:alice"), author: "did:plc:mallory", wantDenied: true},
+		{name: "empty allowlist", permission: Allowlist(), author: "did:plc:alice", wantDenied: true},
+		{name: "follower", permission: FollowersOnly(), author: "did:plc:alice"},
+		{name: "not following", permission: FollowersOnly(), author: "did:plc:bob", wantDenied: true},
+		{name: "profile lookup failed", permission: FollowersOnly(), author: "did:plc:unknown", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.permission(context.Background(), &Invocation{Client: client, Author: tt.author})
+			var userErr *UserError
+			denied := errors.As(err, &userErr) && errors.Is(err, ErrPermissionDenied)
+			if denied != tt.wantDenied || (err != nil && !denied) != tt.wantErr {
+				t.Errorf("permission error = %v, want denied %v, failed %v", err, tt.wantDenied, tt.wantErr)
+			}
+		})
+	}
+}
+
+// Denied invocations are answered and don't run the handler.
+func TestPermissionDeniedReply(t *testing.T) {
+	s := &standIn{}
+	client := newTestClient(t, s)
+	router := NewRouter()
+	ran := false
+	router.Register(Command{
+		Name:        "admin",
+		Permissions: []Permission{Allowlist("did:plc:alice")},
+		Handler:     func(ctx context.Context, inv *Invocation) error { ran = true; return nil },
+	})
+	if err := sendMessage(client, router, "did:plc:mallory", "/admin"); err != nil {
+		t.Fatal(err)
+	}
+	if replies := s.takeReplies(); ran || len(replies) != 1 || replies[0] != "you are not allowed to use this command" {
+		t.Errorf("handler ran: %v, replied %q", ran, replies)
+	}
+}
@@ -0,0 +1,48 @@
+package identity
+
+import (
+	"sync"
+	"time"
+)
+
+type cacheEntry[V any] struct {
+	value   V
+	expires time.Time
+}
+
+// Simple thread-safe map with per-entry expiry.
+type ttlCache[V any] struct {
+	mutex   sync.Mutex
+	entries map[string]cacheEntry[V]
+}
+
+func newTTLCache[V any]() *ttlCache[V] {
+	return &ttlCache[V]{entries: make(map[string]cacheEntry[V])}
+}
+
+func (c *ttlCache[V]) get(key string) (V, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		var zero V
+		return zero, false
+	}
+	return entry.value, true
+}
+
+func (c *ttlCache[V]) set(key string, value V, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.entries[key] = cacheEntry[V]{value: value, expires: time.Now().Add(ttl)}
+}
+
+func (c *ttlCache[V]) delete(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.entries, key)
+}
@@ -0,0 +1,134 @@
+package identity
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/davhofer/indigo/atproto/crypto"
+	"github.com/mr-tron/base58"
+)
+
+// A DID document, containing the fields relevant for atproto.
+type DIDDocument struct {
+	ID                 string               `json:"id"`
+	AlsoKnownAs        []string             `json:"alsoKnownAs,omitempty"`
+	VerificationMethod []VerificationMethod `json:"verificationMethod,omitempty"`
+	Service            []Service            `json:"service,omitempty"`
+}
+
+// A public key listed in a DID document.
+type VerificationMethod struct {
+	ID                 string `json:"id"`
+	Type               string `json:"type"`
+	Controller         string `json:"controller"`
+	PublicKeyMultibase string `json:"publicKeyMultibase"`
+}
+
+// A service endpoint listed in a DID document (e.g. the account's PDS).
+type Service struct {
+	ID              string `json:"id"`
+	Type            string `json:"type"`
+	ServiceEndpoint string `json:"serviceEndpoint"`
+}
+
+// Accept both plain string endpoints and the (unused by atproto) map/list forms, which are ignored.
+func (s *Service) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		ID              string          `json:"id"`
+		Type            string          `json:"type"`
+		ServiceEndpoint json.RawMessage `json:"serviceEndpoint"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	s.ID = raw.ID
+	s.Type = raw.Type
+	s.ServiceEndpoint = ""
+	var endpoint string
+	if err := json.Unmarshal(raw.ServiceEndpoint, &endpoint); err == nil {
+		s.ServiceEndpoint = endpoint
+	}
+	return nil
+}
+
+// Check whether a document entry id (either "#fragment" or "did:...#fragment") refers to the given fragment.
+func (d *DIDDocument) matchesFragment(id string, fragment string) bool {
+	return id == "#"+fragment || id == d.ID+"#"+fragment
+}
+
+// Get the endpoint url of the service with the given id fragment (e.g. "atproto_pds").
+func (d *DIDDocument) ServiceEndpoint(fragment string) (string, bool) {
+	for _, s := range d.Service {
+		if d.matchesFragment(s.ID, fragment) && s.ServiceEndpoint != "" {
+			return strings.TrimSuffix(s.ServiceEndpoint, "/"), true
+		}
+	}
+	return "", false
+}
+
+// Get the url of the account's PDS.
+func (d *DIDDocument) PDSEndpoint() (string, error) {
+	endpoint, ok := d.ServiceEndpoint("atproto_pds")
+	if !ok {
+		return "", fmt.Errorf("PDSEndpoint error: %w", ErrNoPDSEndpoint)
+	}
+	if !strings.HasPrefix(endpoint, "https://") && !strings.HasPrefix(endpoint, "http://") {
+		return "", fmt.Errorf("PDSEndpoint error: invalid endpoint url %q", endpoint)
+	}
+	return endpoint, nil
+}
+
+// Get the atproto signing key of the account (multibase encoded).
+func (d *DIDDocument) SigningKey() (VerificationMethod, error) {
+	for _, vm := range d.VerificationMethod {
+		if d.matchesFragment(vm.ID, "atproto") && vm.PublicKeyMultibase != "" {
+			return vm, nil
+		}
+	}
+	return VerificationMethod{}, fmt.Errorf("SigningKey error: %w", ErrNoSigningKey)
+}
+
+// Get the handles the account claims, i.e. the at:// entries in alsoKnownAs.
+//
+// Note that these are not verified, use Resolver.LookupDID to get a verified handle.
+func (d *DIDDocument) Handles() []string {
+	var handles []string
+	for _, aka := range d.AlsoKnownAs {
+		if strings.HasPrefix(aka, "at://") {
+			handles = append(handles, strings.ToLower(strings.TrimPrefix(aka, "at://")))
+		}
+	}
+	return handles
+}
+
+// Get the primary (first) handle declared in the document, or an empty string if there is none.
+func (d *DIDDocument) DeclaredHandle() string {
+	handles := d.Handles()
+	if len(handles) == 0 {
+		return ""
+	}
+	return handles[0]
+}
+
+// Parse the public key. Supports Multikey as well as the legacy verification method types.
+func (vm VerificationMethod) PublicKey() (crypto.PublicKey, error) {
+	switch vm.Type {
+	case "Multikey":
+		return crypto.ParsePublicMultibase(vm.PublicKeyMultibase)
+	case "EcdsaSecp256k1VerificationKey2019", "EcdsaSecp256r1VerificationKey2019":
+		if !strings.HasPrefix(vm.PublicKeyMultibase, "z") {
+			return nil, fmt.Errorf("PublicKey error: unsupported multibase encoding")
+		}
+		keyBytes, err := base58.Decode(vm.PublicKeyMultibase[1:])
+		if err != nil {
+			return nil, fmt.Errorf("PublicKey error (base58.Decode): %v", err)
+		}
+		if vm.Type == "EcdsaSecp256k1VerificationKey2019" {
+			return crypto.ParsePublicUncompressedBytesK256(keyBytes)
+		}
+		return crypto.ParsePublicUncompressedBytesP256(keyBytes)
+	default:
+		return nil, fmt.Errorf("PublicKey error: unsupported verification method type %q", vm.Type)
+	}
+}
@@ -0,0 +1,273 @@
+// Package identity resolves atproto identities: DIDs (did:plc and did:web) to DID documents, and handles to DIDs.
+//
+// Handles are verified bidirectionally, i.e. a handle is only trusted if it resolves to a DID whose
+// document claims the handle in return.
+package identity
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const DefaultPLCDirectory = "https://plc.directory"
+
+// Handle used for accounts whose handle cannot be verified.
+const HandleInvalid = "handle.invalid"
+
+var (
+	ErrDIDNotFound          = errors.New("DID not found")
+	ErrHandleNotFound       = errors.New("handle not found")
+	ErrHandleMismatch       = errors.New("handle and DID document do not match")
+	ErrUnsupportedDIDMethod = errors.New("unsupported DID method")
+	ErrNoPDSEndpoint        = errors.New("DID document has no PDS endpoint")
+	ErrNoSigningKey         = errors.New("DID document has no atproto signing key")
+)
+
+// Resolves TXT records. Implemented by *net.Resolver; can be replaced e.g. for testing.
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// A resolved account identity.
+type Identity struct {
+	Did            string
+	Handle         string // the verified handle, or HandleInvalid if the handle could not be verified
+	PDSEndpoint    string // url of the account's PDS, empty if the document doesn't specify one
+	SigningKey     VerificationMethod
+	Document       *DIDDocument
+	HandleVerified bool
+}
+
+// Resolver for DIDs and handles, with a TTL cache.
+//
+// The zero value is not usable, create a Resolver with NewResolver.
+type Resolver struct {
+	PLCDirectory string        // base url of the PLC directory used to resolve did:plc
+	HTTPClient   *http.Client  // used for the PLC directory, did:web and /.well-known/atproto-did requests
+	DNS          TXTResolver   // used to resolve handles via _atproto TXT records
+	CacheTTL     time.Duration // how long resolved DIDs and handles are cached. Set to 0 to disable caching
+
+	didCache    *ttlCache[*DIDDocument]
+	handleCache *ttlCache[string]
+}
+
+// Creates a resolver using the public PLC directory, the default DNS resolver, and a one hour cache.
+func NewResolver(httpClient *http.Client) *Resolver {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &Resolver{
+		PLCDirectory: DefaultPLCDirectory,
+		HTTPClient:   httpClient,
+		DNS:          net.DefaultResolver,
+		CacheTTL:     time.Hour,
+		didCache:     newTTLCache[*DIDDocument](),
+		handleCache:  newTTLCache[string](),
+	}
+}
+
+// Normalize a handle: strip a leading @ and lowercase.
+func NormalizeHandle(handle string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(handle), "@"))
+}
+
+// Remove the given handle or DID from the cache, e.g. after an account changed its handle or PDS.
+func (r *Resolver) Purge(handleOrDid string) {
+	if strings.HasPrefix(handleOrDid, "did:") {
+		r.didCache.delete(handleOrDid)
+	} else {
+		r.handleCache.delete(NormalizeHandle(handleOrDid))
+	}
+}
+
+// Resolve a DID to its DID document. Supports did:plc and did:web.
+func (r *Resolver) ResolveDID(ctx context.Context, did string) (*DIDDocument, error) {
+	if doc, ok := r.didCache.get(did); ok {
+		return doc, nil
+	}
+
+	var docUrl string
+	switch {
+	case strings.HasPrefix(did, "did:plc:"):
+		docUrl = strings.TrimSuffix(r.PLCDirectory, "/") + "/" + did
+	case strings.HasPrefix(did, "did:web:"):
+		// atproto only supports hostname-level did:web, without paths
+		hostname, err := url.PathUnescape(strings.TrimPrefix(did, "did:web:"))
+		if err != nil || hostname == "" || strings.Contains(hostname, ":") && !strings.HasPrefix(hostname, "localhost:") {
+			return nil, fmt.Errorf("ResolveDID error: invalid did:web %q", did)
+		}
+		scheme := "https"
+		if hostname == "localhost" || strings.HasPrefix(hostname, "localhost:") {
+			scheme = "http"
+		}
+		docUrl = scheme + "://" + hostname + "/.well-known/did.json"
+	default:
+		return nil, fmt.Errorf("ResolveDID error: %w: %s", ErrUnsupportedDIDMethod, did)
+	}
+
+	body, err := r.httpGet(ctx, docUrl, 1<<20)
+	if err != nil {
+		return nil, fmt.Errorf("ResolveDID error: %w", err)
+	}
+	if body == nil {
+		return nil, fmt.Errorf("ResolveDID error: %w: %s", ErrDIDNotFound, did)
+	}
+
+	var doc DIDDocument
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, fmt.Errorf("ResolveDID error (json.Unmarshal): %v", err)
+	}
+	if doc.ID != did {
+		return nil, fmt.Errorf("ResolveDID error: document id %q does not match %q", doc.ID, did)
+	}
+
+	r.didCache.set(did, &doc, r.CacheTTL)
+	return &doc, nil
+}
+
+// Resolve a handle to a DID, using DNS TXT records with a fallback to HTTPS (/.well-known/atproto-did).
+//
+// The result is not verified against the DID document, use LookupHandle for that.
+func (r *Resolver) ResolveHandle(ctx context.Context, handle string) (string, error) {
+	handle = NormalizeHandle(handle)
+	if strings.HasPrefix(handle, "did:") {
+		return handle, nil
+	}
+	if handle == "" || handle == HandleInvalid {
+		return "", fmt.Errorf("ResolveHandle error: %w: %q", ErrHandleNotFound, handle)
+	}
+	if did, ok := r.handleCache.get(handle); ok {
+		return did, nil
+	}
+
+	did, dnsErr := r.resolveHandleDNS(ctx, handle)
+	if dnsErr != nil {
+		var httpErr error
+		did, httpErr = r.resolveHandleHTTPS(ctx, handle)
+		if httpErr != nil {
+			return "", fmt.Errorf("ResolveHandle error: %w: %s (dns: %v, https: %v)", ErrHandleNotFound, handle, dnsErr, httpErr)
+		}
+	}
+
+	r.handleCache.set(handle, did, r.CacheTTL)
+	return did, nil
+}
+
+func (r *Resolver) resolveHandleDNS(ctx context.Context, handle string) (string, error) {
+	records, err := r.DNS.LookupTXT(ctx, "_atproto."+handle)
+	if err != nil {
+		return "", err
+	}
+	var did string
+	for _, record := range records {
+		if value, ok := strings.CutPrefix(record, "did="); ok {
+			if did != "" && did != value {
+				return "", fmt.Errorf("multiple conflicting DIDs in TXT records")
+			}
+			did = strings.TrimSpace(value)
+		}
+	}
+	if !strings.HasPrefix(did, "did:") {
+		return "", fmt.Errorf("no DID in TXT records")
+	}
+	return did, nil
+}
+
+func (r *Resolver) resolveHandleHTTPS(ctx context.Context, handle string) (string, error) {
+	body, err := r.httpGet(ctx, "https://"+handle+"/.well-known/atproto-did", 2048)
+	if err != nil {
+		return "", err
+	}
+	did := strings.TrimSpace(string(body))
+	if !strings.HasPrefix(did, "did:") {
+		return "", fmt.Errorf("no DID in /.well-known/atproto-did")
+	}
+	return did, nil
+}
+
+// Perform a GET request and return the body. Returns a nil body (and no error) for 404 and 410 responses.
+func (r *Resolver) httpGet(ctx context.Context, url string, maxBytes int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxBytes))
+}
+
+// Resolve a handle to a full identity. Fails if the DID document doesn't claim the handle.
+func (r *Resolver) LookupHandle(ctx context.Context, handle string) (*Identity, error) {
+	handle = NormalizeHandle(handle)
+	did, err := r.ResolveHandle(ctx, handle)
+	if err != nil {
+		return nil, fmt.Errorf("LookupHandle error: %w", err)
+	}
+	doc, err := r.ResolveDID(ctx, did)
+	if err != nil {
+		return nil, fmt.Errorf("LookupHandle error: %w", err)
+	}
+	for _, claimed := range doc.Handles() {
+		if claimed == handle {
+			return newIdentity(doc, handle, true), nil
+		}
+	}
+	return nil, fmt.Errorf("LookupHandle error: %w: %s does not claim %s", ErrHandleMismatch, did, handle)
+}
+
+// Resolve a DID to a full identity. If the declared handle doesn't resolve back to the DID, the handle is set to HandleInvalid.
+func (r *Resolver) LookupDID(ctx context.Context, did string) (*Identity, error) {
+	doc, err := r.ResolveDID(ctx, did)
+	if err != nil {
+		return nil, fmt.Errorf("LookupDID error: %w", err)
+	}
+	handle := doc.DeclaredHandle()
+	if handle != "" {
+		if resolved, err := r.ResolveHandle(ctx, handle); err == nil && resolved == did {
+			return newIdentity(doc, handle, true), nil
+		}
+	}
+	return newIdentity(doc, HandleInvalid, false), nil
+}
+
+// Resolve a handle or DID to a full identity.
+func (r *Resolver) Lookup(ctx context.Context, handleOrDid string) (*Identity, error) {
+	handleOrDid = strings.TrimPrefix(strings.TrimSpace(handleOrDid), "@")
+	if strings.HasPrefix(handleOrDid, "did:") {
+		return r.LookupDID(ctx, handleOrDid)
+	}
+	return r.LookupHandle(ctx, handleOrDid)
+}
+
+func newIdentity(doc *DIDDocument, handle string, verified bool) *Identity {
+	ident := &Identity{
+		Did:            doc.ID,
+		Handle:         handle,
+		Document:       doc,
+		HandleVerified: verified,
+	}
+	if endpoint, err := doc.PDSEndpoint(); err == nil {
+		ident.PDSEndpoint = endpoint
+	}
+	if key, err := doc.SigningKey(); err == nil {
+		ident.SigningKey = key
+	}
+	return ident
+}
@@ -0,0 +1,281 @@
+package identity
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeDNS map[string][]string
+
+func (d fakeDNS) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	records, ok := d[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return records, nil
+}
+
+func testDocument(did string, handle string) *DIDDocument {
+	doc := &DIDDocument{
+		ID: did,
+		Service: []Service{
+			{ID: "#atproto_pds", Type: "AtprotoPersonalDataServer", ServiceEndpoint: "https://pds.example.com/"},
+		},
+	}
+	if handle != "" {
+		doc.AlsoKnownAs = []string{"at://" + handle}
+	}
+	return doc
+}
+
+type testEnv struct {
+	resolver *Resolver
+	webDid   string // did:web of the local stand-in
+	hits     atomic.Int64
+}
+
+// Set up a resolver against local stand-ins: a PLC directory / did:web host, and an HTTPS server for
+// /.well-known/atproto-did which answers for every hostname.
+func newTestEnv(t *testing.T, dns fakeDNS, wellKnown map[string]string) *testEnv {
+	t.Helper()
+	env := &testEnv{}
+	docs := map[string]*DIDDocument{
+		"did:plc:alice":    testDocument("did:plc:alice", "alice.test"),
+		"did:plc:bob":      testDocument("did:plc:bob", "bob.test"),
+		"did:plc:mallory":  testDocument("did:plc:mallory", "alice.test"),
+		"did:plc:imposter": testDocument("did:plc:other", ""),
+	}
+
+	plc := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.hits.Add(1)
+		if r.URL.Path == "/.well-known/did.json" {
+			json.NewEncoder(w).Encode(testDocument(env.webDid, "web.test"))
+			return
+		}
+		doc, ok := docs[strings.TrimPrefix(r.URL.Path, "/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(doc)
+	}))
+	t.Cleanup(plc.Close)
+	u, _ := url.Parse(plc.URL)
+	env.webDid = "did:web:" + url.PathEscape("localhost:"+u.Port())
+
+	web := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.hits.Add(1)
+		did, ok := wellKnown[r.Host]
+		if !ok || r.URL.Path != "/.well-known/atproto-did" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(did + "\n"))
+	}))
+	t.Cleanup(web.Close)
+
+	// plain requests go to the PLC stand-in, TLS requests (any hostname) to the well-known stand-in
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return tls.Dial(network, web.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		},
+	}
+	resolver := NewResolver(&http.Client{Transport: transport, Timeout: 5 * time.Second})
+	resolver.PLCDirectory = plc.URL
+	resolver.DNS = dns
+	env.resolver = resolver
+	return env
+}
+
+func TestResolveDID(t *testing.T) {
+	env := newTestEnv(t, fakeDNS{}, nil)
+	tests := []struct {
+		name    string
+		did     string
+		handle  string
+		wantErr error
+		anyErr  bool
+	}{
+		{name: "did:plc", did: "did:plc:alice", handle: "alice.test"},
+		{name: "did:plc not found", did: "did:plc:nobody", wantErr: ErrDIDNotFound},
+		{name: "did:plc id mismatch", did: "did:plc:imposter", anyErr: true},
+		{name: "did:web", did: env.webDid, handle: "web.test"},
+		{name: "did:web with path", did: "did:web:example.com:user:alice", anyErr: true},
+		{name: "unsupported method", did: "did:key:z6Mk", wantErr: ErrUnsupportedDIDMethod},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := env.resolver.ResolveDID(context.Background(), tt.did)
+			switch {
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("ResolveDID(%q) error = %v, want %v", tt.did, err, tt.wantErr)
+				}
+				return
+			case tt.anyErr:
+				if err == nil {
+					t.Fatalf("ResolveDID(%q) succeeded, want error", tt.did)
+				}
+				return
+			case err != nil:
+				t.Fatalf("ResolveDID(%q) error = %v", tt.did, err)
+			}
+			if doc.ID != tt.did || doc.DeclaredHandle() != tt.handle {
+				t.Errorf("ResolveDID(%q) = %q (handle %q), want handle %q", tt.did, doc.ID, doc.DeclaredHandle(), tt.handle)
+			}
+			if endpoint, err := doc.PDSEndpoint(); err != nil || endpoint != "https://pds.example.com" {
+				t.Errorf("PDSEndpoint() = %q, %v", endpoint, err)
+			}
+		})
+	}
+}
+
+func TestResolveHandle(t *testing.T) {
+	dns := fakeDNS{
+		"_atproto.alice.test":    {"did=did:plc:alice"},
+		"_atproto.conflict.test": {"did=did:plc:alice", "did=did:plc:bob"},
+		"_atproto.garbage.test":  {"v=spf1 -all"},
+	}
+	wellKnown := map[string]string{
+		"bob.test":      "did:plc:bob",
+		"conflict.test": "did:plc:bob",
+		"garbage.test":  "not a did",
+	}
+	tests := []struct {
+		name    string
+		handle  string
+		want    string
+		wantErr error
+	}{
+		{name: "DNS TXT", handle: "alice.test", want: "did:plc:alice"},
+		{name: "normalized", handle: "@Alice.Test", want: "did:plc:alice"},
+		{name: "well-known fallback", handle: "bob.test", want: "did:plc:bob"},
+		{name: "conflicting TXT falls back", handle: "conflict.test", want: "did:plc:bob"},
+		{name: "neither", handle: "garbage.test", wantErr: ErrHandleNotFound},
+		{name: "unknown", handle: "nobody.test", wantErr: ErrHandleNotFound},
+		{name: "invalid handle", handle: HandleInvalid, wantErr: ErrHandleNotFound},
+		{name: "DID passthrough", handle: "did:plc:alice", want: "did:plc:alice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t, dns, wellKnown)
+			did, err := env.resolver.ResolveHandle(context.Background(), tt.handle)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("ResolveHandle(%q) error = %v, want %v", tt.handle, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || did != tt.want {
+				t.Fatalf("ResolveHandle(%q) = %q, %v, want %q", tt.handle, did, err, tt.want)
+			}
+		})
+	}
+
+	t.Run("DNS preferred over well-known", func(t *testing.T) {
+		env := newTestEnv(t, dns, map[string]string{"alice.test": "did:plc:bob"})
+		did, err := env.resolver.ResolveHandle(context.Background(), "alice.test")
+		if err != nil || did != "did:plc:alice" {
+			t.Fatalf("ResolveHandle = %q, %v, want did:plc:alice", did, err)
+		}
+		if hits := env.hits.Load(); hits != 0 {
+			t.Errorf("well-known was requested %d times, want 0", hits)
+		}
+	})
+}
+
+func TestLookup(t *testing.T) {
+	dns := fakeDNS{
+		"_atproto.alice.test": {"did=did:plc:alice"},
+		"_atproto.bob.test":   {"did=did:plc:alice"}, // claimed by bob's document, but points to alice
+		"_atproto.eve.test":   {"did=did:plc:mallory"},
+	}
+	tests := []struct {
+		name         string
+		handleOrDid  string
+		wantDid      string
+		wantHandle   string
+		wantVerified bool
+		wantErr      error
+	}{
+		{name: "handle", handleOrDid: "alice.test", wantDid: "did:plc:alice", wantHandle: "alice.test", wantVerified: true},
+		{name: "DID", handleOrDid: "did:plc:alice", wantDid: "did:plc:alice", wantHandle: "alice.test", wantVerified: true},
+		{name: "handle not claimed by document", handleOrDid: "eve.test", wantErr: ErrHandleMismatch},
+		{name: "declared handle resolves elsewhere", handleOrDid: "did:plc:bob", wantDid: "did:plc:bob", wantHandle: HandleInvalid},
+		{name: "declared handle claimed by another DID", handleOrDid: "did:plc:mallory", wantDid: "did:plc:mallory", wantHandle: HandleInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t, dns, nil)
+			ident, err := env.resolver.Lookup(context.Background(), tt.handleOrDid)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("Lookup(%q) error = %v, want %v", tt.handleOrDid, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Lookup(%q) error = %v", tt.handleOrDid, err)
+			}
+			if ident.Did != tt.wantDid || ident.Handle != tt.wantHandle || ident.HandleVerified != tt.wantVerified {
+				t.Errorf("Lookup(%q) = %s %s verified=%v, want %s %s verified=%v", tt.handleOrDid,
+					ident.Did, ident.Handle, ident.HandleVerified, tt.wantDid, tt.wantHandle, tt.wantVerified)
+			}
+			if ident.PDSEndpoint != "https://pds.example.com" {
+				t.Errorf("PDSEndpoint = %q", ident.PDSEndpoint)
+			}
+		})
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	tests := []struct {
+		name     string
+		ttl      time.Duration
+		wait     time.Duration
+		wantHits int64
+	}{
+		{name: "cached", ttl: time.Minute, wantHits: 2},
+		{name: "expired", ttl: 20 * time.Millisecond, wait: 50 * time.Millisecond, wantHits: 4},
+		{name: "disabled", ttl: 0, wantHits: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := newTestEnv(t, fakeDNS{}, map[string]string{"bob.test": "did:plc:bob"})
+			env.resolver.CacheTTL = tt.ttl
+			for i := 0; i < 2; i++ {
+				if _, err := env.resolver.ResolveDID(context.Background(), "did:plc:alice"); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := env.resolver.ResolveHandle(context.Background(), "bob.test"); err != nil {
+					t.Fatal(err)
+				}
+				time.Sleep(tt.wait)
+			}
+			if hits := env.hits.Load(); hits != tt.wantHits {
+				t.Errorf("requests = %d, want %d", hits, tt.wantHits)
+			}
+		})
+	}
+
+	t.Run("purge", func(t *testing.T) {
+		env := newTestEnv(t, fakeDNS{}, nil)
+		env.resolver.ResolveDID(context.Background(), "did:plc:alice")
+		env.resolver.Purge("did:plc:alice")
+		env.resolver.ResolveDID(context.Background(), "did:plc:alice")
+		if hits := env.hits.Load(); hits != 2 {
+			t.Errorf("requests = %d, want 2", hits)
+		}
+	})
+}
@@ -0,0 +1,262 @@
+// Package instrumentation provides opt-in OpenTelemetry tracing and Prometheus metrics for botsky clients and listeners.
+//
+// The package is a separate module (github.com/davhofer/botsky/pkg/instrumentation), so OpenTelemetry and Prometheus
+// are only pulled in by depending on it:
+//
+//	inst, err := instrumentation.New()
+//	client, err := botsky.NewClient(ctx, handle, appkey, inst.ClientOption())
+//	inst.RegisterClient(client)
+//	listener.SetObserver(inst)
+package instrumentation
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davhofer/botsky/pkg/botsky"
+	"github.com/davhofer/botsky/pkg/listeners"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/davhofer/botsky"
+
+var _ listeners.Observer = (*Instrumentation)(nil)
+
+// Traces and collects metrics of XRPC calls, listener polls and handler invocations.
+//
+// Implements listeners.Observer.
+type Instrumentation struct {
+	tracer trace.Tracer
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	polls           *prometheus.CounterVec
+	events          *prometheus.CounterVec
+	handlerDuration *prometheus.HistogramVec
+	handlerFailures *prometheus.CounterVec
+	rateLimit       *rateLimitCollector
+}
+
+type options struct {
+	tracerProvider trace.TracerProvider
+	registerer     prometheus.Registerer
+	namespace      string
+}
+
+// Option configures the Instrumentation, see New.
+type Option func(*options)
+
+// Create spans with the given provider. Default: the global provider (otel.GetTracerProvider()).
+func WithTracerProvider(provider trace.TracerProvider) Option {
+	return func(o *options) {
+		o.tracerProvider = provider
+	}
+}
+
+// Register the metrics with the given registerer. Default: prometheus.DefaultRegisterer.
+func WithRegisterer(registerer prometheus.Registerer) Option {
+	return func(o *options) {
+		o.registerer = registerer
+	}
+}
+
+// Prefix the metric names with the given namespace. Default: "botsky".
+func WithNamespace(namespace string) Option {
+	return func(o *options) {
+		o.namespace = namespace
+	}
+}
+
+// Set up the instrumentation and register its metrics.
+func New(opts ...Option) (*Instrumentation, error) {
+	o := options{
+		tracerProvider: otel.GetTracerProvider(),
+		registerer:     prometheus.DefaultRegisterer,
+		namespace:      "botsky",
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	i := &Instrumentation{
+		tracer: o.tracerProvider.Tracer(tracerName),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: o.namespace,
+			Name:      "xrpc_requests_total",
+			Help:      "XRPC requests by NSID and response status (0 if the request failed without a response).",
+		}, []string{"nsid", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: o.namespace,
+			Name:      "xrpc_request_duration_seconds",
+			Help:      "Latency of XRPC requests by NSID, including retries.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"nsid"}),
+		polls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: o.namespace,
+			Name:      "listener_polls_total",
+			Help:      "Listener polls by listener and result (ok or error).",
+		}, []string{"listener", "result"}),
+		events: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: o.namespace,
+			Name:      "listener_events_total",
+			Help:      "Events polled by listener.",
+		}, []string{"listener"}),
+		handlerDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: o.namespace,
+			Name:      "handler_duration_seconds",
+			Help:      "Duration of handler invocations by listener and handler id.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"listener", "handler"}),
+		handlerFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: o.namespace,
+			Name:      "handler_failures_total",
+			Help:      "Failed handler invocations by listener and handler id.",
+		}, []string{"listener", "handler"}),
+		rateLimit: &rateLimitCollector{
+			desc: prometheus.NewDesc(
+				prometheus.BuildFQName(o.namespace, "", "ratelimit_remaining"),
+				"Remaining rate limit budget reported by the server, by account and endpoint class.",
+				[]string{"account", "class"}, nil,
+			),
+		},
+	}
+
+	for _, collector := range []prometheus.Collector{
+		i.requests, i.requestDuration, i.polls, i.events, i.handlerDuration, i.handlerFailures, i.rateLimit,
+	} {
+		if err := o.registerer.Register(collector); err != nil {
+			return nil, fmt.Errorf("instrumentation.New error (Register): %w", err)
+		}
+	}
+	return i, nil
+}
+
+// Client option adding the XRPC tracing and metrics middleware.
+func (i *Instrumentation) ClientOption() botsky.Option {
+	return botsky.WithMiddleware(i.Middleware)
+}
+
+// Report the rate limit budget of the client in the ratelimit_remaining metric.
+func (i *Instrumentation) RegisterClient(client *botsky.Client) {
+	i.rateLimit.add(client)
+}
+
+// Wrap the transport, creating a span and recording metrics for every XRPC request.
+func (i *Instrumentation) Middleware(base http.RoundTripper) http.RoundTripper {
+	return &transport{base: base, instrumentation: i}
+}
+
+type transport struct {
+	base            http.RoundTripper
+	instrumentation *Instrumentation
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	nsid := strings.TrimPrefix(req.URL.Path, "/xrpc/")
+	ctx, span := t.instrumentation.tracer.Start(req.Context(), nsid,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("rpc.system", "xrpc"),
+			attribute.String("rpc.method", nsid),
+			attribute.String("http.request.method", req.Method),
+			attribute.String("server.address", req.URL.Host),
+		),
+	)
+	defer span.End()
+
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	t.instrumentation.requestDuration.WithLabelValues(nsid).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		t.instrumentation.requests.WithLabelValues(nsid, "0").Inc()
+		return resp, err
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode >= 400 {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	t.instrumentation.requests.WithLabelValues(nsid, strconv.Itoa(resp.StatusCode)).Inc()
+	return resp, nil
+}
+
+// Trace a listener poll and count the polled events.
+func (i *Instrumentation) ObservePoll(ctx context.Context, listener string, poll func(context.Context) (int, error)) error {
+	ctx, span := i.tracer.Start(ctx, listener+" poll", trace.WithAttributes(attribute.String("botsky.listener", listener)))
+	defer span.End()
+
+	count, err := poll(ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		i.polls.WithLabelValues(listener, "error").Inc()
+		return err
+	}
+	span.SetAttributes(attribute.Int("botsky.events", count))
+	i.polls.WithLabelValues(listener, "ok").Inc()
+	i.events.WithLabelValues(listener).Add(float64(count))
+	return nil
+}
+
+// Trace a handler invocation and record its duration and failure.
+func (i *Instrumentation) ObserveHandler(ctx context.Context, listener string, handler string, events int, handle func(context.Context) error) {
+	ctx, span := i.tracer.Start(ctx, listener+" handler "+handler, trace.WithAttributes(
+		attribute.String("botsky.listener", listener),
+		attribute.String("botsky.handler", handler),
+		attribute.Int("botsky.events", events),
+	))
+	defer span.End()
+
+	start := time.Now()
+	err := handle(ctx)
+	i.handlerDuration.WithLabelValues(listener, handler).Observe(time.Since(start).Seconds())
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		i.handlerFailures.WithLabelValues(listener, handler).Inc()
+	}
+}
+
+// Collects the rate limit budget of the registered clients when scraped.
+type rateLimitCollector struct {
+	desc    *prometheus.Desc
+	mutex   sync.Mutex
+	clients []*botsky.Client
+}
+
+func (c *rateLimitCollector) add(client *botsky.Client) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.clients = append(c.clients, client)
+}
+
+func (c *rateLimitCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *rateLimitCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.Lock()
+	clients := append([]*botsky.Client{}, c.clients...)
+	c.mutex.Unlock()
+
+	for _, client := range clients {
+		for class, status := range client.RateLimitStatus() {
+			if status.Limit == 0 {
+				// no response with rate limit headers yet
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(status.Remaining), client.Handle, string(class))
+		}
+	}
+}
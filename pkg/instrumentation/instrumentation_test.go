@@ -0,0 +1,82 @@
+package instrumentation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/davhofer/botsky/pkg/botsky"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestInstrumentation(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	spans := tracetest.NewSpanRecorder()
+	inst, err := New(WithRegisterer(registry), WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans))), WithNamespace("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the metrics can't be registered twice
+	if _, err := New(WithRegisterer(registry), WithNamespace("test")); err == nil {
+		t.Error("second New with the same registerer succeeded")
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"did": "did:plc:alice", "handle": "alice.test"})
+	}))
+	defer server.Close()
+	client, err := botsky.NewClient(context.Background(), "did:plc:bot", "",
+		botsky.WithEagerDIDResolution(false),
+		botsky.WithoutLogging(),
+		botsky.WithAppViewHost(server.URL),
+		inst.ClientOption(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	inst.RegisterClient(client)
+
+	if _, err := client.GetProfile(context.Background(), "did:plc:alice"); err != nil {
+		t.Fatal(err)
+	}
+	inst.ObservePoll(context.Background(), "notifications", func(ctx context.Context) (int, error) { return 3, nil })
+	inst.ObservePoll(context.Background(), "notifications", func(ctx context.Context) (int, error) { return 0, errors.New("offline") })
+	inst.ObserveHandler(context.Background(), "notifications", "reply", 3, func(ctx context.Context) error { return errors.New("failed") })
+
+	counters := []struct {
+		name      string
+		collector prometheus.Collector
+		want      float64
+	}{
+		{"xrpc requests", inst.requests.WithLabelValues("app.bsky.actor.getProfile", "200"), 1},
+		{"successful polls", inst.polls.WithLabelValues("notifications", "ok"), 1},
+		{"failed polls", inst.polls.WithLabelValues("notifications", "error"), 1},
+		{"events", inst.events.WithLabelValues("notifications"), 3},
+		{"handler failures", inst.handlerFailures.WithLabelValues("notifications", "reply"), 1},
+	}
+	for _, counter := range counters {
+		if got := testutil.ToFloat64(counter.collector); got != counter.want {
+			t.Errorf("%s = %v, want %v", counter.name, got, counter.want)
+		}
+	}
+	if n, err := testutil.GatherAndCount(registry, "test_xrpc_request_duration_seconds", "test_handler_duration_seconds"); err != nil || n != 2 {
+		t.Errorf("gathered %d duration histograms, %v, want 2", n, err)
+	}
+
+	names := map[string]bool{}
+	for _, span := range spans.Ended() {
+		names[span.Name()] = true
+	}
+	for _, name := range []string{"app.bsky.actor.getProfile", "notifications poll", "notifications handler reply"} {
+		if !names[name] {
+			t.Errorf("no span %q, got %v", name, names)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// Package boltstore provides a listeners.CheckpointStore backed by a bbolt database.
+//
+// It lives in its own package, so bbolt is only pulled in by bots using it.
+package boltstore
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/davhofer/botsky/pkg/listeners"
+	bolt "go.etcd.io/bbolt"
+)
+
+var bucket = []byte("botsky-checkpoints")
+
+var _ listeners.CheckpointStore = (*CheckpointStore)(nil)
+
+// CheckpointStore keeping the checkpoints in a bucket of a bbolt database.
+type CheckpointStore struct {
+	db    *bolt.DB
+	owned bool // whether the database was opened by the store, and is closed by Close
+}
+
+// Open (or create) the database at path.
+func Open(path string) (*CheckpointStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("boltstore.Open error (bolt.Open): %w", err)
+	}
+	return &CheckpointStore{db: db, owned: true}, nil
+}
+
+// Use an already opened database, e.g. one shared with other parts of the bot.
+func New(db *bolt.DB) *CheckpointStore {
+	return &CheckpointStore{db: db}
+}
+
+func (s *CheckpointStore) Load(ctx context.Context, key string) ([]byte, error) {
+	var checkpoint []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b == nil {
+			return nil
+		}
+		if value := b.Get([]byte(key)); value != nil {
+			// only valid during the transaction
+			checkpoint = append([]byte{}, value...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("CheckpointStore.Load error (View): %w", err)
+	}
+	if checkpoint == nil {
+		return nil, listeners.ErrCheckpointNotFound
+	}
+	return checkpoint, nil
+}
+
+func (s *CheckpointStore) Save(ctx context.Context, key string, checkpoint []byte) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucket)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), checkpoint)
+	})
+	if err != nil {
+		return fmt.Errorf("CheckpointStore.Save error (Update): %w", err)
+	}
+	return nil
+}
+
+// Close the database, if it was opened with Open.
+func (s *CheckpointStore) Close() error {
+	if !s.owned {
+		return nil
+	}
+	return s.db.Close()
+}
@@ -0,0 +1,48 @@
+package boltstore
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/davhofer/botsky/pkg/listeners"
+)
+
+func TestCheckpointStore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "checkpoints.db")
+	key := "did:plc:bot/PollingNotificationListener"
+
+	store, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// no bucket yet
+	if _, err := store.Load(ctx, key); !errors.Is(err, listeners.ErrCheckpointNotFound) {
+		t.Fatalf("Load from an empty database error = %v, want ErrCheckpointNotFound", err)
+	}
+	for _, checkpoint := range []string{`"first"`, `"second"`} {
+		if err := store.Save(ctx, key, []byte(checkpoint)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// bucket exists, key doesn't
+	if _, err := store.Load(ctx, "did:plc:other/PollingNotificationListener"); !errors.Is(err, listeners.ErrCheckpointNotFound) {
+		t.Errorf("Load of a missing key error = %v, want ErrCheckpointNotFound", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the checkpoint survives reopening the database
+	store, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	checkpoint, err := store.Load(ctx, key)
+	if err != nil || string(checkpoint) != `"second"` {
+		t.Errorf("Load = %s, %v, want \"second\"", checkpoint, err)
+	}
+}
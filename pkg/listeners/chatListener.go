@@ -2,7 +2,9 @@ package listeners
 
 import (
 	"context"
+	"encoding/json"
 	"github.com/davhofer/botsky/pkg/botsky"
+	"sync"
 
 	"github.com/davhofer/indigo/api/chat"
 )
@@ -10,15 +12,101 @@ import (
 // Instantiation of a Listener for handling chat logs/events.
 type PollingChatListener struct {
 	Listener[chat.ConvoGetLog_Output_Logs_Elem]
+	state *chatState
 }
 
 // Returns an set up PollingChatListener.
 func NewPollingChatListener(ctx context.Context, client *botsky.Client) *PollingChatListener {
-	return &PollingChatListener{*NewListener(ctx, client, "PollingChatListener", pollChatLogs)}
+	state := &chatState{}
+	l := &PollingChatListener{
+		Listener: *NewListener(ctx, client, "PollingChatListener", state.poll),
+		state:    state,
+	}
+	l.checkpointer = state
+	l.source = func(ctx context.Context, handlerCtx context.Context) {
+		// logs which were delivered but not acknowledged in a previous run are delivered again
+		state.rewind()
+		l.poll(ctx, handlerCtx)
+	}
+	return l
+}
+
+// Cursor after the chat logs acknowledged by the handlers, for persisting it and resuming with SetCursor.
+//
+// Alternatively, set a CheckpointStore, which persists the cursor once the handlers acknowledged the logs.
+func (l *PollingChatListener) Cursor() string {
+	return l.state.getCursor()
+}
+
+// Continue with the chat logs after the given cursor.
+func (l *PollingChatListener) SetCursor(cursor string) {
+	l.state.setCursor(cursor)
+}
+
+// Chat log cursors of the listener.
+type chatState struct {
+	mutex  sync.Mutex
+	cursor string // after the delivered logs
+	acked  string // after the logs acknowledged by the handlers
+}
+
+func (s *chatState) getCursor() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.acked
+}
+
+// Cursor after the delivered logs.
+func (s *chatState) delivered() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.cursor
+}
+
+func (s *chatState) setCursor(cursor string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cursor, s.acked = cursor, cursor
+}
+
+// Continue polling after the acknowledged logs.
+func (s *chatState) rewind() {
+	s.setCursor(s.getCursor())
+}
+
+// The position after the polled logs, acknowledged once the handlers handled them.
+func (s *chatState) checkpoint() ([]byte, error) {
+	return json.Marshal(s.delivered())
+}
+
+func (s *chatState) acknowledged(ctx context.Context, checkpoint []byte) {
+	var cursor string
+	if err := json.Unmarshal(checkpoint, &cursor); err != nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.acked = cursor
+}
+
+func (s *chatState) restore(checkpoint []byte) error {
+	var cursor string
+	if err := json.Unmarshal(checkpoint, &cursor); err != nil {
+		return err
+	}
+	s.setCursor(cursor)
+	return nil
 }
 
 // Get all new chat logs since the last check.
-func pollChatLogs(ctx context.Context, client *botsky.Client) ([]*chat.ConvoGetLog_Output_Logs_Elem, error) {
+func (s *chatState) poll(ctx context.Context, client *botsky.Client) ([]*chat.ConvoGetLog_Output_Logs_Elem, error) {
 	// the "update seen" part happens automatically through updating of the cursor
-	return client.ChatGetRecentLogs(ctx)
+	logs, cursor, err := client.ChatGetRecentLogs(ctx, s.delivered())
+	if err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	s.cursor = cursor
+	s.mutex.Unlock()
+	return logs, nil
 }
@@ -0,0 +1,86 @@
+package listeners
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/davhofer/botsky/pkg/botsky"
+	"github.com/davhofer/indigo/api/chat"
+)
+
+// Local stand-in for the chat service, with one log after the empty cursor.
+func newChatStandIn(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/xrpc/chat.bsky.convo.getLog" {
+			http.NotFound(w, r)
+			return
+		}
+		cursor := r.URL.Query().Get("cursor")
+		output := chat.ConvoGetLog_Output{Logs: []*chat.ConvoGetLog_Output_Logs_Elem{}, Cursor: &cursor}
+		if cursor == "" {
+			next := "rev1"
+			output.Cursor = &next
+			output.Logs = append(output.Logs, &chat.ConvoGetLog_Output_Logs_Elem{
+				ConvoDefs_LogBeginConvo: &chat.ConvoDefs_LogBeginConvo{ConvoId: "convo", Rev: "rev1"},
+			})
+		}
+		json.NewEncoder(w).Encode(output)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Logs which weren't acknowledged when the listener was stopped are delivered by the next run,
+// and the cursor only moves once they are acknowledged.
+func TestChatRedeliveredAfterStop(t *testing.T) {
+	server := newChatStandIn(t)
+	l := NewPollingChatListener(context.Background(), newTestClient(t, botsky.WithChatHost(server.URL)))
+	l.SetPollingStrategy(PollingStrategy{Interval: 10 * time.Millisecond})
+
+	var mutex sync.Mutex
+	var handled []string
+	started := make(chan struct{}, 1)
+	l.RegisterHandler("h", func(ctx context.Context, client *botsky.Client, logs []*chat.ConvoGetLog_Output_Logs_Elem) error {
+		mutex.Lock()
+		for _, log := range logs {
+			id, _ := ChatLogID(log)
+			handled = append(handled, id)
+		}
+		first := len(handled) == 1
+		mutex.Unlock()
+		if first {
+			started <- struct{}{}
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	})
+
+	go l.Run(context.Background())
+	<-started
+	if cursor := l.Cursor(); cursor != "" {
+		t.Errorf("cursor = %q before the logs were acknowledged", cursor)
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	l.Shutdown(shutdownCtx)
+	waitUntil(t, "stop", func() bool { return !l.IsActive() })
+	if cursor := l.Cursor(); cursor != "" {
+		t.Errorf("cursor = %q after the handler was cancelled", cursor)
+	}
+
+	ctx, cancelRun := context.WithCancel(context.Background())
+	defer cancelRun()
+	go l.Run(ctx)
+	waitUntil(t, "acknowledgement", func() bool { return l.Cursor() == "rev1" })
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(handled) != 2 || handled[0] != "convo/rev1" || handled[1] != "convo/rev1" {
+		t.Errorf("handled %v, want the log twice", handled)
+	}
+}
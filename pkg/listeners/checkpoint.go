@@ -0,0 +1,263 @@
+package listeners
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Returned by CheckpointStore.Load if there is no checkpoint for the key.
+var ErrCheckpointNotFound = errors.New("checkpoint not found")
+
+// Timeout for saving a checkpoint (and acting on it, e.g. marking notifications as seen).
+const checkpointTimeout = 10 * time.Second
+
+// Persists the cursors of listeners, so they continue where they left off after a restart.
+//
+// A listener saves its cursor once all handlers acknowledged (handled, dropped or dead-lettered) a batch,
+// and loads it when it is started. Checkpoints are keyed by the account's DID and the listener name.
+type CheckpointStore interface {
+	Load(ctx context.Context, key string) ([]byte, error)
+	Save(ctx context.Context, key string, checkpoint []byte) error
+}
+
+// CheckpointStore keeping checkpoints in memory.
+type MemoryCheckpointStore struct {
+	mutex       sync.Mutex
+	checkpoints map[string][]byte
+}
+
+func NewMemoryCheckpointStore() *MemoryCheckpointStore {
+	return &MemoryCheckpointStore{checkpoints: make(map[string][]byte)}
+}
+
+func (s *MemoryCheckpointStore) Load(ctx context.Context, key string) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	checkpoint, ok := s.checkpoints[key]
+	if !ok {
+		return nil, ErrCheckpointNotFound
+	}
+	return checkpoint, nil
+}
+
+func (s *MemoryCheckpointStore) Save(ctx context.Context, key string, checkpoint []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.checkpoints[key] = checkpoint
+	return nil
+}
+
+// CheckpointStore keeping one file per checkpoint in a directory. Files are replaced atomically.
+type FileCheckpointStore struct {
+	Dir   string
+	mutex sync.Mutex
+}
+
+func NewFileCheckpointStore(dir string) *FileCheckpointStore {
+	return &FileCheckpointStore{Dir: dir}
+}
+
+func (s *FileCheckpointStore) path(key string) string {
+	return filepath.Join(s.Dir, url.PathEscape(key)+".json")
+}
+
+func (s *FileCheckpointStore) Load(ctx context.Context, key string) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	checkpoint, err := os.ReadFile(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrCheckpointNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("FileCheckpointStore.Load error (os.ReadFile): %w", err)
+	}
+	return checkpoint, nil
+}
+
+func (s *FileCheckpointStore) Save(ctx context.Context, key string, checkpoint []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := os.MkdirAll(s.Dir, 0o700); err != nil {
+		return fmt.Errorf("FileCheckpointStore.Save error (os.MkdirAll): %w", err)
+	}
+	// write to a temporary file first so a crash can't leave a truncated checkpoint behind
+	tmp, err := os.CreateTemp(s.Dir, ".checkpoint-*")
+	if err != nil {
+		return fmt.Errorf("FileCheckpointStore.Save error (os.CreateTemp): %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(checkpoint); err != nil {
+		tmp.Close()
+		return fmt.Errorf("FileCheckpointStore.Save error (Write): %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("FileCheckpointStore.Save error (Close): %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path(key)); err != nil {
+		return fmt.Errorf("FileCheckpointStore.Save error (os.Rename): %w", err)
+	}
+	return nil
+}
+
+// Implemented by listeners with a cursor that can be persisted.
+type checkpointer interface {
+	checkpoint() ([]byte, error) // encode the current cursor
+	restore(checkpoint []byte) error
+}
+
+// Implemented by checkpointers which act on the acknowledged checkpoints, e.g. to mark notifications as seen.
+// Called whether or not there is a checkpoint store.
+type acknowledger interface {
+	acknowledged(ctx context.Context, checkpoint []byte)
+}
+
+// Set the store for persisting the listener's cursor. Must be set before the listener is started.
+func (l *Listener[EventT]) SetCheckpointStore(store CheckpointStore) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.checkpoints = store
+}
+
+// Key of the listener's checkpoint.
+func (l *Listener[EventT]) checkpointKey() string {
+	return l.Client.Did + "/" + l.Name
+}
+
+// Restore the cursor from the checkpoint store, if there is one.
+func (l *Listener[EventT]) loadCheckpoint(ctx context.Context) error {
+	if !l.hasCheckpointStore() {
+		return nil
+	}
+	l.mutex.Lock()
+	store := l.checkpoints
+	l.mutex.Unlock()
+	checkpoint, err := store.Load(ctx, l.checkpointKey())
+	if errors.Is(err, ErrCheckpointNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("loadCheckpoint error (Load): %w", err)
+	}
+	if err := l.checkpointer.restore(checkpoint); err != nil {
+		return fmt.Errorf("loadCheckpoint error (restore): %w", err)
+	}
+	l.getLogger().Debug("Checkpoint restored", "key", l.checkpointKey())
+	return nil
+}
+
+func (l *Listener[EventT]) hasCheckpointStore() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.checkpoints != nil && l.checkpointer != nil
+}
+
+// Encode the current cursor for a batch, nil if the listener has no checkpoint store (and doesn't act on acknowledgements).
+func (l *Listener[EventT]) currentCheckpoint() []byte {
+	if _, ok := l.checkpointer.(acknowledger); !ok && !l.hasCheckpointStore() {
+		return nil
+	}
+	checkpoint, err := l.checkpointer.checkpoint()
+	if err != nil {
+		l.getLogger().Error("Encoding checkpoint failed", "error", err)
+		return nil
+	}
+	return checkpoint
+}
+
+// Save the checkpoint of the batch which was acknowledged last. ctx is cancelled when the handlers are cancelled.
+func (l *Listener[EventT]) saveCheckpoint(ctx context.Context, checkpoint []byte) {
+	ctx, cancel := context.WithTimeout(ctx, checkpointTimeout)
+	defer cancel()
+	if acknowledger, ok := l.checkpointer.(acknowledger); ok {
+		acknowledger.acknowledged(ctx, checkpoint)
+	}
+	l.mutex.Lock()
+	store := l.checkpoints
+	l.mutex.Unlock()
+	if store == nil {
+		return
+	}
+	if err := store.Save(ctx, l.checkpointKey(), checkpoint); err != nil {
+		l.getLogger().Error("Saving checkpoint failed", "error", err)
+	}
+}
+
+// Tracks which batches the handlers acknowledged and saves the checkpoint of the newest batch
+// for which all batches up to it were acknowledged, so no batch is skipped after a restart.
+type ackTracker struct {
+	ctx       context.Context // passed to save
+	mutex     sync.Mutex
+	next      uint64 // sequence number of the next batch
+	committed uint64 // all batches before this one were acknowledged
+	pending   map[uint64]*pendingAck
+	save      func(ctx context.Context, checkpoint []byte)
+	saveMutex sync.Mutex // serializes saves, so an older checkpoint never overwrites a newer one
+	saved     uint64     // committed of the last saved checkpoint
+}
+
+type pendingAck struct {
+	remaining  int // handlers which didn't acknowledge the batch yet
+	checkpoint []byte
+}
+
+func newAckTracker(ctx context.Context, save func(ctx context.Context, checkpoint []byte)) *ackTracker {
+	return &ackTracker{ctx: ctx, pending: make(map[uint64]*pendingAck), save: save}
+}
+
+// Add a batch passed to the given number of handlers. Each of them must call the returned function once.
+func (t *ackTracker) add(handlers int, checkpoint []byte) func() {
+	t.mutex.Lock()
+	seq := t.next
+	t.next++
+	t.pending[seq] = &pendingAck{remaining: handlers, checkpoint: checkpoint}
+	t.mutex.Unlock()
+	if handlers == 0 {
+		t.ack(seq, 0)
+	}
+	return func() {
+		t.ack(seq, 1)
+	}
+}
+
+// Count n acknowledgements of the batch and save the checkpoint, if more batches are committed now.
+func (t *ackTracker) ack(seq uint64, n int) {
+	t.mutex.Lock()
+	t.pending[seq].remaining -= n
+	checkpoint, committed := t.commit()
+	t.mutex.Unlock()
+	if checkpoint == nil {
+		return
+	}
+
+	// save outside of the lock, so acknowledging doesn't wait for the store
+	t.saveMutex.Lock()
+	defer t.saveMutex.Unlock()
+	if committed > t.saved {
+		t.saved = committed
+		t.save(t.ctx, checkpoint)
+	}
+}
+
+// Remove the acknowledged batches from the front, returning the newest of their checkpoints (nil if there is none)
+// and the number of committed batches.
+func (t *ackTracker) commit() ([]byte, uint64) {
+	var checkpoint []byte
+	for {
+		batch, ok := t.pending[t.committed]
+		if !ok || batch.remaining > 0 {
+			break
+		}
+		if batch.checkpoint != nil {
+			checkpoint = batch.checkpoint
+		}
+		delete(t.pending, t.committed)
+		t.committed++
+	}
+	return checkpoint, t.committed
+}
@@ -0,0 +1,186 @@
+package listeners
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/davhofer/botsky/pkg/botsky"
+	"github.com/davhofer/indigo/api/chat"
+)
+
+func TestCheckpointStores(t *testing.T) {
+	stores := map[string]CheckpointStore{
+		"memory": NewMemoryCheckpointStore(),
+		"file":   NewFileCheckpointStore(t.TempDir() + "/checkpoints"),
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			key := "did:plc:bot/PollingNotificationListener"
+			if _, err := store.Load(ctx, key); !errors.Is(err, ErrCheckpointNotFound) {
+				t.Fatalf("Load of a missing key error = %v, want ErrCheckpointNotFound", err)
+			}
+			for _, checkpoint := range []string{`"first"`, `"second"`} {
+				if err := store.Save(ctx, key, []byte(checkpoint)); err != nil {
+					t.Fatal(err)
+				}
+				loaded, err := store.Load(ctx, key)
+				if err != nil || string(loaded) != checkpoint {
+					t.Fatalf("Load = %s, %v, want %s", loaded, err, checkpoint)
+				}
+			}
+			if _, err := store.Load(ctx, "did:plc:other/PollingNotificationListener"); !errors.Is(err, ErrCheckpointNotFound) {
+				t.Errorf("Load of another key error = %v, want ErrCheckpointNotFound", err)
+			}
+		})
+	}
+}
+
+// Records the saved checkpoints.
+type saveRecorder struct {
+	mutex sync.Mutex
+	saved []string
+}
+
+func (r *saveRecorder) save(ctx context.Context, checkpoint []byte) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.saved = append(r.saved, string(checkpoint))
+}
+
+func (r *saveRecorder) checkpoints() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return slices.Clone(r.saved)
+}
+
+func TestAckTracker(t *testing.T) {
+	var recorder saveRecorder
+	tracker := newAckTracker(context.Background(), recorder.save)
+	first := tracker.add(2, []byte("1"))
+	second := tracker.add(2, nil)
+	third := tracker.add(1, []byte("3"))
+
+	// later batches are only committed together with the earlier ones
+	second()
+	second()
+	third()
+	first()
+	if saved := recorder.checkpoints(); len(saved) != 0 {
+		t.Fatalf("saved %v before the first batch was acknowledged by all handlers", saved)
+	}
+	first()
+	if saved := recorder.checkpoints(); !slices.Equal(saved, []string{"3"}) {
+		t.Fatalf("saved %v, want only the newest committed checkpoint [3]", saved)
+	}
+
+	// a batch without handlers is committed right away
+	tracker.add(0, []byte("4"))
+	if saved := recorder.checkpoints(); !slices.Equal(saved, []string{"3", "4"}) {
+		t.Errorf("saved %v, want [3 4]", saved)
+	}
+}
+
+// A slow save doesn't block acknowledgements which don't commit anything.
+func TestAckTrackerSlowSave(t *testing.T) {
+	release := make(chan struct{})
+	saving := make(chan struct{})
+	tracker := newAckTracker(context.Background(), func(ctx context.Context, checkpoint []byte) {
+		close(saving)
+		<-release
+	})
+	first := tracker.add(1, []byte("1"))
+	tracker.add(1, []byte("2"))
+	third := tracker.add(1, []byte("3"))
+
+	go first()
+	<-saving
+	acked := make(chan struct{})
+	go func() {
+		third()
+		close(acked)
+	}()
+	select {
+	case <-acked:
+	case <-time.After(time.Second):
+		t.Error("acknowledgement waited for the save")
+	}
+	close(release)
+}
+
+// A listener with a checkpoint store saves its cursor once the handlers acknowledged the events,
+// and a new listener resumes from it.
+func TestResumeFromCheckpoint(t *testing.T) {
+	var mutex sync.Mutex
+	var cursors []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cursor := r.URL.Query().Get("cursor")
+		mutex.Lock()
+		cursors = append(cursors, cursor)
+		mutex.Unlock()
+		output := chat.ConvoGetLog_Output{Logs: []*chat.ConvoGetLog_Output_Logs_Elem{}, Cursor: &cursor}
+		if cursor == "" {
+			next := "rev1"
+			output.Cursor = &next
+			output.Logs = append(output.Logs, &chat.ConvoGetLog_Output_Logs_Elem{
+				ConvoDefs_LogBeginConvo: &chat.ConvoDefs_LogBeginConvo{ConvoId: "convo", Rev: "rev1"},
+			})
+		}
+		json.NewEncoder(w).Encode(output)
+	}))
+	defer server.Close()
+	client := newTestClient(t, botsky.WithChatHost(server.URL))
+	store := NewMemoryCheckpointStore()
+	key := "did:plc:bot/PollingChatListener"
+
+	run := func() int {
+		l := NewPollingChatListener(context.Background(), client)
+		l.SetPollingStrategy(PollingStrategy{Interval: 10 * time.Millisecond})
+		l.SetCheckpointStore(store)
+		var mutex sync.Mutex
+		handled := 0
+		l.RegisterHandler("h", func(ctx context.Context, client *botsky.Client, logs []*chat.ConvoGetLog_Output_Logs_Elem) error {
+			mutex.Lock()
+			defer mutex.Unlock()
+			handled += len(logs)
+			return nil
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- l.Run(ctx) }()
+		waitUntil(t, "checkpoint", func() bool {
+			checkpoint, err := store.Load(context.Background(), key)
+			return err == nil && string(checkpoint) == `"rev1"`
+		})
+		time.Sleep(30 * time.Millisecond)
+		cancel()
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		return handled
+	}
+
+	if handled := run(); handled != 1 {
+		t.Fatalf("first run handled %d logs, want 1", handled)
+	}
+	mutex.Lock()
+	cursors = nil
+	mutex.Unlock()
+	if handled := run(); handled != 0 {
+		t.Errorf("second run handled %d logs again", handled)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(cursors) == 0 || cursors[0] != "rev1" {
+		t.Errorf("second run polled with cursors %v, want to resume at rev1", cursors)
+	}
+}
@@ -0,0 +1,239 @@
+package listeners
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Error returned by a handler invocation that failed (after all retries).
+type HandlerError[EventT any] struct {
+	Listener string
+	Handler  string
+	Events   []*EventT
+	Attempts int
+	Err      error
+}
+
+func (e *HandlerError[EventT]) Error() string {
+	return fmt.Sprintf("handler %s of %s failed after %d attempt(s): %v", e.Handler, e.Listener, e.Attempts, e.Err)
+}
+
+func (e *HandlerError[EventT]) Unwrap() error {
+	return e.Err
+}
+
+// Error of a handler invocation that panicked. The panic is recovered, so other handlers keep running.
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("handler panicked: %v", e.Value)
+}
+
+// Error of a handler which handled some of the events and failed on the others.
+// Only the failed events are retried and passed to the dead letter sink.
+type PartialError[EventT any] struct {
+	Failed []*EventT
+	Err    error
+}
+
+func (e *PartialError[EventT]) Error() string {
+	return fmt.Sprintf("failed on %d event(s): %v", len(e.Failed), e.Err)
+}
+
+func (e *PartialError[EventT]) Unwrap() error {
+	return e.Err
+}
+
+// The events a handler failed on with the given error: the failed events of a PartialError, otherwise all events.
+func failedEvents[EventT any](err error, events []*EventT) []*EventT {
+	if err == nil {
+		return nil
+	}
+	var partial *PartialError[EventT]
+	if errors.As(err, &partial) {
+		return partial.Failed
+	}
+	return events
+}
+
+// Events a handler failed on, stored by a DeadLetterSink to be replayed later with Listener.Replay.
+type DeadLetter struct {
+	Listener string          `json:"listener"`
+	Handler  string          `json:"handler"`
+	Error    string          `json:"error"`
+	Time     time.Time       `json:"time"`
+	Events   json.RawMessage `json:"events"` // JSON array of the events
+}
+
+// Receives the events of failed handler invocations, see WithDeadLetterSink.
+type DeadLetterSink interface {
+	Put(ctx context.Context, letter DeadLetter) error
+}
+
+// DeadLetterSink keeping dead letters in memory.
+type MemoryDeadLetterSink struct {
+	mutex   sync.Mutex
+	letters []DeadLetter
+}
+
+func NewMemoryDeadLetterSink() *MemoryDeadLetterSink {
+	return &MemoryDeadLetterSink{}
+}
+
+func (s *MemoryDeadLetterSink) Put(ctx context.Context, letter DeadLetter) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.letters = append(s.letters, letter)
+	return nil
+}
+
+// Remove and return all stored dead letters.
+func (s *MemoryDeadLetterSink) Drain(ctx context.Context) ([]DeadLetter, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	letters := s.letters
+	s.letters = nil
+	return letters, nil
+}
+
+// DeadLetterSink appending dead letters as JSON lines to a file (created with permissions 0600).
+type FileDeadLetterSink struct {
+	Path  string
+	mutex sync.Mutex
+}
+
+func NewFileDeadLetterSink(path string) *FileDeadLetterSink {
+	return &FileDeadLetterSink{Path: path}
+}
+
+func (s *FileDeadLetterSink) Put(ctx context.Context, letter DeadLetter) error {
+	data, err := json.Marshal(letter)
+	if err != nil {
+		return fmt.Errorf("FileDeadLetterSink.Put error (json.Marshal): %w", err)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	file, err := os.OpenFile(s.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("FileDeadLetterSink.Put error (os.OpenFile): %w", err)
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return fmt.Errorf("FileDeadLetterSink.Put error (Write): %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("FileDeadLetterSink.Put error (Close): %w", err)
+	}
+	return nil
+}
+
+// Remove and return all stored dead letters.
+func (s *FileDeadLetterSink) Drain(ctx context.Context) ([]DeadLetter, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	data, err := os.ReadFile(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("FileDeadLetterSink.Drain error (os.ReadFile): %w", err)
+	}
+
+	var letters []DeadLetter
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var letter DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &letter); err != nil {
+			return nil, fmt.Errorf("FileDeadLetterSink.Drain error (json.Unmarshal): %w", err)
+		}
+		letters = append(letters, letter)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("FileDeadLetterSink.Drain error (Scan): %w", err)
+	}
+	if err := os.Remove(s.Path); err != nil {
+		return nil, fmt.Errorf("FileDeadLetterSink.Drain error (os.Remove): %w", err)
+	}
+	return letters, nil
+}
+
+// Set a hook which is called whenever a handler invocation failed (after all retries), e.g. for alerting.
+func (l *Listener[EventT]) OnError(hook func(ctx context.Context, err *HandlerError[EventT])) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.onError = hook
+}
+
+// Run the handler of a dead letter on its events again, e.g. after fixing the cause of the failure.
+//
+// The handler is called directly (not retried), and its error is returned.
+func (l *Listener[EventT]) Replay(ctx context.Context, letter DeadLetter) error {
+	if letter.Listener != l.Name {
+		return fmt.Errorf("Replay error: dead letter belongs to listener %s", letter.Listener)
+	}
+	l.mutex.Lock()
+	h, ok := l.handlers[letter.Handler]
+	l.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("Replay error: handler with id %s is not registered", letter.Handler)
+	}
+	var events []*EventT
+	if err := json.Unmarshal(letter.Events, &events); err != nil {
+		return fmt.Errorf("Replay error (json.Unmarshal): %w", err)
+	}
+	return l.invoke(ctx, h, events)
+}
+
+// Log a failed handler invocation, call the OnError hook and pass the events to the dead letter sink.
+func (l *Listener[EventT]) handleError(ctx context.Context, h *registeredHandler[EventT], handlerErr *HandlerError[EventT]) {
+	logger := l.getLogger()
+	var panicErr *PanicError
+	if errors.As(handlerErr.Err, &panicErr) {
+		logger.Error("Handler panicked", "handler", h.id, "events", len(handlerErr.Events), "panic", panicErr.Value, "stack", string(panicErr.Stack))
+	} else {
+		logger.Error("Handler failed", "handler", h.id, "events", len(handlerErr.Events), "attempts", handlerErr.Attempts, "error", handlerErr.Err)
+	}
+
+	// the listener may be shutting down, but the failure should still be recorded
+	ctx = context.WithoutCancel(ctx)
+
+	l.mutex.Lock()
+	onError := l.onError
+	l.mutex.Unlock()
+	if onError != nil {
+		onError(ctx, handlerErr)
+	}
+
+	if h.config.deadLetters == nil {
+		return
+	}
+	events, err := json.Marshal(handlerErr.Events)
+	if err != nil {
+		logger.Error("Encoding dead letter failed", "handler", h.id, "error", err)
+		return
+	}
+	letter := DeadLetter{
+		Listener: l.Name,
+		Handler:  h.id,
+		Error:    handlerErr.Err.Error(),
+		Time:     time.Now(),
+		Events:   events,
+	}
+	if err := h.config.deadLetters.Put(ctx, letter); err != nil {
+		logger.Error("Storing dead letter failed", "handler", h.id, "error", err)
+	}
+}
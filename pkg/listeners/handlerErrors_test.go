@@ -0,0 +1,192 @@
+package listeners
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/davhofer/botsky/pkg/botsky"
+)
+
+func TestPanicRecovery(t *testing.T) {
+	l := newTestListener(t)
+	errs := make(chan *HandlerError[int], 1)
+	l.OnError(func(ctx context.Context, err *HandlerError[int]) { errs <- err })
+	var calls atomic.Int64
+	l.RegisterHandler("panics", func(ctx context.Context, client *botsky.Client, events []*int) error {
+		if calls.Add(1) == 1 {
+			panic("boom")
+		}
+		return nil
+	})
+	l.run(t)
+
+	l.send(1)
+	select {
+	case err := <-errs:
+		var panicErr *PanicError
+		if !errors.As(err, &panicErr) || panicErr.Value != "boom" || len(panicErr.Stack) == 0 {
+			t.Errorf("handler error = %v, want the recovered panic with its stack", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("panic wasn't reported")
+	}
+
+	// the listener keeps handling events
+	l.send(2)
+	waitUntil(t, "second batch", func() bool { return calls.Load() == 2 })
+	if !l.IsActive() {
+		t.Error("listener stopped after a panic")
+	}
+}
+
+func TestHandlerRetry(t *testing.T) {
+	errFailed := errors.New("failed")
+	tests := []struct {
+		name         string
+		failures     int64 // invocations failing before the handler succeeds
+		wantCalls    int64
+		wantAttempts int // of the reported error, 0 if none
+		wantFailed   []int
+	}{
+		{name: "recovers", failures: 2, wantCalls: 3},
+		{name: "gives up", failures: 10, wantCalls: 3, wantAttempts: 3, wantFailed: []int{2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestListener(t)
+			sink := NewMemoryDeadLetterSink()
+			var reported atomic.Pointer[HandlerError[int]]
+			l.OnError(func(ctx context.Context, err *HandlerError[int]) { reported.Store(err) })
+			var calls atomic.Int64
+			l.RegisterHandler("flaky", func(ctx context.Context, client *botsky.Client, events []*int) error {
+				if calls.Add(1) > tt.failures {
+					return nil
+				}
+				// only the last event fails, the others are handled
+				return &PartialError[int]{Failed: events[len(events)-1:], Err: errFailed}
+			}, WithHandlerRetry(2, time.Millisecond), WithDeadLetterSink(sink))
+			l.run(t)
+
+			l.send(1, 2)
+			waitUntil(t, "handler calls", func() bool { return calls.Load() >= tt.wantCalls })
+			time.Sleep(20 * time.Millisecond)
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("handler called %d times, want %d", got, tt.wantCalls)
+			}
+
+			letters, _ := sink.Drain(context.Background())
+			err := reported.Load()
+			if tt.wantAttempts == 0 {
+				if err != nil || len(letters) != 0 {
+					t.Errorf("reported %v and %d dead letters for a handler which recovered", err, len(letters))
+				}
+				return
+			}
+			if err == nil || err.Attempts != tt.wantAttempts || !errors.Is(err, errFailed) {
+				t.Fatalf("reported %v, want %d attempts", err, tt.wantAttempts)
+			}
+			if len(letters) != 1 {
+				t.Fatalf("stored %d dead letters, want 1", len(letters))
+			}
+			var failed []int
+			if err := json.Unmarshal(letters[0].Events, &failed); err != nil || !slices.Equal(failed, tt.wantFailed) {
+				t.Errorf("dead letter events = %s, want %v", letters[0].Events, tt.wantFailed)
+			}
+		})
+	}
+}
+
+// Events of a handler interrupted by cancellation are redelivered, not dead-lettered.
+func TestCancelledHandlerNotDeadLettered(t *testing.T) {
+	l := newTestListener(t)
+	sink := NewMemoryDeadLetterSink()
+	var reported atomic.Int64
+	l.OnError(func(ctx context.Context, err *HandlerError[int]) { reported.Add(1) })
+	h := newBlockingHandler()
+	l.RegisterHandler("h", h.handle, WithHandlerRetry(3, time.Hour), WithDeadLetterSink(sink))
+	l.run(t)
+
+	l.send(1)
+	<-h.started
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	l.Shutdown(ctx)
+	waitUntil(t, "stop", func() bool { return !l.IsActive() })
+
+	letters, _ := sink.Drain(context.Background())
+	if n := reported.Load(); n != 0 || len(letters) != 0 {
+		t.Errorf("reported %d errors and stored %d dead letters for a cancelled handler", n, len(letters))
+	}
+}
+
+func TestFileDeadLetterSink(t *testing.T) {
+	ctx := context.Background()
+	sink := NewFileDeadLetterSink(filepath.Join(t.TempDir(), "dead-letters.jsonl"))
+	if letters, err := sink.Drain(ctx); err != nil || len(letters) != 0 {
+		t.Fatalf("Drain without a file = %v, %v, want nothing", letters, err)
+	}
+
+	want := []DeadLetter{
+		{Listener: "test", Handler: "a", Error: "failed", Time: time.Unix(1, 0).UTC(), Events: json.RawMessage(`[1,2]`)},
+		{Listener: "test", Handler: "b", Error: "failed again", Time: time.Unix(2, 0).UTC(), Events: json.RawMessage(`[3]`)},
+	}
+	for _, letter := range want {
+		if err := sink.Put(ctx, letter); err != nil {
+			t.Fatal(err)
+		}
+	}
+	letters, err := sink.Drain(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != len(want) {
+		t.Fatalf("drained %d dead letters, want %d", len(letters), len(want))
+	}
+	for i, letter := range letters {
+		if letter.Handler != want[i].Handler || letter.Error != want[i].Error || !letter.Time.Equal(want[i].Time) || string(letter.Events) != string(want[i].Events) {
+			t.Errorf("dead letter %d = %+v, want %+v", i, letter, want[i])
+		}
+	}
+	// draining removes the letters
+	if letters, err := sink.Drain(ctx); err != nil || len(letters) != 0 {
+		t.Errorf("second Drain = %v, %v, want nothing", letters, err)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	l := NewListener[int](context.Background(), newTestClient(t), "test", nil)
+	var replayed []int
+	l.RegisterHandler("h", func(ctx context.Context, client *botsky.Client, events []*int) error {
+		for _, event := range events {
+			replayed = append(replayed, *event)
+		}
+		return nil
+	})
+
+	tests := []struct {
+		name    string
+		letter  DeadLetter
+		wantErr bool
+	}{
+		{name: "replayed", letter: DeadLetter{Listener: "test", Handler: "h", Events: json.RawMessage(`[1,2]`)}},
+		{name: "other listener", letter: DeadLetter{Listener: "other", Handler: "h", Events: json.RawMessage(`[3]`)}, wantErr: true},
+		{name: "unknown handler", letter: DeadLetter{Listener: "test", Handler: "missing", Events: json.RawMessage(`[3]`)}, wantErr: true},
+		{name: "invalid events", letter: DeadLetter{Listener: "test", Handler: "h", Events: json.RawMessage(`{}`)}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := l.Replay(context.Background(), tt.letter); (err != nil) != tt.wantErr {
+				t.Errorf("Replay error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+	if !slices.Equal(replayed, []int{1, 2}) {
+		t.Errorf("replayed %v, want [1 2]", replayed)
+	}
+}
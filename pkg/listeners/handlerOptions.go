@@ -0,0 +1,183 @@
+package listeners
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// What happens with a batch of events when all workers of a handler are busy.
+type BusyPolicy int
+
+const (
+	BusyQueue    BusyPolicy = iota // queue the batch, batches exceeding the queue size are dropped
+	BusyDrop                       // drop the batch
+	BusyCoalesce                   // merge the batch into the pending one, so the handler gets all missed events at once
+)
+
+// Default number of batches queued per handler with BusyQueue.
+const DefaultHandlerQueueSize = 100
+
+type handlerConfig struct {
+	maxConcurrency int
+	timeout        time.Duration
+	busyPolicy     BusyPolicy
+	queueSize      int
+	retries        int
+	retryBackoff   time.Duration
+	deadLetters    DeadLetterSink
+}
+
+// Configures a handler, see RegisterHandler.
+type HandlerOption func(*handlerConfig)
+
+// Run at most n invocations of the handler at the same time. n <= 0 means no limit.
+//
+// Default: 1, i.e. batches are handled one after another, in the order they were received.
+// With more than one worker, batches may be handled out of order.
+func WithMaxConcurrency(n int) HandlerOption {
+	return func(c *handlerConfig) {
+		c.maxConcurrency = n
+	}
+}
+
+// Cancel the context of an invocation after the given duration. Default: no timeout.
+func WithHandlerTimeout(timeout time.Duration) HandlerOption {
+	return func(c *handlerConfig) {
+		c.timeout = timeout
+	}
+}
+
+// Set what happens with new events while all workers of the handler are busy. Default: BusyQueue.
+func WithBusyPolicy(policy BusyPolicy) HandlerOption {
+	return func(c *handlerConfig) {
+		c.busyPolicy = policy
+	}
+}
+
+// Set how many batches are queued with BusyQueue. Default: DefaultHandlerQueueSize.
+func WithQueueSize(size int) HandlerOption {
+	return func(c *handlerConfig) {
+		c.queueSize = size
+	}
+}
+
+// Retry failed invocations up to the given number of times, with exponential backoff (and jitter) starting at backoff.
+// Default: no retries, failures are logged.
+func WithHandlerRetry(retries int, backoff time.Duration) HandlerOption {
+	return func(c *handlerConfig) {
+		c.retries = retries
+		c.retryBackoff = backoff
+	}
+}
+
+// Pass the events of failed invocations (after all retries) to the sink, so they can be replayed with Listener.Replay.
+func WithDeadLetterSink(sink DeadLetterSink) HandlerOption {
+	return func(c *handlerConfig) {
+		c.deadLetters = sink
+	}
+}
+
+// A registered handler with its configuration and pending batches.
+type registeredHandler[EventT any] struct {
+	id      string
+	handler Handler[EventT] // as registered
+	config  handlerConfig
+	mutex   sync.Mutex      // guards handle, running and pending
+	handle  Handler[EventT] // handler wrapped in the listener's middleware
+	running int
+	pending []pendingBatch[EventT]
+}
+
+type pendingBatch[EventT any] struct {
+	ctx    context.Context
+	events []*EventT
+	acks   []func() // acknowledge the batches the events came from
+}
+
+// Acknowledge the batches of the events.
+func (b *pendingBatch[EventT]) ack() {
+	for _, ack := range b.acks {
+		ack()
+	}
+}
+
+func newRegisteredHandler[EventT any](id string, handler Handler[EventT], options []HandlerOption) *registeredHandler[EventT] {
+	config := handlerConfig{
+		maxConcurrency: 1,
+		busyPolicy:     BusyQueue,
+		queueSize:      DefaultHandlerQueueSize,
+	}
+	for _, option := range options {
+		option(&config)
+	}
+	return &registeredHandler[EventT]{id: id, handler: handler, config: config, handle: handler}
+}
+
+// Pass a batch to the handler: start a worker if the concurrency limit allows it, otherwise apply the busy policy.
+//
+// Dropped events count as acknowledged.
+func (l *Listener[EventT]) submit(ctx context.Context, h *registeredHandler[EventT], events []*EventT, ack func()) {
+	batch := pendingBatch[EventT]{ctx: ctx, events: events, acks: []func(){ack}}
+	h.mutex.Lock()
+	if h.config.maxConcurrency <= 0 || h.running < h.config.maxConcurrency {
+		h.running++
+		h.mutex.Unlock()
+		l.inflight.Add(1)
+		go l.work(h, batch)
+		return
+	}
+	defer h.mutex.Unlock()
+
+	switch h.config.busyPolicy {
+	case BusyDrop:
+		l.getLogger().Warn("Handler busy, dropping events", "handler", h.id, "events", len(events))
+		ack()
+	case BusyCoalesce:
+		if len(h.pending) > 0 {
+			last := &h.pending[len(h.pending)-1]
+			// clip, so the events of the other handlers aren't overwritten
+			last.events = append(slices.Clip(last.events), events...)
+			last.acks = append(last.acks, ack)
+			return
+		}
+		h.pending = append(h.pending, batch)
+	default:
+		if len(h.pending) >= h.config.queueSize {
+			l.getLogger().Warn("Handler queue full, dropping events", "handler", h.id, "events", len(events))
+			ack()
+			return
+		}
+		h.pending = append(h.pending, batch)
+	}
+}
+
+// Worker handling the given batch and then pending batches, until there are none left.
+func (l *Listener[EventT]) work(h *registeredHandler[EventT], batch pendingBatch[EventT]) {
+	defer l.inflight.Done()
+	for {
+		if l.runHandler(batch.ctx, h, batch.events) {
+			batch.ack()
+		}
+
+		h.mutex.Lock()
+		if len(h.pending) == 0 {
+			h.running--
+			h.mutex.Unlock()
+			return
+		}
+		batch = h.pending[0]
+		h.pending = h.pending[1:]
+		if batch.ctx.Err() != nil {
+			// the listener was cancelled, don't start handling the remaining batches (and don't acknowledge them)
+			dropped := len(h.pending) + 1
+			h.pending = nil
+			h.running--
+			h.mutex.Unlock()
+			l.getLogger().Warn("Listener cancelled, dropping queued events", "handler", h.id, "batches", dropped)
+			return
+		}
+		h.mutex.Unlock()
+	}
+}
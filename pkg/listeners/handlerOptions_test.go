@@ -0,0 +1,281 @@
+package listeners
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/davhofer/botsky/pkg/botsky"
+)
+
+// Listener whose events are sent by the test.
+type testListener struct {
+	*Listener[int]
+	batches    chan []*int
+	dispatched chan struct{}
+	done       chan error
+}
+
+func newTestListener(t *testing.T) *testListener {
+	l := &testListener{
+		Listener:   NewListener[int](context.Background(), newTestClient(t), "test", nil),
+		batches:    make(chan []*int),
+		dispatched: make(chan struct{}),
+		done:       make(chan error, 1),
+	}
+	l.source = func(ctx context.Context, handlerCtx context.Context) {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case batch := <-l.batches:
+				l.dispatch(handlerCtx, batch, nil)
+				l.dispatched <- struct{}{}
+			}
+		}
+	}
+	return l
+}
+
+func (l *testListener) run(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { l.done <- l.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-l.done
+	})
+	for !l.IsActive() {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Dispatch a batch and wait until it was submitted to the handlers.
+func (l *testListener) send(values ...int) {
+	var events []*int
+	for _, value := range values {
+		events = append(events, &value)
+	}
+	l.batches <- events
+	<-l.dispatched
+}
+
+// Handler recording its batches. The first invocation blocks until release is closed.
+type blockingHandler struct {
+	started chan struct{}
+	release chan struct{}
+	calls   atomic.Int64
+
+	mutex   sync.Mutex
+	batches [][]int
+}
+
+func newBlockingHandler() *blockingHandler {
+	return &blockingHandler{started: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (h *blockingHandler) handle(ctx context.Context, client *botsky.Client, events []*int) error {
+	if h.calls.Add(1) == 1 {
+		close(h.started)
+		select {
+		case <-h.release:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	var batch []int
+	for _, event := range events {
+		batch = append(batch, *event)
+	}
+	h.mutex.Lock()
+	h.batches = append(h.batches, batch)
+	h.mutex.Unlock()
+	return nil
+}
+
+func (h *blockingHandler) handled() [][]int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return slices.Clone(h.batches)
+}
+
+func (h *blockingHandler) waitFor(t *testing.T, batches int) [][]int {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(h.handled()) < batches {
+		if time.Now().After(deadline) {
+			t.Fatalf("handled %v, want %d batches", h.handled(), batches)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// give unexpected batches a chance to show up
+	time.Sleep(20 * time.Millisecond)
+	return h.handled()
+}
+
+func TestBusyPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []HandlerOption
+		want    [][]int
+	}{
+		{name: "queue", options: []HandlerOption{WithBusyPolicy(BusyQueue)}, want: [][]int{{1}, {2}, {3, 4}, {5}}},
+		{name: "queue full", options: []HandlerOption{WithQueueSize(2)}, want: [][]int{{1}, {2}, {3, 4}}},
+		{name: "coalesce", options: []HandlerOption{WithBusyPolicy(BusyCoalesce)}, want: [][]int{{1}, {2, 3, 4, 5}}},
+		{name: "drop", options: []HandlerOption{WithBusyPolicy(BusyDrop)}, want: [][]int{{1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestListener(t)
+			h := newBlockingHandler()
+			l.RegisterHandler("h", h.handle, tt.options...)
+			l.run(t)
+
+			l.send(1)
+			<-h.started
+			l.send(2)
+			l.send(3, 4)
+			l.send(5)
+			close(h.release)
+
+			if got := h.waitFor(t, len(tt.want)); !slices.EqualFunc(got, tt.want, slices.Equal) {
+				t.Errorf("handled %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxConcurrency(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+		want  int64
+	}{
+		{name: "default", limit: 1, want: 1},
+		{name: "limited", limit: 3, want: 3},
+		{name: "unlimited", limit: 0, want: 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestListener(t)
+			var running, peak, handled atomic.Int64
+			release := make(chan struct{})
+			l.RegisterHandler("h", func(ctx context.Context, client *botsky.Client, events []*int) error {
+				n := running.Add(1)
+				for {
+					old := peak.Load()
+					if n <= old || peak.CompareAndSwap(old, n) {
+						break
+					}
+				}
+				<-release
+				running.Add(-1)
+				handled.Add(1)
+				return nil
+			}, WithMaxConcurrency(tt.limit))
+			l.run(t)
+
+			for i := 0; i < 8; i++ {
+				l.send(i)
+			}
+			deadline := time.Now().Add(5 * time.Second)
+			for peak.Load() < tt.want && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			time.Sleep(20 * time.Millisecond)
+			close(release)
+			for handled.Load() < 8 && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+
+			if got := peak.Load(); got != tt.want {
+				t.Errorf("peak concurrency = %d, want %d", got, tt.want)
+			}
+			if got := handled.Load(); got != 8 {
+				t.Errorf("handled %d batches, want 8", got)
+			}
+		})
+	}
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	l := newTestListener(t)
+	errs := make(chan *HandlerError[int], 1)
+	l.OnError(func(ctx context.Context, err *HandlerError[int]) { errs <- err })
+	l.RegisterHandler("slow", func(ctx context.Context, client *botsky.Client, events []*int) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}, WithHandlerTimeout(20*time.Millisecond))
+	l.run(t)
+
+	l.send(1)
+	select {
+	case err := <-errs:
+		if !errors.Is(err, context.DeadlineExceeded) || err.Handler != "slow" {
+			t.Errorf("handler error = %v, want deadline exceeded of handler slow", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler didn't time out")
+	}
+	if !l.IsActive() {
+		t.Error("listener stopped after a handler timeout")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	t.Run("drains", func(t *testing.T) {
+		l := newTestListener(t)
+		h := newBlockingHandler()
+		l.RegisterHandler("h", h.handle)
+		l.run(t)
+
+		l.send(1)
+		<-h.started
+		l.send(2)
+		l.send(3)
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			close(h.release)
+		}()
+		if err := l.Shutdown(context.Background()); err != nil {
+			t.Fatalf("Shutdown error = %v", err)
+		}
+		// running and queued batches were handled before Shutdown returned
+		want := [][]int{{1}, {2}, {3}}
+		if got := h.handled(); !slices.EqualFunc(got, want, slices.Equal) {
+			t.Errorf("handled %v, want %v", got, want)
+		}
+		if l.IsActive() {
+			t.Error("listener still active after Shutdown")
+		}
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		l := newTestListener(t)
+		h := newBlockingHandler()
+		l.RegisterHandler("h", h.handle)
+		l.run(t)
+
+		l.send(1)
+		<-h.started
+		l.send(2)
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		if err := l.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Shutdown error = %v, want deadline exceeded", err)
+		}
+		// the running handler was cancelled, the queued batch is dropped
+		select {
+		case <-l.done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("run didn't finish after the handlers were cancelled")
+		}
+		l.done <- nil // for the cleanup
+		if got := h.handled(); len(got) != 0 {
+			t.Errorf("handled %v after the deadline, want nothing", got)
+		}
+	})
+}
@@ -0,0 +1,373 @@
+package listeners
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/davhofer/botsky/pkg/botsky"
+	"github.com/davhofer/indigo/api/bsky"
+	"github.com/gorilla/websocket"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Public Jetstream instance operated by Bluesky.
+const DefaultJetstreamURL = "wss://jetstream2.us-east.bsky.network/subscribe"
+
+const (
+	jetstreamMinBackoff     = time.Second
+	jetstreamMaxBackoff     = time.Minute
+	jetstreamBatchSize      = 100             // maximum number of events passed to the handlers at once
+	jetstreamCursorInterval = 5 * time.Second // how often OnCursor is called
+)
+
+// Kind of a StreamEvent.
+type StreamEventType string
+
+const (
+	EventPostCreated StreamEventType = "post"
+	EventLike        StreamEventType = "like"
+	EventFollow      StreamEventType = "follow"
+	EventRepost      StreamEventType = "repost"
+	EventDelete      StreamEventType = "delete"
+	EventOther       StreamEventType = "other" // record updates and records of other collections, see Raw
+)
+
+// Message as sent by Jetstream.
+type JetstreamMessage struct {
+	Did    string           `json:"did"`
+	TimeUS int64            `json:"time_us"`
+	Kind   string           `json:"kind"` // "commit", "identity" or "account"
+	Commit *JetstreamCommit `json:"commit,omitempty"`
+}
+
+type JetstreamCommit struct {
+	Rev        string          `json:"rev"`
+	Operation  string          `json:"operation"` // "create", "update" or "delete"
+	Collection string          `json:"collection"`
+	Rkey       string          `json:"rkey"`
+	Record     json.RawMessage `json:"record,omitempty"`
+	Cid        string          `json:"cid,omitempty"`
+}
+
+// A repo commit decoded into a typed event. Depending on Type, one of Post, Like, Follow and Repost is set.
+type StreamEvent struct {
+	Type       StreamEventType
+	Did        string // author of the record
+	Collection string
+	Rkey       string
+	Uri        string
+	Cid        string
+	TimeUS     int64 // Jetstream cursor of the event (unix microseconds)
+
+	Post   *bsky.FeedPost
+	Like   *bsky.FeedLike
+	Follow *bsky.GraphFollow
+	Repost *bsky.FeedRepost
+
+	Raw *JetstreamMessage
+}
+
+// Configuration of a JetstreamListener.
+type JetstreamConfig struct {
+	URL            string   // Jetstream subscribe endpoint, defaults to DefaultJetstreamURL
+	Collections    []string // only receive records of these collections. Defaults to posts, likes, reposts and follows
+	Dids           []string // only receive records of these accounts. Empty for all accounts
+	ZstdDictionary []byte   // Jetstream's zstd dictionary. If set, compressed messages are requested
+	Cursor         int64    // replay the events after this cursor (unix microseconds), 0 to start with live events (or the checkpoint)
+
+	// Called regularly with the cursor of the last acknowledged event, e.g. for persisting it. May be nil.
+	OnCursor func(cursor int64)
+}
+
+// Listener receiving repo commits from a Jetstream WebSocket, instead of polling.
+//
+// Handlers are registered as with the polling listeners and called (in order) with batches of events.
+// The connection is re-established with exponential backoff, resuming from the last handled event.
+type JetstreamListener struct {
+	Listener[StreamEvent]
+	config   JetstreamConfig
+	cursor   atomic.Int64  // last event acknowledged by the handlers
+	received atomic.Int64  // last received event, reconnects resume after it
+	decoder  *zstd.Decoder // decoder of the current run, nil without a dictionary
+}
+
+// Returns a set up JetstreamListener.
+func NewJetstreamListener(ctx context.Context, client *botsky.Client, config JetstreamConfig) (*JetstreamListener, error) {
+	if config.URL == "" {
+		config.URL = DefaultJetstreamURL
+	}
+	if len(config.Collections) == 0 {
+		config.Collections = []string{"app.bsky.feed.post", "app.bsky.feed.like", "app.bsky.feed.repost", "app.bsky.graph.follow"}
+	}
+	l := &JetstreamListener{
+		Listener: *NewListener[StreamEvent](ctx, client, "JetstreamListener", nil),
+		config:   config,
+	}
+	l.cursor.Store(config.Cursor)
+	l.source = l.stream
+	l.checkpointer = l
+	if len(config.ZstdDictionary) > 0 {
+		// check the dictionary, the decoder of a run is created when it starts
+		decoder, err := l.newDecoder()
+		if err != nil {
+			return nil, fmt.Errorf("NewJetstreamListener error (zstd.NewReader): %w", err)
+		}
+		decoder.Close()
+	}
+	return l, nil
+}
+
+func (l *JetstreamListener) newDecoder() (*zstd.Decoder, error) {
+	return zstd.NewReader(nil, zstd.WithDecoderDicts(l.config.ZstdDictionary))
+}
+
+// Cursor of the last event acknowledged by the handlers (unix microseconds), for resuming with JetstreamConfig.Cursor.
+func (l *JetstreamListener) Cursor() int64 {
+	return l.cursor.Load()
+}
+
+func (l *JetstreamListener) checkpoint() ([]byte, error) {
+	return strconv.AppendInt(nil, l.cursor.Load(), 10), nil
+}
+
+// Restore the cursor, unless one was configured explicitly.
+func (l *JetstreamListener) restore(checkpoint []byte) error {
+	if l.config.Cursor != 0 {
+		return nil
+	}
+	cursor, err := strconv.ParseInt(string(checkpoint), 10, 64)
+	if err != nil {
+		return err
+	}
+	l.cursor.Store(cursor)
+	return nil
+}
+
+// Move the cursor to the acknowledged batch.
+func (l *JetstreamListener) acknowledged(ctx context.Context, checkpoint []byte) {
+	if cursor, err := strconv.ParseInt(string(checkpoint), 10, 64); err == nil {
+		l.cursor.Store(cursor)
+	}
+}
+
+// Event source of the listener: receive events and pass them to the handlers in order.
+func (l *JetstreamListener) stream(ctx context.Context, handlerCtx context.Context) {
+	// events which were received but not handled in a previous run are received again
+	l.received.Store(l.cursor.Load())
+	l.decoder = nil
+	if len(l.config.ZstdDictionary) > 0 {
+		decoder, err := l.newDecoder()
+		if err != nil {
+			l.getLogger().Error("Creating zstd decoder failed", "error", err)
+			return
+		}
+		defer decoder.Close()
+		l.decoder = decoder
+	}
+	events := make(chan *StreamEvent, 1024)
+	go l.receive(ctx, events)
+	l.handleBatches(ctx, handlerCtx, events)
+}
+
+// Subscribe url including filters and cursor.
+func (l *JetstreamListener) subscribeURL() (string, error) {
+	u, err := url.Parse(l.config.URL)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	for _, collection := range l.config.Collections {
+		query.Add("wantedCollections", collection)
+	}
+	for _, did := range l.config.Dids {
+		query.Add("wantedDids", did)
+	}
+	if l.decoder != nil {
+		query.Set("compress", "true")
+	}
+	if cursor := l.received.Load(); cursor > 0 {
+		// Jetstream replays from the cursor inclusively
+		query.Set("cursor", strconv.FormatInt(cursor+1, 10))
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// Connection loop, reconnecting with backoff. Decoded events are sent to the dispatcher.
+func (l *JetstreamListener) receive(ctx context.Context, events chan<- *StreamEvent) {
+	defer close(events)
+
+	backoff := time.Duration(0)
+	for {
+		received, err := l.connect(ctx, events)
+		if ctx.Err() != nil {
+			return
+		}
+		if received {
+			backoff = 0
+		}
+		backoff = min(max(2*backoff, jetstreamMinBackoff), jetstreamMaxBackoff)
+		wait := backoff/2 + rand.N(backoff/2+1)
+		l.getLogger().Warn("Jetstream connection lost, reconnecting", "error", err, "backoff", wait, "cursor", l.received.Load())
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// Connect and read messages until the connection fails or ctx is cancelled. Reports whether any message was received.
+func (l *JetstreamListener) connect(ctx context.Context, events chan<- *StreamEvent) (bool, error) {
+	subscribeURL, err := l.subscribeURL()
+	if err != nil {
+		return false, err
+	}
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, subscribeURL, nil)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	l.getLogger().Debug("Jetstream connected", "cursor", l.received.Load())
+
+	// unblock ReadMessage when the listener is stopped
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	received := false
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			return received, err
+		}
+		received = true
+		if messageType == websocket.BinaryMessage && l.decoder != nil {
+			if data, err = l.decoder.DecodeAll(data, nil); err != nil {
+				l.getLogger().Warn("Decompressing Jetstream message failed", "error", err)
+				continue
+			}
+		}
+
+		var message JetstreamMessage
+		if err := json.Unmarshal(data, &message); err != nil {
+			l.getLogger().Warn("Decoding Jetstream message failed", "error", err)
+			continue
+		}
+		event := decodeStreamEvent(&message)
+		if event == nil {
+			// identity and account events are not passed to handlers
+			continue
+		}
+		select {
+		case events <- event:
+			l.received.Store(event.TimeUS)
+		case <-ctx.Done():
+			return received, ctx.Err()
+		}
+	}
+}
+
+// Decode a commit message into a typed event. Returns nil for non-commit messages.
+func decodeStreamEvent(message *JetstreamMessage) *StreamEvent {
+	commit := message.Commit
+	if message.Kind != "commit" || commit == nil {
+		return nil
+	}
+	event := &StreamEvent{
+		Type:       EventOther,
+		Did:        message.Did,
+		Collection: commit.Collection,
+		Rkey:       commit.Rkey,
+		Uri:        fmt.Sprintf("at://%s/%s/%s", message.Did, commit.Collection, commit.Rkey),
+		Cid:        commit.Cid,
+		TimeUS:     message.TimeUS,
+		Raw:        message,
+	}
+	if commit.Operation == "delete" {
+		event.Type = EventDelete
+		return event
+	}
+	if commit.Operation != "create" {
+		return event
+	}
+
+	var err error
+	switch commit.Collection {
+	case "app.bsky.feed.post":
+		event.Post = &bsky.FeedPost{}
+		if err = json.Unmarshal(commit.Record, event.Post); err == nil {
+			event.Type = EventPostCreated
+		}
+	case "app.bsky.feed.like":
+		event.Like = &bsky.FeedLike{}
+		if err = json.Unmarshal(commit.Record, event.Like); err == nil {
+			event.Type = EventLike
+		}
+	case "app.bsky.feed.repost":
+		event.Repost = &bsky.FeedRepost{}
+		if err = json.Unmarshal(commit.Record, event.Repost); err == nil {
+			event.Type = EventRepost
+		}
+	case "app.bsky.graph.follow":
+		event.Follow = &bsky.GraphFollow{}
+		if err = json.Unmarshal(commit.Record, event.Follow); err == nil {
+			event.Type = EventFollow
+		}
+	}
+	if err != nil {
+		// keep the raw record, but don't hand out a half-decoded one
+		event.Post, event.Like, event.Repost, event.Follow = nil, nil, nil, nil
+	}
+	return event
+}
+
+// Pass events to the handlers in batches, in the order they were received. Returns once events is closed.
+//
+// Once the listener is stopped (sourceCtx is done), the buffered events are discarded instead of being passed
+// to the handlers, they are received again after a restart.
+func (l *JetstreamListener) handleBatches(sourceCtx context.Context, ctx context.Context, events <-chan *StreamEvent) {
+	lastCursorUpdate := time.Now()
+
+	for event := range events {
+		batch := []*StreamEvent{event}
+	collect:
+		for len(batch) < jetstreamBatchSize {
+			select {
+			case next, ok := <-events:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, next)
+			default:
+				break collect
+			}
+		}
+
+		if sourceCtx.Err() != nil {
+			continue
+		}
+
+		// the cursor moves once the handlers acknowledged the batch, see acknowledged
+		checkpoint := strconv.AppendInt(nil, batch[len(batch)-1].TimeUS, 10)
+		// wait for the handlers, so the next batch isn't handled before this one
+		l.dispatch(ctx, batch, checkpoint)
+		l.inflight.Wait()
+
+		if l.config.OnCursor != nil && (time.Since(lastCursorUpdate) >= jetstreamCursorInterval || ctx.Err() != nil) {
+			l.config.OnCursor(l.cursor.Load())
+			lastCursorUpdate = time.Now()
+		}
+	}
+	if l.config.OnCursor != nil {
+		l.config.OnCursor(l.cursor.Load())
+	}
+}
@@ -0,0 +1,339 @@
+package listeners
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/davhofer/botsky/pkg/botsky"
+	"github.com/gorilla/websocket"
+)
+
+func newTestClient(t *testing.T, options ...botsky.Option) *botsky.Client {
+	t.Helper()
+	options = append([]botsky.Option{
+		botsky.WithEagerDIDResolution(false),
+		botsky.WithoutLogging(),
+	}, options...)
+	client, err := botsky.NewClient(context.Background(), "did:plc:bot", "", options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func commitMessage(timeUS int64, operation string, collection string, record string) JetstreamMessage {
+	return JetstreamMessage{
+		Did:    "did:plc:alice",
+		TimeUS: timeUS,
+		Kind:   "commit",
+		Commit: &JetstreamCommit{
+			Rev:        "rev" + strconv.FormatInt(timeUS, 10),
+			Operation:  operation,
+			Collection: collection,
+			Rkey:       "rkey" + strconv.FormatInt(timeUS, 10),
+			Record:     json.RawMessage(record),
+			Cid:        "cid" + strconv.FormatInt(timeUS, 10),
+		},
+	}
+}
+
+var testJetstreamMessages = []JetstreamMessage{
+	commitMessage(1, "create", "app.bsky.feed.post", `{"$type":"app.bsky.feed.post","text":"hello","createdAt":"2024-01-01T00:00:00Z"}`),
+	commitMessage(2, "create", "app.bsky.feed.like", `{"$type":"app.bsky.feed.like","subject":{"uri":"at://did:plc:bot/app.bsky.feed.post/1","cid":"bafy"},"createdAt":"2024-01-01T00:00:00Z"}`),
+	{Did: "did:plc:alice", TimeUS: 3, Kind: "identity"},
+	commitMessage(4, "create", "app.bsky.graph.follow", `{"$type":"app.bsky.graph.follow","subject":"did:plc:bot","createdAt":"2024-01-01T00:00:00Z"}`),
+	commitMessage(5, "create", "app.bsky.feed.threadgate", `{"$type":"app.bsky.feed.threadgate"}`),
+	commitMessage(6, "delete", "app.bsky.feed.post", ``),
+	commitMessage(7, "create", "app.bsky.feed.repost", `{"$type":"app.bsky.feed.repost","subject":{"uri":"at://did:plc:bot/app.bsky.feed.post/1","cid":"bafy"},"createdAt":"2024-01-01T00:00:00Z"}`),
+	commitMessage(8, "update", "app.bsky.feed.post", `{"$type":"app.bsky.feed.post","text":"edited","createdAt":"2024-01-01T00:00:00Z"}`),
+	commitMessage(9, "create", "app.bsky.feed.post", `{"$type":"app.bsky.feed.post","text":42}`), // undecodable record
+}
+
+// Local stand-in for a Jetstream instance, replaying testJetstreamMessages.
+type jetstreamStandIn struct {
+	*httptest.Server
+	dropAfter int // the first connection is closed after this many messages, 0 to keep it open
+
+	mutex       sync.Mutex
+	queries     []string // query of every connection
+	connections chan struct{}
+}
+
+func newJetstreamStandIn(t *testing.T, dropAfter int) *jetstreamStandIn {
+	s := &jetstreamStandIn{dropAfter: dropAfter, connections: make(chan struct{}, 10)}
+	upgrader := websocket.Upgrader{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		s.mutex.Lock()
+		s.queries = append(s.queries, r.URL.RawQuery)
+		first := len(s.queries) == 1
+		s.mutex.Unlock()
+		s.connections <- struct{}{}
+
+		query := r.URL.Query()
+		cursor, _ := strconv.ParseInt(query.Get("cursor"), 10, 64)
+		wanted := query["wantedCollections"]
+		sent := 0
+		for _, message := range testJetstreamMessages {
+			if message.TimeUS < cursor {
+				continue
+			}
+			if message.Commit != nil && !slices.Contains(wanted, message.Commit.Collection) {
+				continue
+			}
+			if first && s.dropAfter > 0 && sent == s.dropAfter {
+				return
+			}
+			if err := conn.WriteJSON(message); err != nil {
+				return
+			}
+			sent++
+		}
+		// keep the connection open until the client closes it
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *jetstreamStandIn) url() string {
+	return "ws" + strings.TrimPrefix(s.URL, "http")
+}
+
+func (s *jetstreamStandIn) query(i int) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if i >= len(s.queries) {
+		return ""
+	}
+	return s.queries[i]
+}
+
+// Collects the delivered events.
+type eventRecorder struct {
+	mutex  sync.Mutex
+	events []*StreamEvent
+	calls  atomic.Int64
+}
+
+func (r *eventRecorder) record(events []*StreamEvent) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.events = append(r.events, events...)
+}
+
+func (r *eventRecorder) times() []int64 {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var times []int64
+	for _, event := range r.events {
+		times = append(times, event.TimeUS)
+	}
+	return times
+}
+
+func (r *eventRecorder) waitFor(t *testing.T, count int) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for len(r.times()) < count {
+		if time.Now().After(deadline) {
+			t.Fatalf("received %v, want %d events", r.times(), count)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestJetstreamListener(t *testing.T) {
+	standIn := newJetstreamStandIn(t, 2)
+	listener, err := NewJetstreamListener(context.Background(), newTestClient(t), JetstreamConfig{URL: standIn.url()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var recorder eventRecorder
+	reconnected := make(chan struct{})
+	listener.RegisterHandler("record", func(ctx context.Context, client *botsky.Client, events []*StreamEvent) error {
+		if recorder.calls.Add(1) == 1 {
+			// keep the first batch busy until the stand-in dropped the connection and the listener reconnected,
+			// so the remaining received events are still buffered
+			select {
+			case <-reconnected:
+			case <-time.After(10 * time.Second):
+			}
+		}
+		recorder.record(events)
+		return nil
+	})
+	var lastCursor atomic.Int64
+	listener.config.OnCursor = func(cursor int64) { lastCursor.Store(cursor) }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error)
+	go func() { done <- listener.Run(ctx) }()
+
+	<-standIn.connections
+	select {
+	case <-standIn.connections:
+		close(reconnected)
+	case <-time.After(10 * time.Second):
+		t.Fatal("listener did not reconnect")
+	}
+
+	// the threadgate isn't requested, the identity event isn't delivered, every event is delivered once
+	want := []int64{1, 2, 4, 6, 7, 8, 9}
+	recorder.waitFor(t, len(want))
+	time.Sleep(50 * time.Millisecond)
+	if got := recorder.times(); !slices.Equal(got, want) {
+		t.Errorf("delivered %v, want %v", got, want)
+	}
+
+	// filters were requested, and the reconnect resumed after the last received event
+	first, second := standIn.query(0), standIn.query(1)
+	for _, collection := range []string{"app.bsky.feed.post", "app.bsky.feed.like", "app.bsky.feed.repost", "app.bsky.graph.follow"} {
+		if !strings.Contains(first, "wantedCollections="+collection) {
+			t.Errorf("query %q doesn't request %s", first, collection)
+		}
+	}
+	if strings.Contains(first, "cursor=") {
+		t.Errorf("first connection requested a cursor: %q", first)
+	}
+	if !strings.Contains(second, "cursor=3") {
+		t.Errorf("reconnect query %q, want cursor=3", second)
+	}
+
+	// decoded events
+	recorder.mutex.Lock()
+	events := recorder.events
+	recorder.mutex.Unlock()
+	checks := []struct {
+		typ StreamEventType
+		ok  bool
+	}{
+		{EventPostCreated, events[0].Post != nil && events[0].Post.Text == "hello"},
+		{EventLike, events[1].Like != nil && events[1].Like.Subject.Uri == "at://did:plc:bot/app.bsky.feed.post/1"},
+		{EventFollow, events[2].Follow != nil && events[2].Follow.Subject == "did:plc:bot"},
+		{EventDelete, events[3].Uri == "at://did:plc:alice/app.bsky.feed.post/rkey6"},
+		{EventRepost, events[4].Repost != nil},
+		{EventOther, events[5].Post == nil},
+		{EventOther, events[6].Post == nil && events[6].Raw != nil},
+	}
+	for i, check := range checks {
+		if events[i].Type != check.typ || !check.ok {
+			t.Errorf("event %d = %s %+v, want %s", i, events[i].Type, events[i], check.typ)
+		}
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Run error = %v", err)
+	}
+	if cursor := listener.Cursor(); cursor != 9 || lastCursor.Load() != 9 {
+		t.Errorf("cursor = %d, OnCursor got %d, want 9", cursor, lastCursor.Load())
+	}
+}
+
+// Events buffered when the listener is stopped aren't passed to the handlers with a cancelled context.
+func TestJetstreamListenerStopDiscardsBuffered(t *testing.T) {
+	standIn := newJetstreamStandIn(t, 0)
+	listener, err := NewJetstreamListener(context.Background(), newTestClient(t), JetstreamConfig{URL: standIn.url()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	var recorder eventRecorder
+	listener.RegisterHandler("record", func(ctx context.Context, client *botsky.Client, events []*StreamEvent) error {
+		if recorder.calls.Add(1) == 1 {
+			close(started)
+			<-ctx.Done()
+		}
+		recorder.record(events)
+		return nil
+	})
+	var failures atomic.Int64
+	listener.OnError(func(ctx context.Context, err *HandlerError[StreamEvent]) { failures.Add(1) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- listener.Run(ctx) }()
+	<-started
+	// let the remaining events arrive in the buffer
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	<-done
+
+	if calls := recorder.calls.Load(); calls != 1 {
+		t.Errorf("handler called %d times after the listener was stopped, want only the running batch", calls)
+	}
+	if n := failures.Load(); n != 0 {
+		t.Errorf("%d batches failed", n)
+	}
+	// the next run continues after the handled events
+	handled := recorder.times()
+	if cursor := listener.Cursor(); cursor != handled[len(handled)-1] {
+		t.Errorf("cursor = %d, want %d", cursor, handled[len(handled)-1])
+	}
+}
+
+// A batch whose handler was cancelled before acknowledging it doesn't move the cursor,
+// so the next run receives it again.
+func TestJetstreamListenerCursorOnlyForAcknowledged(t *testing.T) {
+	standIn := newJetstreamStandIn(t, 0)
+	listener, err := NewJetstreamListener(context.Background(), newTestClient(t), JetstreamConfig{URL: standIn.url()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	var recorder eventRecorder
+	listener.RegisterHandler("record", func(ctx context.Context, client *botsky.Client, events []*StreamEvent) error {
+		recorder.record(events)
+		if recorder.calls.Add(1) == 1 {
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	})
+	var lastCursor atomic.Int64
+	listener.config.OnCursor = func(cursor int64) { lastCursor.Store(cursor) }
+
+	go listener.Run(context.Background())
+	<-started
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	listener.Shutdown(shutdownCtx)
+	waitUntil(t, "stop", func() bool { return !listener.IsActive() })
+	if cursor := listener.Cursor(); cursor != 0 || lastCursor.Load() != 0 {
+		t.Fatalf("cursor = %d, OnCursor got %d after the handler was cancelled, want 0", cursor, lastCursor.Load())
+	}
+
+	// the next run starts from the beginning again
+	ctx, cancelRun := context.WithCancel(context.Background())
+	defer cancelRun()
+	go listener.Run(ctx)
+	waitUntil(t, "acknowledgement", func() bool { return listener.Cursor() == 9 })
+	times := recorder.times()
+	if first := slices.Index(times[1:], times[0]); first < 0 {
+		t.Errorf("delivered %v, want the cancelled events again", times)
+	}
+}
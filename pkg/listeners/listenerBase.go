@@ -2,28 +2,80 @@ package listeners
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/davhofer/botsky/pkg/botsky"
+	"log/slog"
+	"maps"
+	"math/rand/v2"
+	"runtime/debug"
 	"sync"
 	"time"
 )
 
 // Generic event handler class for the listener.
-type Handler[EventT any] func(context.Context, *botsky.Client, []*EventT)
+//
+// A returned error is logged and, depending on the handler's options, leads to retries or a dead letter.
+type Handler[EventT any] func(context.Context, *botsky.Client, []*EventT) error
+
+// Observes listener activity, e.g. for tracing and metrics (see package instrumentation).
+//
+// ObservePoll must call poll, ObserveHandler must call handle, and both may wrap the call (e.g. in a span)
+// and pass on a derived context.
+type Observer interface {
+	ObservePoll(ctx context.Context, listener string, poll func(context.Context) (int, error)) error
+	ObserveHandler(ctx context.Context, listener string, handler string, events int, handle func(context.Context) error)
+}
+
+// Observer which just runs the poll and handlers.
+type noopObserver struct{}
+
+func (noopObserver) ObservePoll(ctx context.Context, listener string, poll func(context.Context) (int, error)) error {
+	_, err := poll(ctx)
+	return err
+}
+
+func (noopObserver) ObserveHandler(ctx context.Context, listener string, handler string, events int, handle func(context.Context) error) {
+	handle(ctx)
+}
 
 // Generic event listener.
+//
+// A listener runs until the context passed to Run is cancelled, or until Shutdown is called.
+// Handlers are called with a context derived from the run context, so cancelling it propagates to them.
+// All methods are safe for concurrent use.
 type Listener[EventT any] struct {
-	Name            string
-	Client          *botsky.Client
-	ctx             context.Context
-	Active          bool
-	Handlers        map[string]Handler[EventT]
-	stopSignal      chan bool
-	PollingInterval time.Duration
-	mutex           sync.Mutex
-	pollEventsFunc  func(context.Context, *botsky.Client) ([]*EventT, error) // gets called every PollingInterval seconds to get a list of events which will then be passed to the handlers
+	Name   string
+	Client *botsky.Client
+	ctx    context.Context // parent context of Start
+
+	mutex           sync.Mutex // guards the fields below
+	handlers        map[string]*registeredHandler[EventT]
+	pollingStrategy PollingStrategy
+	logger          *slog.Logger
+	observer        Observer
+	onError         func(context.Context, *HandlerError[EventT])
+	middleware      []Middleware[EventT]
+	checkpoints     CheckpointStore
+	acks            *ackTracker // acknowledgements of the current run
+	running         bool
+	stopSource      context.CancelFunc // stops receiving new events
+	cancel          context.CancelFunc // cancels the run context, and with it the handler contexts
+	done            chan struct{}      // closed when the current run has finished
+
+	intervalChanged chan struct{}
+	inflight        sync.WaitGroup                                           // running handlers
+	pollEventsFunc  func(context.Context, *botsky.Client) ([]*EventT, error) // gets called every polling interval to get a list of events which will then be passed to the handlers
+
+	// Receives events until ctx is done and dispatches them with handlerCtx. Defaults to polling with pollEventsFunc.
+	source func(ctx context.Context, handlerCtx context.Context)
+	// Cursor of the listener, persisted with the checkpoint store. nil if the listener has no cursor.
+	checkpointer checkpointer
 }
 
+// Returned by Run if the listener is already running.
+var ErrListenerRunning = errors.New("listener is already running")
+
 // Creates a new listener. The pollEvents argument is a function that gets called in order to fetch the newest set of events to be handled.
 func NewListener[EventT any](ctx context.Context, client *botsky.Client, name string, pollEvents func(context.Context, *botsky.Client) ([]*EventT, error)) *Listener[EventT] {
 	if name == "" {
@@ -33,113 +85,312 @@ func NewListener[EventT any](ctx context.Context, client *botsky.Client, name st
 		Name:            name,
 		Client:          client,
 		ctx:             ctx,
-		Active:          false,
-		Handlers:        make(map[string]Handler[EventT]),
-		stopSignal:      make(chan bool, 1),
-		PollingInterval: time.Duration(time.Second * 5), // Default polling interval: 5s
+		handlers:        make(map[string]*registeredHandler[EventT]),
+		pollingStrategy: DefaultPollingStrategy,
+		logger:          client.Logger().With("listener", name),
+		observer:        noopObserver{},
+		intervalChanged: make(chan struct{}, 1),
 		pollEventsFunc:  pollEvents,
 	}
 }
 
-// Set how frequently the listener polls for new events.
-func (l *Listener[EventT]) SetPollingInterval(seconds uint) {
-	// set to default
-	if seconds == 0 {
-		seconds = 5
-	}
-	restart := false
-	if l.Active {
-		l.Stop()
-		restart = true
-	}
-	l.PollingInterval = time.Duration(time.Duration(seconds) * time.Second)
-	if restart {
-		l.Start()
-	}
+// Set the observer of the listener's polls and handler invocations.
+func (l *Listener[EventT]) SetObserver(observer Observer) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.observer = observer
+}
+
+// Set the logger of the listener. By default, the client's logger is used.
+func (l *Listener[EventT]) SetLogger(logger *slog.Logger) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.logger = logger.With("listener", l.Name)
+}
+
+func (l *Listener[EventT]) getLogger() *slog.Logger {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.logger
+}
+
+func (l *Listener[EventT]) getObserver() Observer {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.observer
+}
+
+// Set how frequently the listener polls for new events while there is activity (see PollingStrategy.Interval).
+// 0 resets it to DefaultPollingInterval. Takes effect immediately, also while running.
+func (l *Listener[EventT]) SetPollingInterval(interval time.Duration) {
+	strategy := l.PollingStrategy()
+	strategy.Interval = interval
+	l.SetPollingStrategy(strategy)
+}
+
+// How frequently the listener polls for new events while there is activity.
+func (l *Listener[EventT]) PollingInterval() time.Duration {
+	return l.PollingStrategy().Interval
+}
+
+// Whether the listener is currently running.
+func (l *Listener[EventT]) IsActive() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.running
 }
 
 // Try to register a new event handler. The id must be unique.
 //
 // Every registered event handler gets called on the full list of polled events.
-func (l *Listener[EventT]) RegisterHandler(id string, handler Handler[EventT]) error {
-	if _, exists := l.Handlers[id]; exists {
+// By default, a handler handles one batch at a time and further batches are queued, see HandlerOption.
+func (l *Listener[EventT]) RegisterHandler(id string, handler Handler[EventT], options ...HandlerOption) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, exists := l.handlers[id]; exists {
 		return fmt.Errorf("Handler with id %s already exists.", id)
 	}
-	l.Handlers[id] = handler
+	h := newRegisteredHandler(id, handler, options)
+	h.wrap(l.middleware)
+	l.handlers[id] = h
 	return nil
 }
 
 // Deregister (i.e. deactivate) a registered event handler.
 func (l *Listener[EventT]) DeregisterHandler(id string) error {
-	if _, exists := l.Handlers[id]; !exists {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, exists := l.handlers[id]; !exists {
 		return fmt.Errorf("Handler with id %s is not registered.", id)
 	}
-	delete(l.Handlers, id)
+	delete(l.handlers, id)
 	return nil
 }
 
-// Start listening (polling) in the background. This starts a new go routine.
+// Listen until ctx is cancelled or Shutdown is called. Blocks until the handlers started by this run have returned.
+//
+// Cancelling ctx also cancels the contexts of running handlers. Returns ErrListenerRunning if the listener is already running,
+// or an error if the checkpoint couldn't be loaded.
+func (l *Listener[EventT]) Run(ctx context.Context) error {
+	run, err := l.begin(ctx)
+	if err != nil {
+		return err
+	}
+	run()
+	return nil
+}
+
+// Start listening in the background, until the listener context is cancelled or Stop/Shutdown is called.
 func (l *Listener[EventT]) Start() {
-	if l.Active {
-		fmt.Println(l.Name, "is already active.")
+	run, err := l.begin(l.ctx)
+	if errors.Is(err, ErrListenerRunning) {
+		l.getLogger().Warn("Listener is already active")
+		return
+	}
+	if err != nil {
+		l.getLogger().Error("Starting listener failed", "error", err)
 		return
 	}
-	l.Active = true
-	go l.listen()
+	go run()
 }
 
-// Stop listening.
+// Stop listening and wait for running handlers to return. Equivalent to Shutdown without a deadline.
 func (l *Listener[EventT]) Stop() {
-	if !l.Active {
-		fmt.Println(l.Name, "is already stopped.")
+	if !l.IsActive() {
+		l.getLogger().Warn("Listener is already stopped")
 		return
 	}
-	l.stopSignal <- true
-	l.Active = false
+	l.Shutdown(context.Background())
 }
 
-// Continuous loop that listens and distributes polled events to handlers.
-// Is run as a goroutine.
-func (l *Listener[EventT]) listen() {
-	ticker := time.NewTicker(l.PollingInterval)
-	fmt.Println(l.Name, "started")
-	defer fmt.Println(l.Name, "stopped")
-	defer ticker.Stop()
+// Stop receiving new events and wait for running handlers to return.
+//
+// If ctx is done before the handlers returned, their contexts are cancelled and ctx.Err() is returned
+// without waiting any further. Does nothing if the listener is not running.
+func (l *Listener[EventT]) Shutdown(ctx context.Context) error {
+	l.mutex.Lock()
+	if !l.running {
+		l.mutex.Unlock()
+		return nil
+	}
+	stopSource, cancel, done := l.stopSource, l.cancel, l.done
+	l.mutex.Unlock()
+
+	stopSource()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		cancel()
+		return ctx.Err()
+	}
+}
+
+// Restore the checkpoint, mark the listener as running and set up the contexts of a run. The returned function executes the run.
+func (l *Listener[EventT]) begin(ctx context.Context) (func(), error) {
+	if l.IsActive() {
+		return nil, ErrListenerRunning
+	}
+	if err := l.loadCheckpoint(ctx); err != nil {
+		return nil, err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.running {
+		return nil, ErrListenerRunning
+	}
+	handlerCtx, cancel := context.WithCancel(ctx)
+	l.acks = newAckTracker(handlerCtx, l.saveCheckpoint)
+	sourceCtx, stopSource := context.WithCancel(handlerCtx)
+	done := make(chan struct{})
+	l.running, l.stopSource, l.cancel, l.done = true, stopSource, cancel, done
+	source := l.source
+	if source == nil {
+		source = l.poll
+	}
+	logger := l.logger
+
+	return func() {
+		logger.Info("Listener started", "did", l.Client.Did)
+		source(sourceCtx, handlerCtx)
+		l.inflight.Wait()
+		cancel()
+		logger.Info("Listener stopped")
+
+		l.mutex.Lock()
+		l.running = false
+		l.mutex.Unlock()
+		close(done)
+	}, nil
+}
+
+// Polling loop, passing polled events to the handlers until ctx is done.
+func (l *Listener[EventT]) poll(ctx context.Context, handlerCtx context.Context) {
+	var backoff pollBackoff
+	timer := time.NewTimer(l.PollingStrategy().first())
+	defer timer.Stop()
 
 	for {
 		select {
-		case <-l.stopSignal:
+		case <-ctx.Done():
 			return
-		case <-ticker.C:
+		case <-l.intervalChanged:
+			backoff = pollBackoff{}
+			timer.Reset(l.PollingStrategy().first())
+		case <-timer.C:
 
-			events, err := l.pollEventsFunc(l.ctx, l.Client)
+			logger := l.getLogger()
+			start := time.Now()
+			var events []*EventT
+			err := l.getObserver().ObservePoll(ctx, l.Name, func(ctx context.Context) (int, error) {
+				var err error
+				events, err = l.pollEventsFunc(ctx, l.Client)
+				return len(events), err
+			})
+			delay := l.PollingStrategy().next(&backoff, len(events), err)
+			timer.Reset(delay)
 			if err != nil {
-				// TODO: logging/error handling...
-				fmt.Println(l.Name, "pollAndHandle error:", err)
+				if ctx.Err() == nil {
+					logger.Error("Polling events failed", "error", err, "duration", time.Since(start), "failures", backoff.failures, "backoff", delay)
+				}
 				continue
 			}
+			logger.Debug("Polled events", "count", len(events), "duration", time.Since(start), "interval", delay)
 
 			if len(events) == 0 {
 				continue
 			}
+			l.dispatch(handlerCtx, events, l.currentCheckpoint())
+		}
+	}
+}
 
-			for id, handler := range l.Handlers {
-				// pass in the associated id with the context
-				go handler(context.WithValue(l.ctx, "id", id), l.Client, events)
-			}
+// Pass the events to all registered handlers, which run in their own (tracked) goroutines.
+// The checkpoint (may be nil) is saved once all handlers acknowledged the batch.
+func (l *Listener[EventT]) dispatch(ctx context.Context, events []*EventT, checkpoint []byte) {
+	l.mutex.Lock()
+	handlers := maps.Clone(l.handlers)
+	acks := l.acks
+	l.mutex.Unlock()
 
+	ack := acks.add(len(handlers), checkpoint)
+	for _, h := range handlers {
+		l.submit(ctx, h, events, ack)
+	}
+}
+
+// Run a handler on the polled events, retrying failed invocations according to its options.
+//
+// Reports whether the events were acknowledged, i.e. handled or given up on, and not interrupted by cancellation.
+// Interrupted events aren't passed to the dead letter sink, they are delivered again after a restart.
+func (l *Listener[EventT]) runHandler(ctx context.Context, h *registeredHandler[EventT], events []*EventT) bool {
+	for attempt := 1; ; attempt++ {
+		err := l.invoke(ctx, h, events)
+		if err == nil {
+			return true
+		}
+		if ctx.Err() != nil {
+			l.getLogger().Warn("Handler interrupted by cancellation", "handler", h.id, "events", len(events), "error", err)
+			return false
+		}
+		// retry (and give up on) only the events the handler failed on
+		if failed := failedEvents(err, events); len(failed) > 0 {
+			events = failed
+		}
+		if attempt > h.config.retries {
+			l.handleError(ctx, h, &HandlerError[EventT]{Listener: l.Name, Handler: h.id, Events: events, Attempts: attempt, Err: err})
+			return true
+		}
+
+		// exponential backoff with full jitter
+		backoff := h.config.retryBackoff << (attempt - 1)
+		if backoff <= 0 || backoff > time.Minute {
+			backoff = time.Minute
+		}
+		delay := time.Duration(rand.Int64N(int64(backoff))) + 1
+		l.getLogger().Warn("Handler failed, retrying", "handler", h.id, "attempt", attempt, "error", err, "backoff", delay)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			l.getLogger().Warn("Handler retry interrupted by cancellation", "handler", h.id, "events", len(events), "error", err)
+			return false
+		case <-timer.C:
 		}
 	}
 }
 
+// Invoke a handler once, recovering a panic and logging its duration.
+func (l *Listener[EventT]) invoke(ctx context.Context, h *registeredHandler[EventT], events []*EventT) (err error) {
+	if h.config.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.config.timeout)
+		defer cancel()
+	}
+	start := time.Now()
+	// pass in the associated id with the context
+	l.getObserver().ObserveHandler(context.WithValue(ctx, "id", h.id), l.Name, h.id, len(events), func(ctx context.Context) (handleErr error) {
+		defer func() {
+			if r := recover(); r != nil {
+				handleErr = &PanicError{Value: r, Stack: debug.Stack()}
+				err = handleErr
+			}
+		}()
+		h.mutex.Lock()
+		handle := h.handle
+		h.mutex.Unlock()
+		err = handle(ctx, l.Client, events)
+		return err
+	})
+	l.getLogger().Debug("Handler finished", "handler", h.id, "events", len(events), "duration", time.Since(start), "error", err)
+	return err
+}
+
 /*
 handler functions can be closures, to include e.g. pointers to containers for storing results, channels, the client, etc. to handlers
 
-user must take care of errors in handler, e.g. by logging
-
-TODO: cancellation/timeout of handlers?
-TODO: logging
-
 should we directly implement specific event handlers? e.g.
 OnMention() {}
 OnLike() {}
@@ -0,0 +1,248 @@
+package listeners
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/davhofer/botsky/pkg/botsky"
+	"github.com/davhofer/indigo/api/bsky"
+	"github.com/davhofer/indigo/api/chat"
+)
+
+// Wraps a handler, e.g. to filter events or to log invocations.
+//
+// A middleware is applied to each handler separately, so state created when wrapping (e.g. seen IDs) isn't
+// shared between handlers.
+type Middleware[EventT any] func(Handler[EventT]) Handler[EventT]
+
+// Add middleware to all handlers of the listener, including those registered later.
+// The first middleware is the outermost one, i.e. it sees the events first. Middleware added by a later call
+// wraps the middleware added before, which keeps its state (e.g. seen IDs).
+func (l *Listener[EventT]) Use(middleware ...Middleware[EventT]) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.middleware = append(slices.Clone(middleware), l.middleware...)
+	for _, h := range l.handlers {
+		h.mutex.Lock()
+		h.handle = chain(middleware, h.handle)
+		h.mutex.Unlock()
+	}
+}
+
+// Apply the listener's middleware to a newly registered handler.
+func (h *registeredHandler[EventT]) wrap(middleware []Middleware[EventT]) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.handle = chain(middleware, h.handler)
+}
+
+// Wrap the handler in the middleware, the first one outermost.
+func chain[EventT any](middleware []Middleware[EventT], handle Handler[EventT]) Handler[EventT] {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handle = middleware[i](handle)
+	}
+	return handle
+}
+
+// Keep the events for which keep returns true, and only call the handler if there are any left.
+func filterEvents[EventT any](next Handler[EventT], keep func(client *botsky.Client, event *EventT) bool) Handler[EventT] {
+	return func(ctx context.Context, client *botsky.Client, events []*EventT) error {
+		kept := make([]*EventT, 0, len(events))
+		for _, event := range events {
+			if keep(client, event) {
+				kept = append(kept, event)
+			}
+		}
+		if len(kept) == 0 {
+			return nil
+		}
+		return next(ctx, client, kept)
+	}
+}
+
+// Drop the events caused by the bot itself, e.g. its own chat messages. author returns the DID of an event's author.
+func FilterSelf[EventT any](author func(*EventT) string) Middleware[EventT] {
+	return func(next Handler[EventT]) Handler[EventT] {
+		return filterEvents(next, func(client *botsky.Client, event *EventT) bool {
+			return author(event) != client.Did
+		})
+	}
+}
+
+// Drop events that were already handled successfully within the ttl, identified by id (e.g. the record URI).
+// Events for which id returns false have no ID and are always passed on.
+//
+// Events are only remembered once the handler succeeded, so retries and replays aren't dropped.
+func Dedupe[EventT any](id func(*EventT) (string, bool), ttl time.Duration) Middleware[EventT] {
+	return func(next Handler[EventT]) Handler[EventT] {
+		var mutex sync.Mutex
+		seen := make(map[string]time.Time) // expiry by id
+
+		return func(ctx context.Context, client *botsky.Client, events []*EventT) error {
+			now := time.Now()
+			mutex.Lock()
+			for key, expiry := range seen {
+				if now.After(expiry) {
+					delete(seen, key)
+				}
+			}
+			fresh := make([]*EventT, 0, len(events))
+			for _, event := range events {
+				key, ok := id(event)
+				if _, duplicate := seen[key]; !ok || !duplicate {
+					fresh = append(fresh, event)
+				}
+			}
+			mutex.Unlock()
+			if len(fresh) < len(events) {
+				client.Logger().Debug("Dropping duplicate events", "handler", ctx.Value("id"), "count", len(events)-len(fresh))
+			}
+			if len(fresh) == 0 {
+				return nil
+			}
+
+			err := next(ctx, client, fresh)
+			failed := failedEvents(err, fresh)
+			mutex.Lock()
+			defer mutex.Unlock()
+			for _, event := range fresh {
+				if key, ok := id(event); ok && !slices.Contains(failed, event) {
+					seen[key] = now.Add(ttl)
+				}
+			}
+			return err
+		}
+	}
+}
+
+// Pass at most limit events per author within the window to the handler, dropping the rest.
+// author returns the DID of an event's author. Events are only counted if the handler succeeded.
+func RateLimitAuthors[EventT any](author func(*EventT) string, limit int, window time.Duration) Middleware[EventT] {
+	return func(next Handler[EventT]) Handler[EventT] {
+		var mutex sync.Mutex
+		history := make(map[string][]time.Time) // times of the passed events by author
+
+		return func(ctx context.Context, client *botsky.Client, events []*EventT) error {
+			now := time.Now()
+			mutex.Lock()
+			for did, times := range history {
+				// drop the times which are out of the window
+				i := 0
+				for i < len(times) && now.Sub(times[i]) >= window {
+					i++
+				}
+				if i == len(times) {
+					delete(history, did)
+				} else {
+					history[did] = times[i:]
+				}
+			}
+			passed := make([]*EventT, 0, len(events))
+			for _, event := range events {
+				did := author(event)
+				if len(history[did]) >= limit {
+					client.Logger().Debug("Author rate limited, dropping event", "handler", ctx.Value("id"), "author", did)
+					continue
+				}
+				history[did] = append(history[did], now)
+				passed = append(passed, event)
+			}
+			mutex.Unlock()
+
+			if len(passed) == 0 {
+				return nil
+			}
+			err := next(ctx, client, passed)
+			if err != nil {
+				// don't count failed events, so retries and replays aren't dropped
+				mutex.Lock()
+				defer mutex.Unlock()
+				for _, event := range failedEvents(err, passed) {
+					did := author(event)
+					if i := slices.Index(history[did], now); i >= 0 {
+						history[did] = slices.Delete(history[did], i, i+1)
+					}
+				}
+			}
+			return err
+		}
+	}
+}
+
+// Log every invocation with the handler id, number of events, duration and error.
+func Logging[EventT any](logger *slog.Logger) Middleware[EventT] {
+	return func(next Handler[EventT]) Handler[EventT] {
+		return func(ctx context.Context, client *botsky.Client, events []*EventT) error {
+			start := time.Now()
+			err := next(ctx, client, events)
+			if err != nil {
+				logger.ErrorContext(ctx, "Handler failed", "handler", ctx.Value("id"), "events", len(events), "duration", time.Since(start), "error", err)
+			} else {
+				logger.InfoContext(ctx, "Handler succeeded", "handler", ctx.Value("id"), "events", len(events), "duration", time.Since(start))
+			}
+			return err
+		}
+	}
+}
+
+// Author of a notification, for FilterSelf and RateLimitAuthors.
+func NotificationAuthor(notif *bsky.NotificationListNotifications_Notification) string {
+	if notif.Author == nil {
+		return ""
+	}
+	return notif.Author.Did
+}
+
+// ID of a notification, for Dedupe.
+func NotificationID(notif *bsky.NotificationListNotifications_Notification) (string, bool) {
+	return notif.Uri, notif.Uri != ""
+}
+
+// Sender of a created or deleted chat message, for FilterSelf and RateLimitAuthors. Empty for other logs.
+func ChatLogAuthor(elem *chat.ConvoGetLog_Output_Logs_Elem) string {
+	var message *chat.ConvoDefs_MessageView
+	var deleted *chat.ConvoDefs_DeletedMessageView
+	switch {
+	case elem.ConvoDefs_LogCreateMessage != nil && elem.ConvoDefs_LogCreateMessage.Message != nil:
+		message = elem.ConvoDefs_LogCreateMessage.Message.ConvoDefs_MessageView
+		deleted = elem.ConvoDefs_LogCreateMessage.Message.ConvoDefs_DeletedMessageView
+	case elem.ConvoDefs_LogDeleteMessage != nil && elem.ConvoDefs_LogDeleteMessage.Message != nil:
+		message = elem.ConvoDefs_LogDeleteMessage.Message.ConvoDefs_MessageView
+		deleted = elem.ConvoDefs_LogDeleteMessage.Message.ConvoDefs_DeletedMessageView
+	}
+	if message != nil && message.Sender != nil {
+		return message.Sender.Did
+	}
+	if deleted != nil && deleted.Sender != nil {
+		return deleted.Sender.Did
+	}
+	return ""
+}
+
+// ID of a chat log (conversation and revision), for Dedupe. false for unknown kinds of logs.
+func ChatLogID(elem *chat.ConvoGetLog_Output_Logs_Elem) (string, bool) {
+	switch {
+	case elem.ConvoDefs_LogBeginConvo != nil:
+		return elem.ConvoDefs_LogBeginConvo.ConvoId + "/" + elem.ConvoDefs_LogBeginConvo.Rev, true
+	case elem.ConvoDefs_LogLeaveConvo != nil:
+		return elem.ConvoDefs_LogLeaveConvo.ConvoId + "/" + elem.ConvoDefs_LogLeaveConvo.Rev, true
+	case elem.ConvoDefs_LogCreateMessage != nil:
+		return elem.ConvoDefs_LogCreateMessage.ConvoId + "/" + elem.ConvoDefs_LogCreateMessage.Rev, true
+	case elem.ConvoDefs_LogDeleteMessage != nil:
+		return elem.ConvoDefs_LogDeleteMessage.ConvoId + "/" + elem.ConvoDefs_LogDeleteMessage.Rev, true
+	}
+	return "", false
+}
+
+// Author of a stream event, for FilterSelf and RateLimitAuthors.
+func StreamEventAuthor(event *StreamEvent) string {
+	return event.Did
+}
+
+// ID of a stream event (record URI, CID and operation), for Dedupe.
+func StreamEventID(event *StreamEvent) (string, bool) {
+	return event.Uri + " " + event.Cid + " " + string(event.Type), event.Uri != ""
+}
@@ -0,0 +1,81 @@
+package listeners
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/davhofer/botsky/pkg/botsky"
+	"github.com/davhofer/indigo/api/chat"
+)
+
+// Middleware recording its name when called.
+func tracing[EventT any](name string, trace *[]string) Middleware[EventT] {
+	return func(next Handler[EventT]) Handler[EventT] {
+		return func(ctx context.Context, client *botsky.Client, events []*EventT) error {
+			*trace = append(*trace, name)
+			return next(ctx, client, events)
+		}
+	}
+}
+
+func TestUse(t *testing.T) {
+	l := NewListener[int](context.Background(), newTestClient(t), "test", nil)
+	var trace []string
+	var handled []int
+	handler := func(ctx context.Context, client *botsky.Client, events []*int) error {
+		for _, event := range events {
+			handled = append(handled, *event)
+		}
+		return nil
+	}
+	id := func(event *int) (string, bool) { return strconv.Itoa(*event), true }
+	invoke := func(handler string, events ...int) {
+		var batch []*int
+		for _, event := range events {
+			batch = append(batch, &event)
+		}
+		if err := l.invoke(context.Background(), l.handlers[handler], batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	l.RegisterHandler("before", handler)
+	l.Use(tracing[int]("a", &trace), Dedupe(id, time.Hour))
+	invoke("before", 1, 2)
+	l.Use(tracing[int]("b", &trace))
+	invoke("before", 2, 3)
+	// the dedupe state survived adding middleware
+	if want := []int{1, 2, 3}; !slices.Equal(handled, want) {
+		t.Errorf("handled %v, want %v", handled, want)
+	}
+
+	// later middleware wraps the earlier one, also for handlers registered afterwards
+	l.RegisterHandler("after", handler)
+	trace = nil
+	invoke("before", 4)
+	invoke("after", 4)
+	if want := []string{"b", "a", "b", "a"}; !slices.Equal(trace, want) {
+		t.Errorf("middleware order %v, want %v", trace, want)
+	}
+}
+
+func TestDedupeWithoutID(t *testing.T) {
+	var handled int
+	handler := Dedupe(ChatLogID, time.Hour)(func(ctx context.Context, client *botsky.Client, events []*chat.ConvoGetLog_Output_Logs_Elem) error {
+		handled += len(events)
+		return nil
+	})
+	known := &chat.ConvoGetLog_Output_Logs_Elem{ConvoDefs_LogBeginConvo: &chat.ConvoDefs_LogBeginConvo{ConvoId: "convo", Rev: "1"}}
+	unknown := &chat.ConvoGetLog_Output_Logs_Elem{}
+	client := newTestClient(t)
+	for i := 0; i < 2; i++ {
+		handler(context.Background(), client, []*chat.ConvoGetLog_Output_Logs_Elem{known, unknown, {}})
+	}
+	// the known log is handled once, logs without an ID every time
+	if handled != 5 {
+		t.Errorf("handled %d logs, want 5", handled)
+	}
+}
@@ -2,44 +2,234 @@ package listeners
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
 	"github.com/davhofer/botsky/pkg/botsky"
 
 	"github.com/davhofer/indigo/api/bsky"
 )
 
+// Maximum number of notifications delivered by a single poll. If there are more, the oldest are delivered first.
+const maxNotificationsPerPoll = 1000
+
 // Instantiation of the (polling) listenerBase for handling notifications.
+//
+// Every notification is delivered once: the listener pages back to the newest notification it already delivered
+// (the high-water mark, see NotificationCursor). Once the handlers acknowledged them, notifications are marked
+// as seen up to the newest one.
 type PollingNotificationListener struct {
 	Listener[bsky.NotificationListNotifications_Notification]
+	state *notificationState
+}
+
+// Position of a PollingNotificationListener: the indexedAt of the newest delivered notification, and the CIDs
+// of the delivered notifications indexed at that time. Can be persisted and restored with SetCursor.
+type NotificationCursor struct {
+	IndexedAt string   `json:"indexedAt"`
+	Cids      []string `json:"cids"`
 }
 
 // Returns an set up PollingNotificationListener.
+//
+// Without a cursor (see SetCursor), the listener starts with the notifications that weren't marked as seen yet.
 func NewPollingNotificationListener(ctx context.Context, client *botsky.Client) *PollingNotificationListener {
-	return &PollingNotificationListener{*NewListener(ctx, client, "PollingNotificationListener", pollNotifications)}
+	state := &notificationState{client: client}
+	l := &PollingNotificationListener{
+		Listener: *NewListener(ctx, client, "PollingNotificationListener", state.poll),
+		state:    state,
+	}
+	l.checkpointer = state
+	l.source = func(ctx context.Context, handlerCtx context.Context) {
+		// notifications which were delivered but not acknowledged in a previous run are delivered again
+		state.rewind()
+		l.poll(ctx, handlerCtx)
+	}
+	return l
 }
 
-// Get all unread notifications (and set them to "read" afterwards).
-func pollNotifications(ctx context.Context, client *botsky.Client) ([]*bsky.NotificationListNotifications_Notification, error) {
-	count, err := client.NotifGetUnreadCount(ctx)
-	if err != nil {
-		return nil, err
+// Cursor of the newest notification acknowledged by the handlers, for persisting it and resuming with SetCursor.
+//
+// Alternatively, set a CheckpointStore, which persists the cursor once the handlers acknowledged the notifications.
+func (l *PollingNotificationListener) Cursor() NotificationCursor {
+	return l.state.cursor()
+}
+
+// Continue after the given cursor: only notifications that weren't delivered yet are passed to the handlers.
+func (l *PollingNotificationListener) SetCursor(cursor NotificationCursor) error {
+	return l.state.setCursor(cursor)
+}
+
+// High-water marks of the delivered and the acknowledged notifications.
+type notificationState struct {
+	client    *botsky.Client
+	mutex     sync.Mutex
+	mark      time.Time          // indexedAt of the newest delivered notification
+	cids      map[string]bool    // delivered notifications indexed at mark
+	inclusive bool               // whether all notifications indexed at mark were delivered (mark taken from the server's seenAt)
+	acked     NotificationCursor // newest notification acknowledged by the handlers
+}
+
+func (s *notificationState) cursor() NotificationCursor {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.acked
+}
+
+// Cursor of the newest delivered notification.
+func (s *notificationState) delivered() NotificationCursor {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.mark.IsZero() {
+		return NotificationCursor{}
+	}
+	cids := slices.Sorted(maps.Keys(s.cids))
+	return NotificationCursor{IndexedAt: s.mark.UTC().Format(time.RFC3339Nano), Cids: cids}
+}
+
+func (s *notificationState) setCursor(cursor NotificationCursor) error {
+	mark, err := time.Parse(time.RFC3339Nano, cursor.IndexedAt)
+	if err != nil && cursor.IndexedAt != "" {
+		return fmt.Errorf("SetCursor error (time.Parse): %w", err)
+	}
+	cids := make(map[string]bool, len(cursor.Cids))
+	for _, cid := range cursor.Cids {
+		cids[cid] = true
 	}
-	if count == 0 {
-		return []*bsky.NotificationListNotifications_Notification{}, nil
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.mark, s.cids, s.inclusive = mark, cids, false
+	s.acked = cursor
+	return nil
+}
+
+// Continue polling after the acknowledged notifications.
+func (s *notificationState) rewind() {
+	if err := s.setCursor(s.cursor()); err != nil {
+		s.client.Logger().Error("Restoring notification cursor failed", "error", err)
 	}
+}
+
+// The position after the polled notifications, acknowledged once the handlers handled them.
+func (s *notificationState) checkpoint() ([]byte, error) {
+	return json.Marshal(s.delivered())
+}
 
-	fmt.Println("listener:", count, "new notifications")
+// Move the cursor and mark the notifications as seen up to the acknowledged ones.
+func (s *notificationState) acknowledged(ctx context.Context, checkpoint []byte) {
+	var cursor NotificationCursor
+	if err := json.Unmarshal(checkpoint, &cursor); err != nil {
+		s.client.Logger().Error("Decoding notification cursor failed", "error", err)
+		return
+	}
+	s.mutex.Lock()
+	s.acked = cursor
+	s.mutex.Unlock()
 
-	notifications, err := client.NotifGetNotifications(ctx, count)
+	seenAt, err := time.Parse(time.RFC3339Nano, cursor.IndexedAt)
 	if err != nil {
-		return nil, err
+		return
+	}
+	// notifications arriving in the meantime are newer, so they stay unseen
+	if err := s.client.NotifUpdateSeenAt(ctx, seenAt); err != nil {
+		s.client.Logger().Warn("Marking notifications as seen failed", "error", err)
 	}
+}
 
-	// mark notifications as seen
-	if err := client.NotifUpdateSeen(ctx); err != nil {
-		return nil, err
+func (s *notificationState) restore(checkpoint []byte) error {
+	var cursor NotificationCursor
+	if err := json.Unmarshal(checkpoint, &cursor); err != nil {
+		return err
 	}
+	return s.setCursor(cursor)
+}
+
+// Get the notifications newer than the high-water mark, at most maxNotificationsPerPoll of the oldest ones.
+func (s *notificationState) poll(ctx context.Context, client *botsky.Client) ([]*bsky.NotificationListNotifications_Notification, error) {
+	s.mutex.Lock()
+	mark, cids, inclusive := s.mark, s.cids, s.inclusive
+	s.mutex.Unlock()
 
+	if mark.IsZero() {
+		// continue after the notifications which were last marked as seen
+		_, _, seenAt, err := client.NotifListNotifications(ctx, "", 1)
+		if err != nil {
+			return nil, err
+		}
+		if mark, err = time.Parse(time.RFC3339Nano, seenAt); err != nil {
+			// never marked as seen, only deliver new notifications
+			mark = time.Now()
+		}
+		inclusive = true
+		s.mutex.Lock()
+		s.mark, s.cids, s.inclusive = mark, nil, true
+		s.mutex.Unlock()
+	}
+
+	// page back to the high-water mark
+	var notifications []*bsky.NotificationListNotifications_Notification
+	cursor, skipped := "", 0
+	for {
+		page, next, _, err := client.NotifListNotifications(ctx, cursor, 100)
+		if err != nil {
+			return nil, err
+		}
+		reachedMark := false
+		for _, notif := range page {
+			indexedAt, err := time.Parse(time.RFC3339Nano, notif.IndexedAt)
+			if err != nil {
+				client.Logger().Warn("Skipping notification with invalid indexedAt", "uri", notif.Uri, "indexedAt", notif.IndexedAt)
+				continue
+			}
+			if indexedAt.Before(mark) {
+				reachedMark = true
+				break
+			}
+			if indexedAt.Equal(mark) && (inclusive || cids[notif.Cid]) {
+				continue
+			}
+			notifications = append(notifications, notif)
+		}
+		// pages are sorted newest first, keep the oldest notifications
+		if excess := len(notifications) - maxNotificationsPerPoll; excess > 0 {
+			notifications = slices.Delete(notifications, 0, excess)
+			skipped += excess
+		}
+		if reachedMark || next == "" || len(page) == 0 {
+			break
+		}
+		cursor = next
+	}
+	if skipped > 0 {
+		client.Logger().Warn("Too many new notifications, delivering the oldest first", "count", len(notifications), "remaining", skipped)
+	}
+	if len(notifications) == 0 {
+		return notifications, nil
+	}
+
+	// move the high-water mark to the newest delivered notification
+	newest := mark
+	for _, notif := range notifications {
+		if indexedAt, _ := time.Parse(time.RFC3339Nano, notif.IndexedAt); indexedAt.After(newest) {
+			newest = indexedAt
+		}
+	}
+	newCids := make(map[string]bool)
+	if newest.Equal(mark) {
+		maps.Copy(newCids, cids)
+	}
+	for _, notif := range notifications {
+		if indexedAt, _ := time.Parse(time.RFC3339Nano, notif.IndexedAt); indexedAt.Equal(newest) {
+			newCids[notif.Cid] = true
+		}
+	}
+	s.mutex.Lock()
+	s.mark, s.cids, s.inclusive = newest, newCids, inclusive && newest.Equal(mark)
+	s.mutex.Unlock()
 	return notifications, nil
 }
 
@@ -0,0 +1,233 @@
+package listeners
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/davhofer/botsky/pkg/botsky"
+	"github.com/davhofer/indigo/api/bsky"
+)
+
+var notificationEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Local stand-in for the notification endpoints of a PDS.
+type notificationPDS struct {
+	*httptest.Server
+	mutex         sync.Mutex
+	notifications []*notification // newest first
+	seenAt        time.Time
+	updates       []time.Time // seenAt of every updateSeen call
+}
+
+func newNotificationPDS(t *testing.T, count int) *notificationPDS {
+	pds := &notificationPDS{seenAt: notificationEpoch}
+	for i := count; i >= 1; i-- {
+		pds.notifications = append(pds.notifications, &notification{
+			Uri:       fmt.Sprintf("at://did:plc:alice/app.bsky.graph.follow/%d", i),
+			Cid:       fmt.Sprintf("cid%d", i),
+			Reason:    "follow",
+			IndexedAt: notificationEpoch.Add(time.Duration(i) * time.Millisecond).Format(time.RFC3339Nano),
+			Author:    &bsky.ActorDefs_ProfileView{Did: "did:plc:alice"},
+		})
+	}
+	pds.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pds.mutex.Lock()
+		defer pds.mutex.Unlock()
+		switch r.URL.Path {
+		case "/xrpc/app.bsky.notification.listNotifications":
+			offset, _ := strconv.Atoi(r.URL.Query().Get("cursor"))
+			limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+			end := min(offset+limit, len(pds.notifications))
+			seenAt := pds.seenAt.Format(time.RFC3339Nano)
+			output := bsky.NotificationListNotifications_Output{Notifications: pds.notifications[offset:end], SeenAt: &seenAt}
+			if end < len(pds.notifications) {
+				next := strconv.Itoa(end)
+				output.Cursor = &next
+			}
+			json.NewEncoder(w).Encode(output)
+		case "/xrpc/app.bsky.notification.updateSeen":
+			var input bsky.NotificationUpdateSeen_Input
+			json.NewDecoder(r.Body).Decode(&input)
+			seenAt, _ := time.Parse(time.RFC3339Nano, input.SeenAt)
+			pds.seenAt = seenAt
+			pds.updates = append(pds.updates, seenAt)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(pds.Close)
+	return pds
+}
+
+func (pds *notificationPDS) seenUpdates() []time.Time {
+	pds.mutex.Lock()
+	defer pds.mutex.Unlock()
+	return slices.Clone(pds.updates)
+}
+
+func newTestNotificationListener(t *testing.T, pds *notificationPDS) *PollingNotificationListener {
+	l := NewPollingNotificationListener(context.Background(), newTestClient(t, botsky.WithPDSHost(pds.URL)))
+	l.SetPollingStrategy(PollingStrategy{Interval: 10 * time.Millisecond})
+	return l
+}
+
+// Index of the notification, from its uri.
+func notificationIndex(n *notification) int {
+	var i int
+	fmt.Sscanf(n.Uri, "at://did:plc:alice/app.bsky.graph.follow/%d", &i)
+	return i
+}
+
+func waitUntil(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Notifications are only marked as seen, and the cursor only moves, once the handlers acknowledged them.
+func TestNotificationsAcknowledged(t *testing.T) {
+	pds := newNotificationPDS(t, 3)
+	l := newTestNotificationListener(t, pds)
+	h := newBlockingHandler()
+	var mutex sync.Mutex
+	var delivered []int
+	l.RegisterHandler("h", func(ctx context.Context, client *botsky.Client, events []*notification) error {
+		mutex.Lock()
+		for _, n := range events {
+			delivered = append(delivered, notificationIndex(n))
+		}
+		mutex.Unlock()
+		return h.handle(ctx, client, nil)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error)
+	go func() { done <- l.Run(ctx) }()
+
+	<-h.started
+	// further polls while the batch is handled don't deliver it again
+	time.Sleep(50 * time.Millisecond)
+	if updates := pds.seenUpdates(); len(updates) != 0 {
+		t.Errorf("marked as seen before the handler returned: %v", updates)
+	}
+	if cursor := l.Cursor(); cursor.IndexedAt != "" {
+		t.Errorf("cursor moved before the handler returned: %+v", cursor)
+	}
+
+	close(h.release)
+	newest := notificationEpoch.Add(3 * time.Millisecond)
+	waitUntil(t, "updateSeen", func() bool { return len(pds.seenUpdates()) > 0 })
+	if updates := pds.seenUpdates(); !updates[0].Equal(newest) {
+		t.Errorf("seenAt = %v, want %v", updates[0], newest)
+	}
+	if cursor := l.Cursor(); cursor.IndexedAt != newest.Format(time.RFC3339Nano) || !slices.Equal(cursor.Cids, []string{"cid3"}) {
+		t.Errorf("cursor = %+v", cursor)
+	}
+
+	cancel()
+	<-done
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !slices.Equal(delivered, []int{3, 2, 1}) {
+		t.Errorf("delivered %v, want [3 2 1]", delivered)
+	}
+}
+
+// Notifications which weren't acknowledged when the listener was stopped are delivered by the next run.
+func TestNotificationsRedeliveredAfterStop(t *testing.T) {
+	pds := newNotificationPDS(t, 2)
+	l := newTestNotificationListener(t, pds)
+	var mutex sync.Mutex
+	var batches [][]int
+	started := make(chan struct{}, 1)
+	l.RegisterHandler("h", func(ctx context.Context, client *botsky.Client, events []*notification) error {
+		var batch []int
+		for _, n := range events {
+			batch = append(batch, notificationIndex(n))
+		}
+		mutex.Lock()
+		batches = append(batches, batch)
+		first := len(batches) == 1
+		mutex.Unlock()
+		if first {
+			started <- struct{}{}
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	})
+
+	go l.Run(context.Background())
+	<-started
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	l.Shutdown(shutdownCtx)
+	waitUntil(t, "stop", func() bool { return !l.IsActive() })
+	if updates := pds.seenUpdates(); len(updates) != 0 {
+		t.Errorf("cancelled batch was marked as seen: %v", updates)
+	}
+
+	ctx, cancelRun := context.WithCancel(context.Background())
+	defer cancelRun()
+	go l.Run(ctx)
+	waitUntil(t, "redelivery", func() bool { return len(pds.seenUpdates()) > 0 })
+	mutex.Lock()
+	defer mutex.Unlock()
+	if want := [][]int{{2, 1}, {2, 1}}; !slices.EqualFunc(batches, want, slices.Equal) {
+		t.Errorf("batches %v, want %v", batches, want)
+	}
+}
+
+// With more than maxNotificationsPerPoll new notifications, the oldest are delivered first and none are lost.
+func TestNotificationsBacklog(t *testing.T) {
+	count := maxNotificationsPerPoll + 150
+	pds := newNotificationPDS(t, count)
+	l := newTestNotificationListener(t, pds)
+	var mutex sync.Mutex
+	var batches [][]int
+	l.RegisterHandler("h", func(ctx context.Context, client *botsky.Client, events []*notification) error {
+		var batch []int
+		for _, n := range events {
+			batch = append(batch, notificationIndex(n))
+		}
+		mutex.Lock()
+		batches = append(batches, batch)
+		mutex.Unlock()
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go l.Run(ctx)
+	newest := notificationEpoch.Add(time.Duration(count) * time.Millisecond)
+	waitUntil(t, "all notifications seen", func() bool {
+		updates := pds.seenUpdates()
+		return len(updates) > 0 && updates[len(updates)-1].Equal(newest)
+	})
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(batches) != 2 || len(batches[0]) != maxNotificationsPerPoll {
+		t.Fatalf("got %d batches, want the oldest %d notifications first and then the rest", len(batches), maxNotificationsPerPoll)
+	}
+	if slices.Max(batches[0]) != maxNotificationsPerPoll || slices.Min(batches[1]) != maxNotificationsPerPoll+1 {
+		t.Errorf("first batch %d..%d, second batch %d..%d", slices.Min(batches[0]), slices.Max(batches[0]), slices.Min(batches[1]), slices.Max(batches[1]))
+	}
+	if total := len(batches[0]) + len(batches[1]); total != count {
+		t.Errorf("delivered %d notifications, want %d", total, count)
+	}
+}
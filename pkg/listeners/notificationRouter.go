@@ -0,0 +1,231 @@
+package listeners
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/davhofer/botsky/pkg/botsky"
+	"github.com/davhofer/indigo/api/bsky"
+)
+
+type notification = bsky.NotificationListNotifications_Notification
+
+// Handler for a single, typed event.
+type EventHandler[T any] func(ctx context.Context, client *botsky.Client, event *T) error
+
+// The bot was mentioned in a post.
+type MentionEvent struct {
+	*bsky.NotificationListNotifications_Notification
+	Post *botsky.RichPost // the post mentioning the bot
+}
+
+// Someone replied to one of the bot's posts.
+type ReplyEvent struct {
+	*bsky.NotificationListNotifications_Notification
+	Post   *botsky.RichPost // the reply
+	Parent *botsky.RichPost // the bot's post that was replied to, nil if it was deleted
+}
+
+// Someone quoted one of the bot's posts.
+type QuoteEvent struct {
+	*bsky.NotificationListNotifications_Notification
+	Post   *botsky.RichPost // the quoting post
+	Quoted *botsky.RichPost // the bot's quoted post, nil if it was deleted
+}
+
+// Someone liked one of the bot's posts (or e.g. its feed generator, then Subject is nil).
+type LikeEvent struct {
+	*bsky.NotificationListNotifications_Notification
+	Subject *botsky.RichPost // the liked post
+}
+
+// Someone reposted one of the bot's posts.
+type RepostEvent struct {
+	*bsky.NotificationListNotifications_Notification
+	Subject *botsky.RichPost // the reposted post
+}
+
+// Someone followed the bot. The follower is the notification's Author.
+type FollowEvent struct {
+	*bsky.NotificationListNotifications_Notification
+}
+
+// Someone joined Bluesky through one of the bot's starter packs.
+type StarterpackJoinedEvent struct {
+	*bsky.NotificationListNotifications_Notification
+	Starterpack string // uri of the starter pack
+}
+
+// Register a handler called for every mention, with the mentioning post.
+//
+// Like all routed handlers, it is registered as a regular handler with the given id and options.
+// Events of a batch are handled one after another. If the handler fails on some of them, a PartialError is
+// returned, so only the failed events are retried and dead-lettered.
+func (l *PollingNotificationListener) OnMention(id string, handler EventHandler[MentionEvent], options ...HandlerOption) error {
+	return route(l, id, "mention", func(n *notification, posts map[string]*botsky.RichPost) *MentionEvent {
+		post := posts[n.Uri]
+		if post == nil {
+			return nil
+		}
+		return &MentionEvent{NotificationListNotifications_Notification: n, Post: post}
+	}, handler, options)
+}
+
+// Register a handler called for every reply to the bot's posts, with the reply and the parent post.
+func (l *PollingNotificationListener) OnReply(id string, handler EventHandler[ReplyEvent], options ...HandlerOption) error {
+	return route(l, id, "reply", func(n *notification, posts map[string]*botsky.RichPost) *ReplyEvent {
+		post := posts[n.Uri]
+		if post == nil {
+			return nil
+		}
+		parent := subjectUri(n)
+		if post.Reply != nil && post.Reply.Parent != nil {
+			parent = post.Reply.Parent.Uri
+		}
+		return &ReplyEvent{NotificationListNotifications_Notification: n, Post: post, Parent: posts[parent]}
+	}, handler, options)
+}
+
+// Register a handler called for every quote of the bot's posts, with the quoting and the quoted post.
+func (l *PollingNotificationListener) OnQuote(id string, handler EventHandler[QuoteEvent], options ...HandlerOption) error {
+	return route(l, id, "quote", func(n *notification, posts map[string]*botsky.RichPost) *QuoteEvent {
+		post := posts[n.Uri]
+		if post == nil {
+			return nil
+		}
+		return &QuoteEvent{NotificationListNotifications_Notification: n, Post: post, Quoted: posts[subjectUri(n)]}
+	}, handler, options)
+}
+
+// Register a handler called for every like, with the liked post.
+func (l *PollingNotificationListener) OnLike(id string, handler EventHandler[LikeEvent], options ...HandlerOption) error {
+	return route(l, id, "like", func(n *notification, posts map[string]*botsky.RichPost) *LikeEvent {
+		return &LikeEvent{NotificationListNotifications_Notification: n, Subject: posts[subjectUri(n)]}
+	}, handler, options)
+}
+
+// Register a handler called for every repost, with the reposted post.
+func (l *PollingNotificationListener) OnRepost(id string, handler EventHandler[RepostEvent], options ...HandlerOption) error {
+	return route(l, id, "repost", func(n *notification, posts map[string]*botsky.RichPost) *RepostEvent {
+		return &RepostEvent{NotificationListNotifications_Notification: n, Subject: posts[subjectUri(n)]}
+	}, handler, options)
+}
+
+// Register a handler called for every new follower.
+func (l *PollingNotificationListener) OnFollow(id string, handler EventHandler[FollowEvent], options ...HandlerOption) error {
+	return route(l, id, "follow", func(n *notification, posts map[string]*botsky.RichPost) *FollowEvent {
+		return &FollowEvent{NotificationListNotifications_Notification: n}
+	}, handler, options)
+}
+
+// Register a handler called whenever someone joins through one of the bot's starter packs.
+func (l *PollingNotificationListener) OnStarterpackJoined(id string, handler EventHandler[StarterpackJoinedEvent], options ...HandlerOption) error {
+	return route(l, id, "starterpack-joined", func(n *notification, posts map[string]*botsky.RichPost) *StarterpackJoinedEvent {
+		event := &StarterpackJoinedEvent{NotificationListNotifications_Notification: n}
+		if n.ReasonSubject != nil {
+			event.Starterpack = *n.ReasonSubject
+		}
+		return event
+	}, handler, options)
+}
+
+// Register a handler called for every notification matching the filter.
+func (l *PollingNotificationListener) On(id string, filter func(*bsky.NotificationListNotifications_Notification) bool, handler EventHandler[bsky.NotificationListNotifications_Notification], options ...HandlerOption) error {
+	return l.RegisterHandler(id, func(ctx context.Context, client *botsky.Client, notifications []*notification) error {
+		var failed []*notification
+		var errs []error
+		for _, n := range notifications {
+			if !filter(n) {
+				continue
+			}
+			if err := handler(ctx, client, n); err != nil {
+				failed = append(failed, n)
+				errs = append(errs, err)
+			}
+		}
+		return partialError(failed, errs)
+	}, options...)
+}
+
+// Register a handler for the notifications with the given reason. The posts referenced by them are loaded
+// in one go and newEvent builds the typed event, or returns nil if the event should be skipped (e.g. deleted post).
+func route[T any](l *PollingNotificationListener, id string, reason string, newEvent func(*notification, map[string]*botsky.RichPost) *T, handler EventHandler[T], options []HandlerOption) error {
+	return l.RegisterHandler(id, func(ctx context.Context, client *botsky.Client, notifications []*notification) error {
+		var matched []*notification
+		var uris []string
+		for _, n := range notifications {
+			if n.Reason != reason {
+				continue
+			}
+			matched = append(matched, n)
+			for _, uri := range referencedPosts(n) {
+				if !slices.Contains(uris, uri) {
+					uris = append(uris, uri)
+				}
+			}
+		}
+		if len(matched) == 0 {
+			return nil
+		}
+
+		posts := make(map[string]*botsky.RichPost)
+		if len(uris) > 0 {
+			loaded, err := client.GetPostsByUris(ctx, uris)
+			if err != nil {
+				return err
+			}
+			for _, post := range loaded {
+				posts[post.Uri] = post
+			}
+		}
+
+		var failed []*notification
+		var errs []error
+		for _, n := range matched {
+			event := newEvent(n, posts)
+			if event == nil {
+				l.getLogger().Debug("Skipping notification, post not found", "reason", reason, "uri", n.Uri)
+				continue
+			}
+			if err := handler(ctx, client, event); err != nil {
+				failed = append(failed, n)
+				errs = append(errs, err)
+			}
+		}
+		return partialError(failed, errs)
+	}, options...)
+}
+
+// PartialError for the failed notifications, nil if there are none.
+func partialError(failed []*notification, errs []error) error {
+	if len(failed) == 0 {
+		return nil
+	}
+	return &PartialError[notification]{Failed: failed, Err: errors.Join(errs...)}
+}
+
+// Uri of the record the notification is about (e.g. the liked post), empty if there is none.
+func subjectUri(n *notification) string {
+	if n.ReasonSubject == nil {
+		return ""
+	}
+	return *n.ReasonSubject
+}
+
+// Uris of the posts a notification refers to: the notification's record, the subject and the parent of a reply.
+func referencedPosts(n *notification) []string {
+	var uris []string
+	for _, uri := range []string{n.Uri, subjectUri(n)} {
+		if strings.Contains(uri, "/app.bsky.feed.post/") {
+			uris = append(uris, uri)
+		}
+	}
+	if n.Record != nil {
+		if post, ok := n.Record.Val.(*bsky.FeedPost); ok && post.Reply != nil && post.Reply.Parent != nil {
+			uris = append(uris, post.Reply.Parent.Uri)
+		}
+	}
+	return uris
+}
@@ -0,0 +1,78 @@
+package listeners
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/davhofer/botsky/pkg/botsky"
+)
+
+func follows(authors ...string) []*notification {
+	var notifications []*notification
+	for _, author := range authors {
+		notifications = append(notifications, &notification{
+			Uri:    "at://" + author + "/app.bsky.graph.follow/1",
+			Reason: "follow",
+		})
+	}
+	return notifications
+}
+
+// A routed handler failing on some events only retries and dead-letters those.
+func TestRoutePartialFailure(t *testing.T) {
+	tests := []struct {
+		name      string
+		retries   int
+		failures  int // failures of did:plc:b before it succeeds
+		wantCalls map[string]int
+		wantDead  []string
+	}{
+		{name: "retried", retries: 2, failures: 1, wantCalls: map[string]int{"did:plc:a": 1, "did:plc:b": 2, "did:plc:c": 1}},
+		{name: "dead letter", retries: 1, failures: 5, wantCalls: map[string]int{"did:plc:a": 1, "did:plc:b": 2, "did:plc:c": 1}, wantDead: []string{"at://did:plc:b/app.bsky.graph.follow/1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewPollingNotificationListener(context.Background(), newTestClient(t))
+			var mutex sync.Mutex
+			calls := make(map[string]int)
+			sink := NewMemoryDeadLetterSink()
+			err := l.OnFollow("follows", func(ctx context.Context, client *botsky.Client, event *FollowEvent) error {
+				mutex.Lock()
+				defer mutex.Unlock()
+				author := event.Uri[len("at://"):len("at://did:plc:a")]
+				calls[author]++
+				if author == "did:plc:b" && calls[author] <= tt.failures {
+					return errors.New("failed")
+				}
+				return nil
+			}, WithHandlerRetry(tt.retries, time.Millisecond), WithDeadLetterSink(sink))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			l.runHandler(context.Background(), l.handlers["follows"], follows("did:plc:a", "did:plc:b", "did:plc:c"))
+
+			for author, want := range tt.wantCalls {
+				if calls[author] != want {
+					t.Errorf("%s handled %d times, want %d", author, calls[author], want)
+				}
+			}
+			letters, _ := sink.Drain(context.Background())
+			var dead []string
+			for _, letter := range letters {
+				var events []*notification
+				json.Unmarshal(letter.Events, &events)
+				for _, event := range events {
+					dead = append(dead, event.Uri)
+				}
+			}
+			if len(dead) != len(tt.wantDead) || (len(dead) > 0 && dead[0] != tt.wantDead[0]) {
+				t.Errorf("dead letters %v, want %v", dead, tt.wantDead)
+			}
+		})
+	}
+}
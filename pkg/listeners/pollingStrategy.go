@@ -0,0 +1,103 @@
+package listeners
+
+import (
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"github.com/davhofer/botsky/pkg/botsky"
+)
+
+// Default polling interval of the listeners.
+const DefaultPollingInterval = 5 * time.Second
+
+// Default strategy of the polling listeners: poll every 5s, back off on errors and add 10% jitter.
+var DefaultPollingStrategy = PollingStrategy{
+	Interval:   DefaultPollingInterval,
+	MaxBackoff: 5 * time.Minute,
+	Jitter:     0.1,
+}
+
+// How a polling listener adapts its interval, see Listener.SetPollingStrategy.
+type PollingStrategy struct {
+	Interval time.Duration // interval while there is activity, defaults to DefaultPollingInterval
+	// Maximum interval during quiet periods. After a poll without events, the interval is doubled up to IdleInterval,
+	// and reset to Interval once there are events again. 0 (or at most Interval) to always poll at Interval
+	IdleInterval time.Duration
+	// Maximum delay after consecutive failed polls. The delay is doubled for every failure, starting at Interval.
+	// Rate limited polls wait at least until the limit resets. 0 (or at most Interval) to retry at Interval
+	MaxBackoff time.Duration
+	Jitter     float64 // random variation of every delay, as a fraction (e.g. 0.1 for ±10%)
+}
+
+// Set the strategy for adapting the polling interval. Takes effect immediately, also while running.
+func (l *Listener[EventT]) SetPollingStrategy(strategy PollingStrategy) {
+	if strategy.Interval <= 0 {
+		strategy.Interval = DefaultPollingInterval
+	}
+	strategy.Jitter = min(max(strategy.Jitter, 0), 1)
+	l.mutex.Lock()
+	l.pollingStrategy = strategy
+	l.mutex.Unlock()
+
+	// notify the polling loop, if it isn't notified already
+	select {
+	case l.intervalChanged <- struct{}{}:
+	default:
+	}
+}
+
+// Strategy for adapting the polling interval.
+func (l *Listener[EventT]) PollingStrategy() PollingStrategy {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.pollingStrategy
+}
+
+// State of the adaptive polling interval.
+type pollBackoff struct {
+	failures int           // consecutive failed polls
+	idle     time.Duration // interval during the current quiet period, 0 after activity
+}
+
+// Delay until the first poll.
+func (s PollingStrategy) first() time.Duration {
+	return s.jitter(s.Interval)
+}
+
+// Delay until the next poll, given the result of the last one.
+func (s PollingStrategy) next(b *pollBackoff, events int, err error) time.Duration {
+	delay := s.Interval
+	switch {
+	case err != nil:
+		b.failures++
+		if s.MaxBackoff > s.Interval {
+			for i := 1; i < b.failures && delay < s.MaxBackoff; i++ {
+				delay *= 2
+			}
+			delay = min(delay, s.MaxBackoff)
+		}
+		var xrpcErr *botsky.XRPCError
+		if errors.Is(err, botsky.ErrRateLimited) && errors.As(err, &xrpcErr) && xrpcErr.RateLimit != nil {
+			// don't poll again before the limit resets
+			delay = max(delay, time.Until(xrpcErr.RateLimit.Reset))
+		}
+	case events > 0:
+		b.failures, b.idle = 0, 0
+	default:
+		b.failures = 0
+		if s.IdleInterval > s.Interval {
+			b.idle = min(max(2*b.idle, s.Interval), s.IdleInterval)
+			delay = b.idle
+		}
+	}
+	return s.jitter(delay)
+}
+
+// Vary the delay randomly by up to ±Jitter.
+func (s PollingStrategy) jitter(delay time.Duration) time.Duration {
+	if s.Jitter <= 0 || delay <= 0 {
+		return delay
+	}
+	return delay + time.Duration((rand.Float64()*2-1)*s.Jitter*float64(delay))
+}
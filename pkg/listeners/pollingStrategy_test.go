@@ -0,0 +1,63 @@
+package listeners
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/davhofer/botsky/pkg/botsky"
+	"github.com/davhofer/indigo/xrpc"
+)
+
+func TestPollingStrategyNext(t *testing.T) {
+	failed := errors.New("failed")
+	type poll struct {
+		events int
+		err    error
+	}
+	tests := []struct {
+		name     string
+		strategy PollingStrategy
+		polls    []poll
+		want     []time.Duration
+	}{
+		{
+			name:     "backoff starts at interval",
+			strategy: PollingStrategy{Interval: time.Second, MaxBackoff: 10 * time.Second},
+			polls:    []poll{{err: failed}, {err: failed}, {err: failed}, {err: failed}, {err: failed}, {events: 1}},
+			want:     []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, time.Second},
+		},
+		{
+			name:     "no backoff",
+			strategy: PollingStrategy{Interval: time.Second},
+			polls:    []poll{{err: failed}, {err: failed}},
+			want:     []time.Duration{time.Second, time.Second},
+		},
+		{
+			name:     "idle",
+			strategy: PollingStrategy{Interval: time.Second, IdleInterval: 5 * time.Second},
+			polls:    []poll{{}, {}, {}, {}, {events: 1}, {}},
+			want:     []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, time.Second, time.Second},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var backoff pollBackoff
+			for i, p := range tt.polls {
+				if got := tt.strategy.next(&backoff, p.events, p.err); got != tt.want[i] {
+					t.Errorf("poll %d: delay = %v, want %v", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+
+	t.Run("rate limited", func(t *testing.T) {
+		strategy := PollingStrategy{Interval: time.Second, MaxBackoff: 10 * time.Second}
+		reset := time.Now().Add(time.Minute)
+		err := fmt.Errorf("poll: %w", &botsky.XRPCError{StatusCode: 429, RateLimit: &xrpc.RatelimitInfo{Reset: reset}})
+		if got := strategy.next(&pollBackoff{}, 0, err); got < 59*time.Second {
+			t.Errorf("delay = %v, want until the rate limit resets", got)
+		}
+	})
+}